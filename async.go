@@ -0,0 +1,282 @@
+package messengerbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy is what an asynchronous webhook does with new events when its queue is full
+type OverflowPolicy string
+
+const (
+	// BLOCK_WHEN_FULL makes Handler wait for room in the queue before answering
+	BLOCK_WHEN_FULL OverflowPolicy = "block"
+	// DROP_WHEN_FULL drops the events which do not fit and reports them to the error callback
+	DROP_WHEN_FULL OverflowPolicy = "drop"
+	// REJECT_WHEN_FULL answers 503 so Messenger delivers the request again later. None of the events of
+	// the request are queued unless they all fit, so they are not handled twice
+	REJECT_WHEN_FULL OverflowPolicy = "reject"
+)
+
+var (
+	ErrQueueFull    = errors.New("messengerbot: event queue is full")
+	ErrShuttingDown = errors.New("messengerbot: webhook is shutting down")
+	// ErrHandlerPanicked is a queued event whose handler panicked
+	ErrHandlerPanicked = errors.New("messengerbot: event handler panicked")
+)
+
+// eventQueue feeds the events received by an asynchronous webhook to its workers. Each worker has its own
+// queue, and all the events of a conversation go to the same worker
+type eventQueue struct {
+	mu     sync.RWMutex
+	shards []chan *Event
+	policy OverflowPolicy
+	closed bool
+	wg     sync.WaitGroup
+	// pending counts the events queued or being handled
+	pending int64
+}
+
+// syncRequests are the requests a synchronous webhook is handling
+type syncRequests struct {
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// dispatchSync handles the events of a request to a synchronous webhook, returning false once the webhook
+// is shutting down
+func (w *Webhook) dispatchSync(events []*Event) bool {
+	s := &w.requests
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		w.errorCallback(ErrShuttingDown)
+		return false
+	}
+	s.wg.Add(1)
+	s.mu.RUnlock()
+	defer s.wg.Done()
+	for _, e := range events {
+		w.dispatchLocked(e)
+	}
+	return true
+}
+
+// ProcessAsync makes Handler acknowledge requests as soon as their events are parsed and queued, and
+// starts workers goroutines handling the queued events. Events are sharded among the workers by page and
+// sender, so the events of a conversation are handled one at a time and in order while different
+// conversations are handled in parallel. queueSize bounds the number of events waiting for each worker,
+// policy decides what happens to events which do not fit. Call it once, before serving requests
+func (w *Webhook) ProcessAsync(workers, queueSize int, policy OverflowPolicy) {
+	if workers < 1 {
+		workers = 1
+	}
+	q := new(eventQueue)
+	q.policy = policy
+	for i := 0; i < workers; i++ {
+		shard := make(chan *Event, queueSize)
+		q.shards = append(q.shards, shard)
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for e := range shard {
+				w.dispatchQueued(e)
+				atomic.AddInt64(&q.pending, -1)
+			}
+		}()
+	}
+	w.queue = q
+}
+
+// dispatchQueued handles a queued event, reporting a panicking handler to the error callback instead of
+// stopping the worker
+func (w *Webhook) dispatchQueued(e *Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			w.errorCallback(&EventError{e, fmt.Errorf("%w : %v", ErrHandlerPanicked, r)})
+		}
+	}()
+	w.dispatch(e)
+}
+
+// QueueLength returns the number of events waiting for the workers of an asynchronous webhook
+func (w *Webhook) QueueLength() int {
+	if w.queue == nil {
+		return 0
+	}
+	n := 0
+	for _, shard := range w.queue.shards {
+		n += len(shard)
+	}
+	return n
+}
+
+// Shutdown stops the webhook from accepting requests, which are answered with 503 and reported to the error
+// callback as ErrShuttingDown, and waits until the queued and running events are handled, then until the
+// paced replies and the messages queued in the outbox are sent, or until ctx is done, returning ctx.Err()
+// in that case. Messages not sent stay pending in the outbox
+func (w *Webhook) Shutdown(ctx context.Context) error {
+	if q := w.queue; q != nil {
+		q.mu.Lock()
+		if !q.closed {
+			q.closed = true
+			for _, shard := range q.shards {
+				close(shard)
+			}
+		}
+		q.mu.Unlock()
+		if err := waitGroup(ctx, &q.wg); err != nil {
+			return err
+		}
+	} else {
+		w.requests.mu.Lock()
+		w.requests.closed = true
+		w.requests.mu.Unlock()
+		if err := waitGroup(ctx, &w.requests.wg); err != nil {
+			return err
+		}
+	}
+	if p := w.pacer; p != nil {
+		if err := waitGroup(ctx, &p.wg); err != nil {
+			return err
+		}
+	}
+	if o := w.outbox; o != nil {
+		o.close()
+		if err := waitGroup(ctx, &o.wg); err != nil {
+			o.abort()
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush waits until the events received so far are handled, and the paced replies and the messages queued
+// in the outbox are sent, or until ctx is done, returning ctx.Err() in that case. Unlike Shutdown it keeps
+// the webhook accepting requests, so under steady traffic it may only return when ctx is done. It tells a
+// deploy script or an admin endpoint that the bot has caught up, and lets tests read the replies to one
+// request before sending the next. Messages failing in the outbox count as sent once they are given up on
+func (w *Webhook) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for !w.idle() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// idle reports whether the webhook has nothing left to do. Work only moves from the queue to the pacer
+// and from the pacer to the outbox, so checking them in that order does not miss any
+func (w *Webhook) idle() bool {
+	if q := w.queue; q != nil && atomic.LoadInt64(&q.pending) > 0 {
+		return false
+	}
+	if p := w.pacer; p != nil {
+		p.mu.Lock()
+		n := len(p.queues)
+		p.mu.Unlock()
+		if n > 0 {
+			return false
+		}
+	}
+	if o := w.outbox; o != nil && !o.idle() {
+		return false
+	}
+	return true
+}
+
+// waitGroup waits for wg, or until ctx is done
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// enqueue queues the events according to the overflow policy, returning whether the request should be
+// acknowledged
+func (q *eventQueue) enqueue(w *Webhook, events []*Event) bool {
+	if q.policy == REJECT_WHEN_FULL {
+		// the room left cannot shrink between checking it and queueing the events
+		q.mu.Lock()
+		defer q.mu.Unlock()
+	} else {
+		q.mu.RLock()
+		defer q.mu.RUnlock()
+	}
+	if q.closed {
+		w.errorCallback(ErrShuttingDown)
+		return false
+	}
+	if q.policy == REJECT_WHEN_FULL && !q.fits(events) {
+		w.errorCallback(ErrQueueFull)
+		return false
+	}
+	for _, e := range events {
+		shard := q.shards[shardIndex(conversationKey(e), len(q.shards))]
+		atomic.AddInt64(&q.pending, 1)
+		if q.policy != DROP_WHEN_FULL {
+			shard <- e
+			continue
+		}
+		select {
+		case shard <- e:
+		default:
+			atomic.AddInt64(&q.pending, -1)
+			w.errorCallback(&EventError{e, ErrQueueFull})
+		}
+	}
+	return true
+}
+
+// fits reports whether the queues of the workers have room for all the events
+func (q *eventQueue) fits(events []*Event) bool {
+	needed := make([]int, len(q.shards))
+	for _, e := range events {
+		needed[shardIndex(conversationKey(e), len(q.shards))]++
+	}
+	for i, shard := range q.shards {
+		if len(shard)+needed[i] > cap(shard) {
+			return false
+		}
+	}
+	return true
+}
+
+// shardIndex picks the worker of a conversation among n
+func shardIndex(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// EventError is an error about an event, such as an event dropped from a full queue
+type EventError struct {
+	Event *Event
+	Err   error
+}
+
+func (e *EventError) Error() string {
+	return e.Err.Error() + " : " + string(e.Event.Type) + " event from " + e.Event.Sender.Id
+}
+
+func (e *EventError) Unwrap() error {
+	return e.Err
+}
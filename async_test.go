@@ -0,0 +1,259 @@
+package messengerbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingWebhook returns an asynchronous webhook whose text message callback reports each text on started
+// and then waits for release
+func blockingWebhook(workers, queueSize int, policy OverflowPolicy) (*Webhook, chan string, chan struct{},
+	func() []error) {
+	w := NewMessengerWebhook("token", "token")
+	started := make(chan string, 100)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var errs []error
+	w.ErrorHandler(func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	})
+	w.MessageHandler(func(pageId string, s Sender, r Recipient, ts time.Time, m IncomingTextMessage) bool {
+		started <- m.Text
+		<-release
+		return true
+	})
+	w.ProcessAsync(workers, queueSize, policy)
+	return w, started, release, func() []error {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]error{}, errs...)
+	}
+}
+
+func textBody(text string) string {
+	return textFrom("user", text)
+}
+
+func textFrom(sender, text string) string {
+	return fmt.Sprintf(`{"object":"page","entry":[{"id":"page","messaging":[{"sender":{"id":%q},
+		"recipient":{"id":"page"},"timestamp":1458692752478,"message":{"mid":"mid.1","seq":1,"text":%q}}]}]}`,
+		sender, text)
+}
+
+func TestAsyncAcknowledgesBeforeHandling(t *testing.T) {
+	w, started, release, errs := blockingWebhook(2, 10, BLOCK_WHEN_FULL)
+	// one user for each worker, so both start handling
+	var senders []string
+	for i := 0; len(senders) < 2; i++ {
+		sender := fmt.Sprint("user", i)
+		if shardIndex(sessionKey("page", sender), 2) == len(senders) {
+			senders = append(senders, sender)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if code := post(w, textFrom(senders[i%2], fmt.Sprint(i))); code != http.StatusOK {
+			t.Fatalf("answered %d", code)
+		}
+	}
+	<-started
+	<-started
+	if n := w.QueueLength(); n != 3 {
+		t.Errorf("%d events queued, want 3", n)
+	}
+	close(release)
+	if err := w.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(started) != 3 || len(errs()) != 0 {
+		t.Errorf("%d more events handled after shutdown, errors %v", len(started), errs())
+	}
+	if code := post(w, textBody("late")); code != http.StatusServiceUnavailable {
+		t.Errorf("after shutdown answered %d", code)
+	}
+	if e := errs(); len(e) != 1 || e[0] != ErrShuttingDown {
+		t.Errorf("errors %v", e)
+	}
+}
+
+func TestAsyncOverflow(t *testing.T) {
+	w, started, release, errs := blockingWebhook(1, 1, DROP_WHEN_FULL)
+	post(w, textBody("handled"))
+	<-started
+	post(w, textBody("queued"))
+	if code := post(w, textBody("dropped")); code != http.StatusOK {
+		t.Errorf("dropping answered %d", code)
+	}
+	e := errs()
+	var dropped *EventError
+	if len(e) != 1 || !errors.As(e[0], &dropped) || !errors.Is(e[0], ErrQueueFull) || dropped.Event.Message.Text != "dropped" {
+		t.Errorf("errors %v", e)
+	}
+	close(release)
+	w.Shutdown(context.Background())
+	if text := <-started; text != "queued" || len(started) != 0 {
+		t.Errorf("handled %q and %d more", text, len(started))
+	}
+
+	w, started, release, errs = blockingWebhook(1, 1, REJECT_WHEN_FULL)
+	post(w, textBody("handled"))
+	<-started
+	// neither event of the request is queued when the second does not fit
+	twoTexts := `{"object":"page","entry":[{"id":"page","messaging":[
+		{"sender":{"id":"user"},"recipient":{"id":"page"},"timestamp":1,"message":{"mid":"mid.1","seq":1,"text":"first"}},
+		{"sender":{"id":"user"},"recipient":{"id":"page"},"timestamp":2,"message":{"mid":"mid.2","seq":2,"text":"second"}}]}]}`
+	if code := post(w, twoTexts); code != http.StatusServiceUnavailable || w.QueueLength() != 0 {
+		t.Errorf("rejecting answered %d with %d events queued", code, w.QueueLength())
+	}
+	post(w, textBody("queued"))
+	if code := post(w, textBody("rejected")); code != http.StatusServiceUnavailable {
+		t.Errorf("rejecting answered %d", code)
+	}
+	if e := errs(); len(e) != 2 || e[0] != ErrQueueFull || e[1] != ErrQueueFull {
+		t.Errorf("errors %v", e)
+	}
+	close(release)
+	w.Shutdown(context.Background())
+	if text := <-started; text != "queued" || len(started) != 0 {
+		t.Errorf("handled %q and %d more", text, len(started))
+	}
+}
+
+func TestAsyncShutdownDeadline(t *testing.T) {
+	w, started, release, _ := blockingWebhook(1, 1, BLOCK_WHEN_FULL)
+	defer close(release)
+	post(w, textBody("stuck"))
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := w.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v", err)
+	}
+}
+
+func TestShutdownSynchronous(t *testing.T) {
+	w := NewMessengerWebhook("token", "token")
+	started, release := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	var errs []error
+	w.ErrorHandler(func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	})
+	w.MessageHandler(func(pageId string, s Sender, r Recipient, ts time.Time, m IncomingTextMessage) bool {
+		close(started)
+		<-release
+		return true
+	})
+	go post(w, textBody("running"))
+	<-started
+	shutdown := make(chan error)
+	go func() { shutdown <- w.Shutdown(context.Background()) }()
+	for closed := false; !closed; time.Sleep(time.Millisecond) {
+		w.requests.mu.RLock()
+		closed = w.requests.closed
+		w.requests.mu.RUnlock()
+	}
+	if code := post(w, textBody("late")); code != http.StatusServiceUnavailable {
+		t.Errorf("answered %d after Shutdown", code)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v while a request was handled", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 1 || errs[0] != ErrShuttingDown {
+		t.Errorf("errors %v", errs)
+	}
+}
+
+func TestAsyncHandlerPanic(t *testing.T) {
+	w := NewMessengerWebhook("token", "token")
+	var mu sync.Mutex
+	var handled []string
+	var errs []error
+	w.ErrorHandler(func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	})
+	w.MessageHandler(func(pageId string, s Sender, r Recipient, ts time.Time, m IncomingTextMessage) bool {
+		if m.Text == "panic" {
+			panic("handler failed")
+		}
+		mu.Lock()
+		handled = append(handled, m.Text)
+		mu.Unlock()
+		return true
+	})
+	w.ProcessAsync(1, 10, BLOCK_WHEN_FULL)
+	post(w, textBody("panic"))
+	post(w, textBody("after"))
+	w.Shutdown(context.Background())
+
+	var perr *EventError
+	if len(handled) != 1 || handled[0] != "after" || len(errs) != 1 || !errors.As(errs[0], &perr) ||
+		!errors.Is(errs[0], ErrHandlerPanicked) || perr.Event.Message.Text != "panic" {
+		t.Errorf("handled %q, errors %v", handled, errs)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	w, started, release, _ := blockingWebhook(1, 10, BLOCK_WHEN_FULL)
+	post(w, textBody("first"))
+	post(w, textBody("second"))
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := w.Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Flush of a busy webhook returned %v", err)
+	}
+	close(release)
+	if err := w.Flush(context.Background()); err != nil || len(started) != 1 || w.QueueLength() != 0 {
+		t.Errorf("Flush returned %v with %d events handled after it", err, len(started))
+	}
+	// the webhook still accepts requests
+	if code := post(w, textBody("third")); code != http.StatusOK {
+		t.Errorf("after Flush answered %d", code)
+	}
+	w.Shutdown(context.Background())
+
+	// messages queued in the outbox are sent before Flush returns
+	var calls int32
+	api := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&calls, 1)
+		fmt.Fprint(res, `{"recipient_id":"user","message_id":"mid.1"}`)
+	}))
+	defer api.Close()
+	o, err := NewFileOutbox(filepath.Join(t.TempDir(), "outbox.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	w = NewMessengerWebhook("token", "token")
+	w.graphApiUrl = api.URL
+	w.UseOutbox(o, 1, 1, time.Millisecond)
+	defer w.Shutdown(context.Background())
+	w.SendTextMessageByRecipientId("user", "queued", nil, REGULAR)
+	err = w.Flush(context.Background())
+	if n := atomic.LoadInt32(&calls); err != nil || n != 1 {
+		t.Errorf("Flush returned %v after %d calls", err, n)
+	}
+}
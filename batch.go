@@ -0,0 +1,202 @@
+package messengerbot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxBatchSize is the most operations the Graph API accepts in a batch request
+const maxBatchSize = 50
+
+// ErrNotAnswered is an operation of a batch request the Graph API gave no answer to, e.g. because the
+// batch took too long. Making it again may succeed
+var ErrNotAnswered = errors.New("messengerbot: batch operation was not answered")
+
+// BatchRequest is an operation of a Graph API batch request. RelativeUrl is relative to the Graph API url,
+// e.g. "me/messages", and Body holds the url-encoded parameters of POST operations
+type BatchRequest struct {
+	Method      string `json:"method"`
+	RelativeUrl string `json:"relative_url"`
+	Body        string `json:"body,omitempty"`
+}
+
+// BatchResponse is the answer to an operation of a batch request
+type BatchResponse struct {
+	Code int
+	Body []byte
+	// Err is the *SendError the operation was answered with, or why it has no answer
+	Err error
+}
+
+// NewSendRequest returns the operation sending the message through the Send API
+func NewSendRequest(data MessageEnvelope) (BatchRequest, error) {
+	jsonStr, err := json.Marshal(data)
+	if err != nil {
+		return BatchRequest{}, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(jsonStr, &fields); err != nil {
+		return BatchRequest{}, err
+	}
+	// each field of the envelope is a parameter, objects being passed as JSON
+	params := url.Values{}
+	for name, value := range fields {
+		var str string
+		if json.Unmarshal(value, &str) == nil {
+			params.Set(name, str)
+		} else {
+			params.Set(name, string(value))
+		}
+	}
+	return BatchRequest{Method: http.MethodPost, RelativeUrl: "me/messages", Body: params.Encode()}, nil
+}
+
+// NewProfileRequest returns the operation fetching the profile of the user identified by psid
+func NewProfileRequest(psid string) BatchRequest {
+	return BatchRequest{Method: http.MethodGet, RelativeUrl: psid + "?fields=" + profileFields}
+}
+
+// Batch makes the operations with the access token of the given page in as few calls to the Graph API as
+// possible, up to 50 operations per call, and returns the answer of each operation in the order of the
+// requests. The error is set when a call failed as a whole, in which case its operations and the ones after
+// it are not made and have the error as Err
+func (w *Webhook) Batch(ctx context.Context, pageId string, requests []BatchRequest) ([]BatchResponse, error) {
+	responses := make([]BatchResponse, len(requests))
+	for start := 0; start < len(requests); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(requests) {
+			end = len(requests)
+		}
+		if err := w.batch(ctx, pageId, requests[start:end], responses[start:end]); err != nil {
+			for i := start; i < len(responses); i++ {
+				responses[i].Err = err
+			}
+			return responses, err
+		}
+	}
+	return responses, nil
+}
+
+// batch makes a single call to the Graph API with at most maxBatchSize operations
+func (w *Webhook) batch(ctx context.Context, pageId string, requests []BatchRequest, responses []BatchResponse) error {
+	ops, err := json.Marshal(requests)
+	if err != nil {
+		return err
+	}
+	log.Println("batch : ", string(ops))
+	form := url.Values{"access_token": {w.accessTokenForPage(pageId)}, "batch": {string(ops)}, "include_headers": {"false"}}
+	req, err := http.NewRequest("POST", w.graphApiUrl+"/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	log.Println("response Status:", resp.Status)
+	log.Println("response Body:", string(body))
+
+	if resp.StatusCode != http.StatusOK {
+		return sendError(resp.StatusCode, body)
+	}
+	// operations which were not made are answered with null
+	var answers []*struct {
+		Code int    `json:"code"`
+		Body string `json:"body"`
+	}
+	if err := json.Unmarshal(body, &answers); err != nil {
+		return err
+	}
+	for i := range responses {
+		if i >= len(answers) || answers[i] == nil {
+			responses[i].Err = ErrNotAnswered
+			continue
+		}
+		responses[i].Code = answers[i].Code
+		responses[i].Body = []byte(answers[i].Body)
+		if answers[i].Code != http.StatusOK {
+			responses[i].Err = sendError(answers[i].Code, responses[i].Body)
+		}
+	}
+	return nil
+}
+
+// SendMessages sends the messages with the access token of the given page in batch requests, and returns
+// the answer of the Send API or the error of each message in the order of the envelopes. Like SendMessage,
+// it does not go through the outbox, and waits for the rate limiter before each message
+func (w *Webhook) SendMessages(ctx context.Context, pageId string, envelopes []MessageEnvelope) ([]*SendResponse, []error) {
+	responses := make([]*SendResponse, len(envelopes))
+	errs := make([]error, len(envelopes))
+	var requests []BatchRequest
+	var sent []int
+	for i, data := range envelopes {
+		if w.rateLimiter != nil {
+			r := data.Recipient
+			if err := w.rateLimiter.Wait(ctx, pageId, r.Id+r.PhoneNumber); err != nil {
+				errs[i] = err
+				continue
+			}
+		}
+		req, err := NewSendRequest(data)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		requests = append(requests, req)
+		sent = append(sent, i)
+	}
+	answers, _ := w.Batch(ctx, pageId, requests)
+	for j, answer := range answers {
+		i := sent[j]
+		if answer.Err != nil {
+			errs[i] = answer.Err
+			continue
+		}
+		r := new(SendResponse)
+		if err := json.Unmarshal(answer.Body, r); err != nil {
+			errs[i] = err
+			continue
+		}
+		responses[i] = r
+	}
+	return responses, errs
+}
+
+// GetUserProfiles fetches the profiles of the users identified by psids in batch requests, and returns the
+// profile or the error of each user in the order of psids
+func (w *Webhook) GetUserProfiles(ctx context.Context, pageId string, psids []string) ([]*UserProfile, []error) {
+	profiles := make([]*UserProfile, len(psids))
+	errs := make([]error, len(psids))
+	requests := make([]BatchRequest, len(psids))
+	for i, psid := range psids {
+		requests[i] = NewProfileRequest(psid)
+	}
+	answers, _ := w.Batch(ctx, pageId, requests)
+	for i, answer := range answers {
+		if answer.Err != nil {
+			errs[i] = answer.Err
+			continue
+		}
+		p := new(UserProfile)
+		if err := json.Unmarshal(answer.Body, p); err != nil {
+			errs[i] = err
+			continue
+		}
+		profiles[i] = p
+	}
+	return profiles, errs
+}
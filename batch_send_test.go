@@ -0,0 +1,59 @@
+package messengerbot_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/vimukthi-git/messengerbot"
+	"github.com/vimukthi-git/messengerbot/messengertest"
+)
+
+func TestSendMessages(t *testing.T) {
+	s := newSendServer(func(recipient string, call int) int {
+		if recipient == "bad" {
+			return 100
+		}
+		return 0
+	})
+	defer s.Close()
+	w := newWebhook(t, s)
+
+	var envelopes []messengerbot.MessageEnvelope
+	for i := 0; i < 60; i++ {
+		envelopes = append(envelopes, messengerbot.MessageEnvelope{Recipient: messengerbot.Recipient{Id: fmt.Sprint("r", i)},
+			Message:       messengerbot.NewTextMessage(fmt.Sprintf(`Hi & "welcome" %d`, i), nil),
+			MessagingType: messengerbot.MESSAGE_TAG, Tag: messengerbot.ACCOUNT_UPDATE})
+	}
+	envelopes[3].Recipient.Id = "bad"
+	envelopes[4] = messengerbot.MessageEnvelope{Recipient: messengerbot.Recipient{Id: "r4"}, SenderAction: messengerbot.TYPING_ON}
+	responses, errs := w.SendMessages(context.Background(), "page", envelopes)
+	batches := make(map[int]int)
+	for _, c := range s.CallsOf(messengertest.SEND_CALL) {
+		batches[c.Batch]++
+	}
+	if !reflect.DeepEqual(batches, map[int]int{1: 50, 2: 10}) {
+		t.Errorf("sent batches %v", batches)
+	}
+	for i, e := range envelopes {
+		id := e.Recipient.Id
+		var serr *messengerbot.SendError
+		switch {
+		case id == "bad":
+			if responses[i] != nil || !errors.As(errs[i], &serr) || serr.Code != 100 {
+				t.Errorf("%s: %+v, %v", id, responses[i], errs[i])
+			}
+		case errs[i] != nil || responses[i].RecipientId != id:
+			t.Errorf("%s: %+v, %v", id, responses[i], errs[i])
+		case e.Message != nil && (responses[i].MessageId != "mid."+id+".1" || textsTo(s, id)[0] != e.Message.Text):
+			t.Errorf("%s: %+v, received %q", id, responses[i], textsTo(s, id))
+		}
+	}
+	sent := delivered(s)
+	if e := sent[0]; e.MessagingType != messengerbot.MESSAGE_TAG || e.Tag != messengerbot.ACCOUNT_UPDATE ||
+		sent[3].SenderAction != messengerbot.TYPING_ON {
+		t.Errorf("sent %+v", sent[:4])
+	}
+}
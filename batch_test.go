@@ -0,0 +1,177 @@
+package messengerbot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// graphApi is a fake Graph API answering profile lookups, on their own or in batch requests, with the
+// profile of a user named after their PSID. The profile of unknown is not found, batch operations asking
+// for skipped are not answered and batch requests made with the bad token fail
+type graphApi struct {
+	*httptest.Server
+	mu       sync.Mutex
+	lookups  []string
+	batches  []int
+	tokens   []string
+	response time.Duration
+}
+
+func newGraphApi(response time.Duration) *graphApi {
+	g := &graphApi{response: response}
+	g.Server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		time.Sleep(g.response)
+		if req.URL.Path != "/" {
+			g.mu.Lock()
+			g.lookups = append(g.lookups, strings.TrimPrefix(req.URL.Path, "/"))
+			g.mu.Unlock()
+			status, body := g.profile(strings.TrimPrefix(req.URL.Path, "/"))
+			res.WriteHeader(status)
+			fmt.Fprint(res, body)
+			return
+		}
+		var ops []BatchRequest
+		json.Unmarshal([]byte(req.PostFormValue("batch")), &ops)
+		g.mu.Lock()
+		g.batches = append(g.batches, len(ops))
+		g.tokens = append(g.tokens, req.PostFormValue("access_token"))
+		g.mu.Unlock()
+		if req.PostFormValue("access_token") == "bad" {
+			res.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(res, `{"error":{"message":"Invalid OAuth access token.","type":"OAuthException","code":190}}`)
+			return
+		}
+		answers := make([]interface{}, len(ops))
+		for i, op := range ops {
+			psid := strings.Split(op.RelativeUrl, "?")[0]
+			if op.Method != http.MethodGet || psid == "skipped" {
+				continue
+			}
+			status, body := g.profile(psid)
+			answers[i] = map[string]interface{}{"code": status, "body": body}
+		}
+		json.NewEncoder(res).Encode(answers)
+	}))
+	return g
+}
+
+func (g *graphApi) profile(psid string) (int, string) {
+	if psid == "unknown" {
+		return http.StatusBadRequest, `{"error":{"message":"(#100) No profile available for that user.","type":"OAuthException","code":100}}`
+	}
+	return http.StatusOK, fmt.Sprintf(`{"first_name":%q,"locale":"en_US"}`, psid)
+}
+
+func TestBatch(t *testing.T) {
+	g := newGraphApi(0)
+	defer g.Close()
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(out)
+	w := NewMessengerWebhook("token", "token")
+	w.graphApiUrl = g.URL
+	w.AddPageAccessToken("other", "bad")
+
+	var psids []string
+	for i := 0; i < 120; i++ {
+		psids = append(psids, fmt.Sprint("u", i))
+	}
+	psids[7], psids[60] = "unknown", "skipped"
+	profiles, errs := w.GetUserProfiles(context.Background(), "page", psids)
+	if !reflect.DeepEqual(g.batches, []int{50, 50, 20}) || !reflect.DeepEqual(g.tokens, []string{"token", "token", "token"}) {
+		t.Errorf("sent batches %v with %v", g.batches, g.tokens)
+	}
+	for i, psid := range psids {
+		var serr *SendError
+		switch {
+		case psid == "unknown":
+			if profiles[i] != nil || !errors.As(errs[i], &serr) || serr.Code != 100 || serr.Status != http.StatusBadRequest {
+				t.Errorf("%s: %+v, %v", psid, profiles[i], errs[i])
+			}
+		case psid == "skipped":
+			if profiles[i] != nil || errs[i] != ErrNotAnswered || !temporary(errs[i]) {
+				t.Errorf("%s: %+v, %v", psid, profiles[i], errs[i])
+			}
+		case errs[i] != nil || profiles[i].FirstName != psid || profiles[i].Locale != "en_US":
+			t.Errorf("%s: %+v, %v", psid, profiles[i], errs[i])
+		}
+	}
+
+	requests := []BatchRequest{NewProfileRequest("a"), NewProfileRequest("b")}
+	responses, err := w.Batch(context.Background(), "other", requests)
+	var serr *SendError
+	if !errors.As(err, &serr) || serr.Code != 190 || len(responses) != 2 || responses[1].Err != err {
+		t.Errorf("batch answered %+v, %v", responses, err)
+	}
+	if responses, err := w.Batch(context.Background(), "page", nil); len(responses) != 0 || err != nil ||
+		len(g.batches) != 4 {
+		t.Errorf("empty batch answered %+v, %v", responses, err)
+	}
+}
+
+func TestProfileLookupsBatched(t *testing.T) {
+	g := newGraphApi(20 * time.Millisecond)
+	defer g.Close()
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(out)
+	w := NewMessengerWebhook("token", "token")
+	w.graphApiUrl = g.URL
+
+	// the first lookup is made on its own, the ones asked for meanwhile in a batch
+	var wg sync.WaitGroup
+	profiles := make([]*UserProfile, 10)
+	errs := make([]error, 10)
+	for i := range profiles {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i > 0 {
+				time.Sleep(5 * time.Millisecond)
+			}
+			profiles[i], errs[i] = w.profiles.get("page", fmt.Sprint("u", i))
+		}(i)
+	}
+	wg.Wait()
+	for i, p := range profiles {
+		if errs[i] != nil || p.FirstName != fmt.Sprint("u", i) {
+			t.Errorf("u%d: %+v, %v", i, p, errs[i])
+		}
+	}
+	if !reflect.DeepEqual(g.lookups, []string{"u0"}) || !reflect.DeepEqual(g.batches, []int{9}) {
+		t.Errorf("looked up %v on their own, %v in batches", g.lookups, g.batches)
+	}
+	if p, err := w.profiles.get("page", "unknown"); p != nil || err == nil {
+		t.Errorf("unknown: %+v, %v", p, err)
+	}
+}
+
+func TestProfileLookupTimeout(t *testing.T) {
+	g := newGraphApi(200 * time.Millisecond)
+	defer g.Close()
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(out)
+	w := NewMessengerWebhook("token", "token")
+	w.graphApiUrl = g.URL
+	w.profiles.timeout = 20 * time.Millisecond
+
+	start := time.Now()
+	if p, err := w.profiles.get("page", "slow"); p != nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slow: %+v, %v", p, err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("lookup took %v", elapsed)
+	}
+}
@@ -0,0 +1,415 @@
+package messengerbot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ErrMissingVariable is a {{variable}} of a broadcast message the recipient has no value for
+var ErrMissingVariable = errors.New("messengerbot: broadcast variable has no value")
+
+// BroadcastRecipient is a recipient of a broadcast, with the values of the {{variables}} of its message
+type BroadcastRecipient struct {
+	Id   string
+	Vars map[string]string
+}
+
+// RecipientIterator returns the recipients of a broadcast one at a time, and false when there are no more
+type RecipientIterator interface {
+	Next() (BroadcastRecipient, bool)
+}
+
+type recipientSlice struct {
+	recipients []BroadcastRecipient
+	next       int
+}
+
+func (r *recipientSlice) Next() (BroadcastRecipient, bool) {
+	if r.next == len(r.recipients) {
+		return BroadcastRecipient{}, false
+	}
+	r.next++
+	return r.recipients[r.next-1], true
+}
+
+// RecipientSlice iterates over the given recipients
+func RecipientSlice(recipients []BroadcastRecipient) RecipientIterator {
+	return &recipientSlice{recipients: recipients}
+}
+
+// RecipientIds iterates over recipients without template variables
+func RecipientIds(ids ...string) RecipientIterator {
+	recipients := make([]BroadcastRecipient, len(ids))
+	for i, id := range ids {
+		recipients[i].Id = id
+	}
+	return RecipientSlice(recipients)
+}
+
+// BroadcastOutcome is what became of the message of a broadcast to a recipient
+type BroadcastOutcome string
+
+const (
+	BROADCAST_DELIVERED BroadcastOutcome = "delivered"
+	// BROADCAST_BLOCKED is a recipient who blocked the page or cannot be reached
+	BROADCAST_BLOCKED BroadcastOutcome = "blocked"
+	BROADCAST_FAILED  BroadcastOutcome = "failed"
+)
+
+// BroadcastResult is the outcome of the message of a broadcast to a recipient
+type BroadcastResult struct {
+	RecipientId string
+	Outcome     BroadcastOutcome
+	MessageId   string
+	Err         error
+}
+
+// BroadcastSummary lists the recipients of a broadcast by outcome
+type BroadcastSummary struct {
+	Delivered []string
+	Blocked   []string
+	Failed    []string
+	// Cancelled is set when the broadcast was cancelled before every recipient was sent the message
+	Cancelled bool
+	Elapsed   time.Duration
+}
+
+func (s BroadcastSummary) String() string {
+	summary := fmt.Sprintf("delivered %d, blocked %d, failed %d in %v", len(s.Delivered), len(s.Blocked),
+		len(s.Failed), s.Elapsed.Round(time.Millisecond))
+	if s.Cancelled {
+		summary += " (cancelled)"
+	}
+	return summary
+}
+
+// Broadcast sends a message to many recipients of a page
+type Broadcast struct {
+	w             *Webhook
+	pageId        string
+	message       *Message
+	tag           MessageTag
+	concurrency   int
+	batchSize     int
+	attempts      int
+	backoff       time.Duration
+	resultHandler func(BroadcastResult)
+
+	mu        sync.Mutex
+	paused    bool
+	resumed   chan struct{}
+	cancelled bool
+	cancel    context.CancelFunc
+	started   time.Time
+	summary   BroadcastSummary
+	results   []BroadcastResult
+}
+
+// NewBroadcast creates a broadcast of the message through the given page, making concurrency batch requests
+// of 50 recipients at once. Strings of the message may hold {{variables}}, replaced by the values of each
+// recipient, and recipients without a value for one of them fail with ErrMissingVariable. Messages are
+// sent with the tag when it is not empty, as updates otherwise. The rate limiter of the webhook applies,
+// and messages which fail with a temporary error are sent up to 3 times in all, a second apart at first
+func (w *Webhook) NewBroadcast(pageId string, m *Message, tag MessageTag, concurrency int) *Broadcast {
+	b := new(Broadcast)
+	b.w = w
+	b.pageId = pageId
+	b.message = m
+	b.tag = tag
+	b.concurrency = concurrency
+	if b.concurrency < 1 {
+		b.concurrency = 1
+	}
+	b.batchSize = maxBatchSize
+	b.attempts = 3
+	b.backoff = time.Second
+	return b
+}
+
+// BatchSize sets how many recipients are sent the message in a batch request, at most 50. A size of 1
+// makes a Send API call per recipient
+func (b *Broadcast) BatchSize(n int) {
+	if n < 1 {
+		n = 1
+	}
+	if n > maxBatchSize {
+		n = maxBatchSize
+	}
+	b.batchSize = n
+}
+
+// Retry sets how many times in all a message failing with a temporary error is sent, and how long to wait
+// before sending it again, the wait doubling after each attempt
+func (b *Broadcast) Retry(attempts int, backoff time.Duration) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	b.attempts = attempts
+	b.backoff = backoff
+}
+
+// ResultHandler registers a callback called with the outcome of each recipient as soon as it is known,
+// from the goroutines sending the broadcast
+func (b *Broadcast) ResultHandler(cb func(BroadcastResult)) {
+	b.resultHandler = cb
+}
+
+// Run sends the message to the recipients and returns the summary once they were all sent the message,
+// or the broadcast was cancelled or ctx is done
+func (b *Broadcast) Run(ctx context.Context, recipients RecipientIterator) BroadcastSummary {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	b.mu.Lock()
+	b.cancel = cancel
+	b.started = time.Now()
+	if b.cancelled {
+		cancel()
+	}
+	b.mu.Unlock()
+
+	jobs := make(chan []BroadcastRecipient)
+	var wg sync.WaitGroup
+	for i := 0; i < b.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range jobs {
+				for _, result := range b.send(ctx, parent, batch) {
+					b.record(result)
+				}
+			}
+		}()
+	}
+	for b.waitWhilePaused(ctx) {
+		var batch []BroadcastRecipient
+		for len(batch) < b.batchSize {
+			r, ok := recipients.Next()
+			if !ok {
+				break
+			}
+			batch = append(batch, r)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		select {
+		case jobs <- batch:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.summary.Cancelled = ctx.Err() != nil
+	b.summary.Elapsed = time.Since(b.started)
+	return b.copySummary()
+}
+
+// send sends the message to a batch of recipients, waiting while the broadcast is paused, and returns the
+// results of the recipients, none when the broadcast was cancelled before the message was sent. Messages
+// being sent when the broadcast is cancelled are only interrupted when sendCtx is done
+func (b *Broadcast) send(ctx, sendCtx context.Context, recipients []BroadcastRecipient) []BroadcastResult {
+	var results, unrendered []BroadcastResult
+	var envelopes []MessageEnvelope
+	for _, r := range recipients {
+		result := BroadcastResult{RecipientId: r.Id, Outcome: BROADCAST_FAILED}
+		m, err := renderMessage(b.message, r.Vars)
+		if err != nil {
+			result.Err = err
+			unrendered = append(unrendered, result)
+			continue
+		}
+		envelope := MessageEnvelope{Recipient: Recipient{Id: r.Id}, Message: m, MessagingType: UPDATE}
+		if b.tag != "" {
+			envelope.MessagingType = MESSAGE_TAG
+			envelope.Tag = b.tag
+		}
+		results = append(results, result)
+		envelopes = append(envelopes, envelope)
+	}
+	// pending are the indexes of the recipients sent the message again
+	pending := make([]int, len(envelopes))
+	for i := range pending {
+		pending[i] = i
+	}
+	backoff := b.backoff
+	for attempt := 1; len(pending) > 0; attempt++ {
+		if !b.waitWhilePaused(ctx) {
+			if attempt == 1 {
+				return unrendered
+			}
+			return append(unrendered, results...)
+		}
+		batch := make([]MessageEnvelope, len(pending))
+		for j, i := range pending {
+			batch[j] = envelopes[i]
+		}
+		responses, errs := b.sendBatch(sendCtx, batch)
+		var retry []int
+		for j, i := range pending {
+			result := &results[i]
+			if errs[j] == nil {
+				result.Outcome = BROADCAST_DELIVERED
+				result.MessageId = responses[j].MessageId
+				result.Err = nil
+				continue
+			}
+			result.Err = errs[j]
+			if serr, ok := errs[j].(*SendError); ok && serr.Blocked() {
+				result.Outcome = BROADCAST_BLOCKED
+			} else if temporary(errs[j]) && attempt < b.attempts {
+				retry = append(retry, i)
+			}
+		}
+		if pending = retry; len(pending) == 0 {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return append(unrendered, results...)
+		}
+		backoff *= 2
+	}
+	return append(unrendered, results...)
+}
+
+// sendBatch sends the envelopes in a batch request, or in a Send API call when there is only one
+func (b *Broadcast) sendBatch(ctx context.Context, envelopes []MessageEnvelope) ([]*SendResponse, []error) {
+	if len(envelopes) == 1 {
+		res, err := b.w.SendMessage(ctx, b.pageId, envelopes[0])
+		return []*SendResponse{res}, []error{err}
+	}
+	return b.w.SendMessages(ctx, b.pageId, envelopes)
+}
+
+func (b *Broadcast) record(r BroadcastResult) {
+	b.mu.Lock()
+	b.results = append(b.results, r)
+	switch r.Outcome {
+	case BROADCAST_DELIVERED:
+		b.summary.Delivered = append(b.summary.Delivered, r.RecipientId)
+	case BROADCAST_BLOCKED:
+		b.summary.Blocked = append(b.summary.Blocked, r.RecipientId)
+	default:
+		b.summary.Failed = append(b.summary.Failed, r.RecipientId)
+	}
+	b.mu.Unlock()
+	if b.resultHandler != nil {
+		b.resultHandler(r)
+	}
+}
+
+// waitWhilePaused returns true once the broadcast is not paused, or false when ctx is done
+func (b *Broadcast) waitWhilePaused(ctx context.Context) bool {
+	b.mu.Lock()
+	paused, resumed := b.paused, b.resumed
+	b.mu.Unlock()
+	if paused {
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// Pause stops sending to new recipients until Resume is called. Messages being sent are not interrupted
+func (b *Broadcast) Pause() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.paused {
+		b.paused = true
+		b.resumed = make(chan struct{})
+	}
+}
+
+// Resume resumes a paused broadcast
+func (b *Broadcast) Resume() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.paused {
+		b.paused = false
+		close(b.resumed)
+	}
+}
+
+// Cancel stops the broadcast, making Run return once the messages being sent are sent
+func (b *Broadcast) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cancelled = true
+	if b.cancel != nil {
+		b.cancel()
+	}
+}
+
+// Progress returns the summary of the recipients sent the message so far
+func (b *Broadcast) Progress() BroadcastSummary {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.copySummary()
+	if !b.started.IsZero() && s.Elapsed == 0 {
+		s.Elapsed = time.Since(b.started)
+	}
+	return s
+}
+
+// Results returns the outcome of each recipient sent the message so far, in the order they were known
+func (b *Broadcast) Results() []BroadcastResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]BroadcastResult{}, b.results...)
+}
+
+func (b *Broadcast) copySummary() BroadcastSummary {
+	s := b.summary
+	s.Delivered = append([]string{}, s.Delivered...)
+	s.Blocked = append([]string{}, s.Blocked...)
+	s.Failed = append([]string{}, s.Failed...)
+	return s
+}
+
+var broadcastVariable = regexp.MustCompile(`{{([^{}]+)}}`)
+
+// renderMessage returns a copy of the message with the {{variables}} of its strings replaced by their
+// values, or an error naming the first variable without a value
+func renderMessage(m *Message, vars map[string]string) (*Message, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if !broadcastVariable.Match(data) {
+		return m, nil
+	}
+	missing := ""
+	data = broadcastVariable.ReplaceAllFunc(data, func(v []byte) []byte {
+		name := string(broadcastVariable.FindSubmatch(v)[1])
+		value, ok := vars[name]
+		if !ok {
+			if missing == "" {
+				missing = name
+			}
+			return v
+		}
+		// the value replaces the variable inside a JSON string
+		quoted, _ := json.Marshal(value)
+		return quoted[1 : len(quoted)-1]
+	})
+	if missing != "" {
+		return nil, fmt.Errorf("%w : {{%s}}", ErrMissingVariable, missing)
+	}
+	rendered := new(Message)
+	if err := json.Unmarshal(data, rendered); err != nil {
+		return nil, err
+	}
+	return rendered, nil
+}
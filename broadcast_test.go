@@ -0,0 +1,144 @@
+package messengerbot_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+	"github.com/vimukthi-git/messengerbot/messengertest"
+)
+
+func TestBroadcast(t *testing.T) {
+	// r7 blocked the page, r8 is not a valid recipient, r9 has no value for {{when}} and the first message to
+	// r5 fails with a temporary error
+	var r5 sync.Once
+	send := sendResponder(func(recipient string, call int) int {
+		code := map[string]int{"r7": 551, "r8": 100}[recipient]
+		if recipient == "r5" {
+			r5.Do(func() { code = 2 })
+		}
+		return code
+	})
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	s := messengertest.NewServer()
+	s.Respond(messengertest.SEND_CALL, func(c *messengertest.Call) (int, interface{}) {
+		mu.Lock()
+		if running++; running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		defer func() {
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+		return send(c)
+	})
+	defer s.Close()
+	w := newWebhook(t, s)
+
+	var recipients []messengerbot.BroadcastRecipient
+	for i := 0; i < 40; i++ {
+		recipients = append(recipients, messengerbot.BroadcastRecipient{Id: fmt.Sprint("r", i),
+			Vars: map[string]string{"name": fmt.Sprint(`"Name`, i), "when": "{{soon}}"}})
+	}
+	delete(recipients[9].Vars, "when")
+	b := w.NewBroadcast("page", messengerbot.NewTextMessage("Hi {{name}}, the sale starts {{when}}", nil),
+		messengerbot.CONFIRMED_EVENT_UPDATE, 4)
+	b.BatchSize(8)
+	b.Retry(3, time.Millisecond)
+	var handled int32
+	b.ResultHandler(func(messengerbot.BroadcastResult) { atomic.AddInt32(&handled, 1) })
+	summary := b.Run(context.Background(), messengerbot.RecipientSlice(recipients))
+
+	if len(summary.Delivered) != 37 || !reflect.DeepEqual(summary.Blocked, []string{"r7"}) ||
+		!reflect.DeepEqual(summary.Failed, []string{"r9", "r8"}) || summary.Cancelled || handled != 40 || len(b.Results()) != 40 {
+		t.Errorf("summary %v, %d results handled", summary, handled)
+	}
+	for _, r := range b.Results() {
+		if r.RecipientId == "r9" && (!errors.Is(r.Err, messengerbot.ErrMissingVariable) || !strings.Contains(r.Err.Error(), "{{when}}")) {
+			t.Errorf("r9 failed with %v", r.Err)
+		}
+	}
+	mu.Lock()
+	if maxRunning > 4 {
+		t.Errorf("%d batches sent at once", maxRunning)
+	}
+	mu.Unlock()
+	// the message to r5 is sent again on its own
+	calls := s.CallsOf(messengertest.SEND_CALL)
+	sizes := make(map[int]int)
+	for _, c := range calls {
+		sizes[c.Batch]++
+	}
+	var batches []int
+	for batch, size := range sizes {
+		if batch != 0 {
+			batches = append(batches, size)
+		}
+	}
+	sort.Ints(batches)
+	if !reflect.DeepEqual(batches, []int{7, 8, 8, 8, 8}) || sizes[0] != 1 || len(calls) != 40 {
+		t.Errorf("sent batches %v, %d messages", batches, len(calls))
+	}
+	if texts := textsTo(s, "r5"); !reflect.DeepEqual(texts, []string{`Hi "Name5, the sale starts {{soon}}`}) {
+		t.Errorf("r5 received %q", texts)
+	}
+	if e := delivered(s)[0]; e.MessagingType != messengerbot.MESSAGE_TAG || e.Tag != messengerbot.CONFIRMED_EVENT_UPDATE {
+		t.Errorf("sent %+v", e)
+	}
+	if summary.String() != fmt.Sprintf("delivered 37, blocked 1, failed 2 in %v", summary.Elapsed.Round(time.Millisecond)) {
+		t.Errorf("summary %q", summary)
+	}
+}
+
+func TestBroadcastPauseResumeCancel(t *testing.T) {
+	s := messengertest.NewServer()
+	defer s.Close()
+	w := newWebhook(t, s)
+
+	var ids []string
+	for i := 0; i < 100; i++ {
+		ids = append(ids, fmt.Sprint("r", i))
+	}
+	b := w.NewBroadcast("page", messengerbot.NewTextMessage("Hi", nil), "", 2)
+	b.BatchSize(1)
+	paused := make(chan struct{})
+	b.ResultHandler(func(r messengerbot.BroadcastResult) {
+		if r.RecipientId == "r10" {
+			b.Pause()
+			close(paused)
+		}
+		if r.RecipientId == "r30" {
+			b.Cancel()
+		}
+	})
+	done := make(chan messengerbot.BroadcastSummary)
+	go func() { done <- b.Run(context.Background(), messengerbot.RecipientIds(ids...)) }()
+
+	<-paused
+	time.Sleep(20 * time.Millisecond)
+	progress := len(b.Progress().Delivered)
+	time.Sleep(20 * time.Millisecond)
+	if n := len(b.Progress().Delivered); n != progress || n > 13 {
+		t.Errorf("%d then %d delivered while paused", progress, n)
+	}
+	b.Resume()
+	summary := <-done
+	if !summary.Cancelled || len(summary.Delivered) < 31 || len(summary.Delivered) > 33 || len(summary.Failed) != 0 {
+		t.Errorf("summary %v", summary)
+	}
+	if e := s.Sent()[0]; e.MessagingType != messengerbot.UPDATE {
+		t.Errorf("sent %+v", e)
+	}
+}
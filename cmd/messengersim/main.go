@@ -0,0 +1,127 @@
+// Command messengersim chats with a bot in the terminal, without a Facebook Page, tokens or a public URL.
+//
+//	messengersim -flow shop.json   chat with a flow file, see the flow package
+//	messengersim                   chat with a demo bot showing every kind of message
+//
+// Bots written in Go run in the simulator from their own main, with messengertest.NewSimulator(w).Run.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+	"github.com/vimukthi-git/messengerbot/flow"
+	"github.com/vimukthi-git/messengerbot/messengertest"
+)
+
+func main() {
+	flowPath := flag.String("flow", "", "flow file to chat with instead of the demo bot")
+	watch := flag.Bool("watch", false, "reload the flow file when it changes")
+	verbose := flag.Bool("v", false, "show the log of the webhook")
+	flag.Parse()
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	w := messengerbot.NewMessengerWebhook("token", "token")
+	store := messengerbot.NewMemorySessionStore(time.Hour)
+	defer store.Close()
+	w.UseSessionStore(store, 24*time.Hour)
+	if *flowPath != "" {
+		bot, err := flow.LoadBot(w, *flowPath)
+		if err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(1)
+		}
+		if *watch {
+			bot.Watch(time.Second)
+			defer bot.Close()
+		}
+	} else {
+		demo(w)
+	}
+
+	sim := messengertest.NewSimulator(w)
+	defer sim.Close()
+	if err := sim.Run(os.Stdin, os.Stdout); err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+	}
+}
+
+// demo answers "image", "button", "generic", "receipt" and "quick" with that kind of message, and echoes
+// anything else
+func demo(w *messengerbot.Webhook) {
+	w.ConversationMessageHandler(func(c *messengerbot.Conversation, m messengerbot.IncomingTextMessage) bool {
+		switch m.Text {
+		case "image":
+			c.Reply(messengerbot.NewImageMessage("http://messengerdemo.parseapp.com/img/touch.png", nil))
+		case "button":
+			c.Reply(messengerbot.NewButtonMessage("VB Super", []messengerbot.Button{
+				{Type: messengerbot.WEB_URL, Title: "Open Web URL", Url: "https://www.oculus.com/en-us/rift/"},
+				{Type: messengerbot.POSTBACK, Title: "Call Postback", Payload: "Payload for first bubble"},
+			}, nil))
+		case "generic":
+			c.Reply(messengerbot.NewGenericMessage([]messengerbot.GenericTemplateElement{
+				{
+					Title:    "rift",
+					Subtitle: "Next-generation virtual reality",
+					ItemUrl:  "https://www.oculus.com/en-us/rift/",
+					ImageUrl: "http://messengerdemo.parseapp.com/img/rift.png",
+					Buttons: []messengerbot.Button{
+						{Type: messengerbot.WEB_URL, Title: "Open Web URL", Url: "https://www.oculus.com/en-us/rift/"},
+						{Type: messengerbot.POSTBACK, Title: "Call Postback", Payload: "Payload for first bubble"},
+					},
+				},
+				{
+					Title:    "touch",
+					Subtitle: "Your Hands, Now in VR",
+					ItemUrl:  "https://www.oculus.com/en-us/touch/",
+					ImageUrl: "http://messengerdemo.parseapp.com/img/touch.png",
+					Buttons: []messengerbot.Button{
+						{Type: messengerbot.WEB_URL, Title: "Open Web URL", Url: "https://www.oculus.com/en-us/touch/"},
+						{Type: messengerbot.POSTBACK, Title: "Call Postback", Payload: "Payload for second bubble"},
+					},
+				},
+			}, nil))
+		case "receipt":
+			c.Reply(messengerbot.NewReceiptMessage("You", "1232132", "USD", "paypal", "1428444852",
+				"https://www.oculus.com/en-us/touch/",
+				[]messengerbot.ReceiptTemplateElement{
+					{Title: "Oculus VR", Subtitle: "VR", Quantity: 2, Price: 599, Currency: "USD"},
+				},
+				messengerbot.Address{Street1: "123/15, sirimangala road", City: "Makola", PostalCode: "11690",
+					State: "Colombo", Country: "LK"},
+				messengerbot.Summary{Subtotal: 1198, TotalCost: 1197},
+				[]messengerbot.Adjustment{{Name: "discount", Amount: 1}}, nil))
+		case "quick":
+			c.ReplyWithQuickReplies("Pick a colour", []messengerbot.QuickReply{
+				{ContentType: messengerbot.TEXT, Title: "Red", Payload: "RED"},
+				{ContentType: messengerbot.TEXT, Title: "Green", Payload: "GREEN"},
+				{ContentType: messengerbot.USER_EMAIL},
+			})
+		default:
+			if m.QuickReply != nil {
+				c.ReplyText("You picked " + m.QuickReply.Payload)
+			} else {
+				c.ReplyText(m.Text)
+			}
+		}
+		return true
+	})
+	w.ConversationPostbackHandler(func(c *messengerbot.Conversation, p messengerbot.EventPostback) bool {
+		c.ReplyText("Postback: " + p.Payload)
+		return true
+	})
+	w.ConversationAttachmentHandler(func(c *messengerbot.Conversation, a messengerbot.IncomingAttachmentMessage) bool {
+		if a.Coordinates != nil {
+			c.ReplyText("Nice place")
+		} else {
+			c.ReplyText("Nice " + a.AttachmentType)
+		}
+		return true
+	})
+}
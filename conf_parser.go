@@ -3,7 +3,6 @@ package messengerbot
 import (
 	"encoding/json"
 	"os"
-	"log"
 )
 
 type Configuration struct {
@@ -11,13 +10,14 @@ type Configuration struct {
 	PageAccessToken string `json:"page_access_token"`
 }
 
-func getTestConfig() Configuration {
-	file, _ := os.Open("config.json")
-	decoder := json.NewDecoder(file)
+// getTestConfig reads the tokens of a real page from config.json
+func getTestConfig() (Configuration, error) {
 	configuration := Configuration{}
-	err := decoder.Decode(&configuration)
+	file, err := os.Open("config.json")
 	if err != nil {
-		log.Fatal("error:", err)
+		return configuration, err
 	}
-	return configuration
+	defer file.Close()
+	err = json.NewDecoder(file).Decode(&configuration)
+	return configuration, err
 }
@@ -0,0 +1,94 @@
+package messengerbot
+
+import (
+	"time"
+)
+
+// Conversation is the context of a single incoming event. It knows the page the event was received on,
+// the user who sent it and the webhook to reply through, so handlers can answer without looking up ids
+type Conversation struct {
+	*Event
+}
+
+type ConversationMessageCallback func(*Conversation, IncomingTextMessage) bool
+
+type ConversationAttachmentCallback func(*Conversation, IncomingAttachmentMessage) bool
+
+type ConversationPostbackCallback func(*Conversation, EventPostback) bool
+
+// Conversation returns the conversation for an event received on pageId from the given sender
+func (w *Webhook) Conversation(pageId string, s Sender, r Recipient, t time.Time) *Conversation {
+	return &Conversation{&Event{PageId: pageId, Sender: s, Recipient: r, Timestamp: t, webhook: w}}
+}
+
+// ConversationMessageHandler registers a text message callback which receives the conversation of the event
+func (w *Webhook) ConversationMessageHandler(cb ConversationMessageCallback) {
+	w.messageHandler = func(e *Event) bool {
+		return cb(e.Conversation(), *e.Message)
+	}
+}
+
+// ConversationAttachmentHandler registers an attachment message callback which receives the conversation
+// of the event
+func (w *Webhook) ConversationAttachmentHandler(cb ConversationAttachmentCallback) {
+	w.attachmentMessageHandler = func(e *Event) bool {
+		return cb(e.Conversation(), *e.Attachment)
+	}
+}
+
+// ConversationPostbackHandler registers a postback callback which receives the conversation of the event
+func (w *Webhook) ConversationPostbackHandler(cb ConversationPostbackCallback) {
+	w.postbackHandler = func(e *Event) bool {
+		return cb(e.Conversation(), *e.Postback)
+	}
+}
+
+// Reply sends the given message to the sender of the event as a response, after typing it when the
+// webhook paces conversations
+func (c *Conversation) Reply(m *Message) {
+	c.send(MessageEnvelope{
+		Recipient:     Recipient{Id: c.Sender.Id},
+		Message:       m,
+		MessagingType: RESPONSE,
+	})
+}
+
+// ReplyText sends the given text to the sender of the event
+func (c *Conversation) ReplyText(text string) {
+	c.Reply(NewTextMessage(text, nil))
+}
+
+// ReplyWithQuickReplies sends the given text along with quick replies to the sender of the event
+func (c *Conversation) ReplyWithQuickReplies(text string, quickReplies []QuickReply) {
+	c.Reply(NewTextMessage(text, quickReplies))
+}
+
+// Typing turns the typing indicator on or off for the sender of the event
+func (c *Conversation) Typing(on bool) {
+	action := TYPING_OFF
+	if on {
+		action = TYPING_ON
+	}
+	c.senderAction(action)
+}
+
+// MarkSeen marks the last message from the sender of the event as seen
+func (c *Conversation) MarkSeen() {
+	c.senderAction(MARK_SEEN)
+}
+
+func (c *Conversation) senderAction(action SenderActionType) {
+	c.send(MessageEnvelope{
+		Recipient:    Recipient{Id: c.Sender.Id},
+		SenderAction: action,
+	})
+}
+
+// send sends a message or sender action of the conversation, in order with the paced replies
+func (c *Conversation) send(envelope MessageEnvelope) {
+	if p := c.webhook.pacer; p != nil {
+		p.send(c.PageId, envelope)
+		return
+	}
+	c.webhook.callSendApiForPage(c.PageId, envelope)
+}
@@ -0,0 +1,74 @@
+package messengerbot
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendRecorder answers every request with 200, recording the access token and envelope of each
+type sendRecorder struct {
+	tokens    []string
+	envelopes []MessageEnvelope
+}
+
+func (s *sendRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var e MessageEnvelope
+	json.NewDecoder(req.Body).Decode(&e)
+	if strings.HasSuffix(req.URL.Path, "/me/messages") {
+		s.tokens = append(s.tokens, req.URL.Query().Get("access_token"))
+		s.envelopes = append(s.envelopes, e)
+	}
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: make(http.Header),
+		Body: ioutil.NopCloser(strings.NewReader(`{}`)), Request: req}, nil
+}
+
+func TestConversation(t *testing.T) {
+	api := new(sendRecorder)
+	transport := http.DefaultTransport
+	http.DefaultTransport = api
+	defer func() { http.DefaultTransport = transport }()
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(out)
+
+	w := NewMessengerWebhook("token", "default token")
+	w.AddPageAccessToken("page", "page token")
+	c := w.Conversation("page", Sender{Id: "user"}, Recipient{Id: "page"}, time.Now())
+	c.ReplyText("hi")
+	c.ReplyWithQuickReplies("pick", []QuickReply{{ContentType: TEXT, Title: "A", Payload: "A"}})
+	c.Typing(true)
+	c.Typing(false)
+	c.MarkSeen()
+	w.Conversation("other", Sender{Id: "user"}, Recipient{Id: "other"}, time.Now()).ReplyText("elsewhere")
+
+	if want := []string{"page token", "page token", "page token", "page token", "page token", "default token"}; !reflect.DeepEqual(api.tokens, want) {
+		t.Errorf("sent with tokens %q", api.tokens)
+	}
+	if len(api.envelopes) != 6 {
+		t.Fatalf("sent %+v", api.envelopes)
+	}
+	for i, e := range api.envelopes {
+		if e.Recipient.Id != "user" {
+			t.Errorf("envelope %d sent to %q", i, e.Recipient.Id)
+		}
+	}
+	for i, text := range map[int]string{0: "hi", 1: "pick", 5: "elsewhere"} {
+		if e := api.envelopes[i]; e.Message == nil || e.Message.Text != text || e.MessagingType != RESPONSE || e.SenderAction != "" {
+			t.Errorf("envelope %d is %+v", i, e)
+		}
+	}
+	if qr := api.envelopes[1].Message.QuickReplies; len(qr) != 1 || qr[0].Payload != "A" {
+		t.Errorf("quick replies %+v", qr)
+	}
+	for i, action := range map[int]SenderActionType{2: TYPING_ON, 3: TYPING_OFF, 4: MARK_SEEN} {
+		if e := api.envelopes[i]; e.SenderAction != action || e.Message != nil || e.MessagingType != "" {
+			t.Errorf("envelope %d is %+v", i, e)
+		}
+	}
+}
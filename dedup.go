@@ -0,0 +1,102 @@
+package messengerbot
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+)
+
+// DedupStore remembers the events a webhook has handled, so events Messenger delivers again after a timeout
+// are dropped. Seen records the key and reports whether it was already recorded in the last ttl. Stores
+// shared by several instances of a bot must record and check the key atomically
+type DedupStore interface {
+	Seen(key string, ttl time.Duration) (bool, error)
+}
+
+// UseDedupStore makes the webhook drop events already seen in the last ttl. Messages and attachments are
+// keyed by mid, deliveries by watermark, and postbacks and optins, which have no mid, by sender, payload
+// and timestamp. An event is recorded before it is handled, so an event whose handling fails is not
+// handled again when redelivered. Events are handled when the store fails
+func (w *Webhook) UseDedupStore(store DedupStore, ttl time.Duration) {
+	w.dedupStore = store
+	w.dedupTTL = ttl
+}
+
+// duplicate reports whether the event was already seen
+func (w *Webhook) duplicate(e *Event) bool {
+	if e.dedupKey == "" {
+		return false
+	}
+	seen, err := w.dedupStore.Seen(e.dedupKey, w.dedupTTL)
+	if err != nil {
+		log.Println("warning: cannot check for duplicate event ", e.dedupKey, err)
+		return false
+	}
+	if seen {
+		log.Println("duplicate event dropped : ", e.dedupKey)
+	}
+	return seen
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+// MemoryDedupStore is a DedupStore keeping keys in memory. It holds at most capacity keys, forgetting the
+// least recently seen ones first, and forgets keys when their ttl is over
+type MemoryDedupStore struct {
+	mu       sync.Mutex
+	capacity int
+	keys     map[string]*list.Element
+	// recent holds the keys, the most recently seen first
+	recent *list.List
+}
+
+// defaultDedupCapacity is the capacity of memory dedup stores created without a positive one
+const defaultDedupCapacity = 10000
+
+// NewMemoryDedupStore creates a memory dedup store holding at most capacity keys, or 10000 when capacity is
+// not positive
+func NewMemoryDedupStore(capacity int) *MemoryDedupStore {
+	if capacity <= 0 {
+		log.Println("warning: dedup store capacity must be positive, using", defaultDedupCapacity)
+		capacity = defaultDedupCapacity
+	}
+	m := new(MemoryDedupStore)
+	m.capacity = capacity
+	m.keys = make(map[string]*list.Element)
+	m.recent = list.New()
+	return m
+}
+
+func (m *MemoryDedupStore) Seen(key string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if el, ok := m.keys[key]; ok {
+		if now.Before(el.Value.(*dedupEntry).expires) {
+			m.recent.MoveToFront(el)
+			return true, nil
+		}
+		m.remove(el)
+	}
+	m.keys[key] = m.recent.PushFront(&dedupEntry{key, now.Add(ttl)})
+	for m.recent.Len() > m.capacity {
+		m.remove(m.recent.Back())
+	}
+	return false, nil
+}
+
+// Len returns the number of keys held, including expired keys not yet forgotten
+func (m *MemoryDedupStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.recent.Len()
+}
+
+func (m *MemoryDedupStore) remove(el *list.Element) {
+	m.recent.Remove(el)
+	delete(m.keys, el.Value.(*dedupEntry).key)
+}
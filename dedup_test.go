@@ -0,0 +1,104 @@
+package messengerbot
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryDedupStore(t *testing.T) {
+	m := NewMemoryDedupStore(2)
+	seen := func(key string, ttl time.Duration) bool {
+		s, err := m.Seen(key, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	if seen("a", time.Hour) || !seen("a", time.Hour) {
+		t.Error("a not recorded")
+	}
+	seen("b", time.Hour)
+	seen("a", time.Hour)
+	// b is the least recently seen
+	seen("c", time.Hour)
+	if m.Len() != 2 || !seen("a", time.Hour) || seen("b", time.Hour) {
+		t.Error("b not evicted first")
+	}
+	if seen("d", time.Millisecond) {
+		t.Error("d seen before recorded")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if seen("d", time.Hour) {
+		t.Error("d seen after expiry")
+	}
+
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(out)
+	m = NewMemoryDedupStore(0)
+	if seen("a", time.Hour) || !seen("a", time.Hour) {
+		t.Error("a not recorded without capacity")
+	}
+}
+
+func TestWebhookDedup(t *testing.T) {
+	samples, _ := filepath.Glob(filepath.Join("testdata", "webhook", "*.json"))
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(out)
+	for _, path := range samples {
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, handled, _ := recordingWebhook()
+		w.UseDedupStore(NewMemoryDedupStore(100), time.Hour)
+		post(w, string(body))
+		once := append([]string{}, *handled...)
+		post(w, string(body))
+		if !reflect.DeepEqual(*handled, once) {
+			t.Errorf("%s handled %q when delivered twice", path, *handled)
+		}
+	}
+
+	postback := func(ts string) string {
+		return `{"object":"page","entry":[{"id":"page","messaging":[{"sender":{"id":"user"},"recipient":{"id":"page"},
+			"timestamp":` + ts + `,"postback":{"payload":"START"}}]}]}`
+	}
+	w, handled, _ := recordingWebhook()
+	w.UseDedupStore(NewMemoryDedupStore(100), time.Hour)
+	w.ProcessAsync(2, 10, BLOCK_WHEN_FULL)
+	post(w, postback("1000"))
+	post(w, postback("1000"))
+	post(w, postback("2000"))
+	post(w, textBody("hi"))
+	post(w, textBody("hi"))
+	w.Shutdown(context.Background())
+	if want := []string{"postback user>page START", "postback user>page START", "message user>page hi"}; !reflect.DeepEqual(*handled, want) {
+		t.Errorf("handled %q", *handled)
+	}
+}
+
+func TestDeliveryCollapsed(t *testing.T) {
+	w := NewMessengerWebhook("token", "token")
+	var deliveries []EventDelivery
+	w.DeliveryHandler(func(pageId string, s Sender, r Recipient, d EventDelivery) bool {
+		deliveries = append(deliveries, d)
+		return true
+	})
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "webhook", "delivery.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post(w, string(body))
+	if len(deliveries) != 1 || len(deliveries[0].Mids) != 2 || deliveries[0].Mid != deliveries[0].Mids[0] ||
+		deliveries[0].Watermark != 1458668856253 || !strings.HasSuffix(deliveries[0].Mids[1], "234") {
+		t.Errorf("deliveries %+v", deliveries)
+	}
+}
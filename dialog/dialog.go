@@ -0,0 +1,428 @@
+// Package dialog runs multi-step conversations as finite-state flows on top of a messengerbot Webhook.
+//
+// A Flow is a set of States. Entering a state sends its prompt, and the next input from the user is
+// checked against the input types the state expects, validated, optionally saved, and used to pick the
+// next state. The position of each user in a flow is kept in their messengerbot.Session, so the webhook
+// must have a session store.
+package dialog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+type InputType string
+
+const (
+	TEXT_INPUT        InputType = "text"
+	QUICK_REPLY_INPUT InputType = "quick_reply"
+	POSTBACK_INPUT    InputType = "postback"
+	ATTACHMENT_INPUT  InputType = "attachment"
+	LOCATION_INPUT    InputType = "location"
+)
+
+// session keys holding the position of the user in a flow
+const (
+	flowKey    = "dialog.flow"
+	stateKey   = "dialog.state"
+	historyKey = "dialog.history"
+	dataKey    = "dialog.data"
+	updatedKey = "dialog.updated"
+)
+
+var (
+	ErrUnknownFlow  = errors.New("dialog: unknown flow")
+	ErrUnknownState = errors.New("dialog: unknown state")
+	ErrNoSession    = errors.New("dialog: webhook has no session store")
+)
+
+// Input is the user's answer to the prompt of a state
+type Input struct {
+	Type InputType
+	// Text of a text message or quick reply
+	Text string
+	// Payload of a quick reply or postback
+	Payload string
+	// Attachment of an attachment or location
+	Attachment *messengerbot.IncomingAttachmentMessage
+}
+
+// Value returns the payload of quick replies and postbacks, the url of attachments, "lat,long" for
+// locations and the text otherwise
+func (in Input) Value() string {
+	switch in.Type {
+	case QUICK_REPLY_INPUT, POSTBACK_INPUT:
+		return in.Payload
+	case ATTACHMENT_INPUT:
+		return in.Attachment.AttachmentUrl
+	case LOCATION_INPUT:
+		return strconv.FormatFloat(in.Attachment.Coordinates.Lat, 'f', -1, 64) + "," +
+			strconv.FormatFloat(in.Attachment.Coordinates.Long, 'f', -1, 64)
+	}
+	return in.Text
+}
+
+// State is a single step of a flow
+type State struct {
+	Name string
+	// Prompt is sent when the state is entered and again after invalid input
+	Prompt *messengerbot.Message
+	// Expects lists the accepted input types, any input is accepted when empty. Expecting TEXT_INPUT also
+	// accepts quick replies
+	Expects []InputType
+	// Validate rejects input with an error which is sent to the user before the prompt is repeated
+	Validate func(c *Context, in Input) error
+	// Retry is sent instead of the default message when the input has the wrong type or does not match On
+	Retry string
+	// Save stores Input.Value in the flow data under this key
+	Save string
+	// On maps an input value to the next state
+	On map[string]string
+	// Next is the state after input not matched by On. An empty Next ends the flow, unless On is not empty
+	// in which case input On does not match is invalid
+	Next string
+	// Transition, when set, picks the next state instead of On and Next. Returning "" ends the flow
+	Transition func(c *Context, in Input) string
+}
+
+func (s *State) accepts(in Input) bool {
+	if len(s.Expects) == 0 {
+		return true
+	}
+	for _, t := range s.Expects {
+		if t == in.Type || (t == TEXT_INPUT && in.Type == QUICK_REPLY_INPUT) {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the name of the next state and whether the input selected one
+func (s *State) next(c *Context, in Input) (string, bool) {
+	if s.Transition != nil {
+		return s.Transition(c, in), true
+	}
+	if next, ok := s.On[in.Value()]; ok {
+		return next, true
+	}
+	if len(s.On) > 0 && s.Next == "" {
+		return "", false
+	}
+	return s.Next, true
+}
+
+// Flow is a named set of states starting at Start
+type Flow struct {
+	Name   string
+	Start  string
+	States map[string]*State
+	// Timeout ends the flow when the user has not answered for this long. Zero means no timeout
+	Timeout time.Duration
+	// OnComplete is called when a transition ends the flow
+	OnComplete func(c *Context)
+	// OnCancel is called when the user cancels the flow
+	OnCancel func(c *Context)
+	// OnTimeout is called on the next event from a user whose flow timed out
+	OnTimeout func(c *Context)
+}
+
+// NewFlow creates an empty flow starting at the state named start
+func NewFlow(name, start string) *Flow {
+	return &Flow{Name: name, Start: start, States: make(map[string]*State)}
+}
+
+// AddState adds a state to the flow
+func (f *Flow) AddState(s *State) *Flow {
+	f.States[s.Name] = s
+	return f
+}
+
+// Context is passed to the callbacks of a flow. It gives access to the conversation and to the data
+// saved by the flow so far
+type Context struct {
+	*messengerbot.Conversation
+	Flow  *Flow
+	State string
+	Data  map[string]string
+}
+
+func (c *Context) Get(key string) string {
+	return c.Data[key]
+}
+
+func (c *Context) Set(key, value string) {
+	c.Data[key] = value
+}
+
+// Engine drives the flows registered on it from the events received by a webhook
+type Engine struct {
+	mu    sync.RWMutex
+	flows map[string]*Flow
+	// CancelWords end the active flow when sent as text, ignoring case
+	CancelWords []string
+	// BackWords return to the previous state when sent as text, ignoring case
+	BackWords []string
+	// Invalid is sent when the input has the wrong type and the state has no Retry message
+	Invalid string
+	// Cancelled is sent when a flow without OnCancel is cancelled
+	Cancelled string
+}
+
+// NewEngine creates an engine and adds it as a middleware to the webhook. Events from users in a flow are
+// consumed by the engine, all other events are passed on. Middlewares added to the webhook later do not
+// see the consumed events
+func NewEngine(w *messengerbot.Webhook) *Engine {
+	e := new(Engine)
+	e.flows = make(map[string]*Flow)
+	e.CancelWords = []string{"cancel"}
+	e.BackWords = []string{"back"}
+	e.Invalid = "Sorry, I didn't get that."
+	e.Cancelled = "Cancelled."
+	w.Use(e.Middleware)
+	return e
+}
+
+// Register adds a flow to the engine
+func (e *Engine) Register(f *Flow) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.flows[f.Name] = f
+}
+
+// Flows returns the registered flows
+func (e *Engine) Flows() []*Flow {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	flows := make([]*Flow, 0, len(e.flows))
+	for _, f := range e.flows {
+		flows = append(flows, f)
+	}
+	return flows
+}
+
+func (e *Engine) flow(name string) *Flow {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.flows[name]
+}
+
+// Start puts the user of the conversation at the start of the named flow and sends its first prompt. A flow
+// without a start state, such as a form none of whose slots apply, completes right away
+func (e *Engine) Start(c *messengerbot.Conversation, flowName string) error {
+	if c.Session == nil {
+		return ErrNoSession
+	}
+	f := e.flow(flowName)
+	if f == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownFlow, flowName)
+	}
+	if f.Start == "" {
+		clearFlow(c.Session)
+		if f.OnComplete != nil {
+			f.OnComplete(&Context{c, f, "", make(map[string]string)})
+		}
+		return nil
+	}
+	if f.States[f.Start] == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownState, f.Start)
+	}
+	ctx := &Context{c, f, f.Start, make(map[string]string)}
+	e.save(ctx, []string{})
+	e.prompt(ctx)
+	return nil
+}
+
+// Active returns the name of the flow the user of the conversation is in, or "" when there is none
+func (e *Engine) Active(c *messengerbot.Conversation) string {
+	if c.Session == nil {
+		return ""
+	}
+	return c.Session.Get(flowKey)
+}
+
+// Middleware consumes the events of users who are in a flow
+func (e *Engine) Middleware(next messengerbot.EventHandler) messengerbot.EventHandler {
+	return func(ev *messengerbot.Event) bool {
+		in, ok := inputOf(ev)
+		if !ok || ev.Session == nil || ev.Session.Get(flowKey) == "" {
+			return next(ev)
+		}
+		ctx, history, err := e.load(ev.Conversation())
+		if err != nil {
+			log.Println("warning: dropping dialog state :", err)
+			clearFlow(ev.Session)
+			return next(ev)
+		}
+		if ctx.Flow.Timeout > 0 {
+			updated, _ := strconv.ParseInt(ev.Session.Get(updatedKey), 10, 64)
+			if time.Since(time.Unix(updated, 0)) > ctx.Flow.Timeout {
+				clearFlow(ev.Session)
+				if ctx.Flow.OnTimeout != nil {
+					ctx.Flow.OnTimeout(ctx)
+				}
+				return next(ev)
+			}
+		}
+		e.handle(ctx, history, in)
+		return true
+	}
+}
+
+func (e *Engine) handle(ctx *Context, history []string, in Input) {
+	if in.Type == TEXT_INPUT && matchesWord(in.Text, e.CancelWords) {
+		clearFlow(ctx.Session)
+		if ctx.Flow.OnCancel != nil {
+			ctx.Flow.OnCancel(ctx)
+		} else {
+			ctx.ReplyText(e.Cancelled)
+		}
+		return
+	}
+	if in.Type == TEXT_INPUT && matchesWord(in.Text, e.BackWords) {
+		if len(history) > 0 {
+			ctx.State = history[len(history)-1]
+			history = history[:len(history)-1]
+		}
+		e.save(ctx, history)
+		e.prompt(ctx)
+		return
+	}
+
+	state := ctx.Flow.States[ctx.State]
+	if !state.accepts(in) {
+		e.retry(ctx, state, "")
+		return
+	}
+	if state.Validate != nil {
+		if err := state.Validate(ctx, in); err != nil {
+			e.retry(ctx, state, err.Error())
+			return
+		}
+	}
+	if state.Save != "" {
+		ctx.Set(state.Save, in.Value())
+	}
+	next, ok := state.next(ctx, in)
+	if !ok {
+		e.retry(ctx, state, "")
+		return
+	}
+	if next == "" {
+		clearFlow(ctx.Session)
+		if ctx.Flow.OnComplete != nil {
+			ctx.Flow.OnComplete(ctx)
+		}
+		return
+	}
+	if ctx.Flow.States[next] == nil {
+		log.Println("warning: dialog flow", ctx.Flow.Name, "has no state", next)
+		clearFlow(ctx.Session)
+		return
+	}
+	history = append(history, ctx.State)
+	ctx.State = next
+	e.save(ctx, history)
+	e.prompt(ctx)
+}
+
+// retry tells the user the input was not accepted and repeats the prompt of the state
+func (e *Engine) retry(ctx *Context, state *State, message string) {
+	if message == "" {
+		message = state.Retry
+	}
+	if message == "" {
+		message = e.Invalid
+	}
+	ctx.ReplyText(message)
+	e.save(ctx, nil)
+	e.prompt(ctx)
+}
+
+func (e *Engine) prompt(ctx *Context) {
+	if state := ctx.Flow.States[ctx.State]; state.Prompt != nil {
+		ctx.Reply(state.Prompt)
+	}
+}
+
+func (e *Engine) load(c *messengerbot.Conversation) (*Context, []string, error) {
+	s := c.Session
+	f := e.flow(s.Get(flowKey))
+	if f == nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnknownFlow, s.Get(flowKey))
+	}
+	if f.States[s.Get(stateKey)] == nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnknownState, s.Get(stateKey))
+	}
+	ctx := &Context{c, f, s.Get(stateKey), make(map[string]string)}
+	var history []string
+	if v := s.Get(historyKey); v != "" {
+		if err := json.Unmarshal([]byte(v), &history); err != nil {
+			return nil, nil, err
+		}
+	}
+	if v := s.Get(dataKey); v != "" {
+		if err := json.Unmarshal([]byte(v), &ctx.Data); err != nil {
+			return nil, nil, err
+		}
+	}
+	return ctx, history, nil
+}
+
+// save stores the position of the user in the session. A nil history keeps the stored one
+func (e *Engine) save(ctx *Context, history []string) {
+	s := ctx.Session
+	s.Set(flowKey, ctx.Flow.Name)
+	s.Set(stateKey, ctx.State)
+	s.Set(updatedKey, strconv.FormatInt(time.Now().Unix(), 10))
+	data, _ := json.Marshal(ctx.Data)
+	s.Set(dataKey, string(data))
+	if history != nil || s.Get(historyKey) == "" {
+		if history == nil {
+			history = []string{}
+		}
+		h, _ := json.Marshal(history)
+		s.Set(historyKey, string(h))
+	}
+}
+
+func clearFlow(s *messengerbot.Session) {
+	for _, key := range []string{flowKey, stateKey, historyKey, dataKey, updatedKey} {
+		s.Delete(key)
+	}
+}
+
+func inputOf(ev *messengerbot.Event) (Input, bool) {
+	switch ev.Type {
+	case messengerbot.MESSAGE_EVENT:
+		if ev.Message.QuickReply != nil {
+			return Input{Type: QUICK_REPLY_INPUT, Text: ev.Message.Text, Payload: ev.Message.QuickReply.Payload}, true
+		}
+		return Input{Type: TEXT_INPUT, Text: ev.Message.Text}, true
+	case messengerbot.ATTACHMENT_EVENT:
+		if ev.Attachment.Coordinates != nil {
+			return Input{Type: LOCATION_INPUT, Attachment: ev.Attachment}, true
+		}
+		return Input{Type: ATTACHMENT_INPUT, Attachment: ev.Attachment}, true
+	case messengerbot.POSTBACK_EVENT:
+		return Input{Type: POSTBACK_INPUT, Payload: ev.Postback.Payload}, true
+	}
+	return Input{}, false
+}
+
+func matchesWord(text string, words []string) bool {
+	text = strings.TrimSpace(text)
+	for _, word := range words {
+		if strings.EqualFold(text, word) {
+			return true
+		}
+	}
+	return false
+}
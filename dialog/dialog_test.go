@@ -0,0 +1,190 @@
+package dialog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+type sentTexts struct {
+	mu       sync.Mutex
+	texts    []string
+	messages []*messengerbot.Message
+}
+
+func (s *sentTexts) take() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	texts := s.texts
+	s.texts = nil
+	return texts
+}
+
+func newTestWebhook(t *testing.T) (*messengerbot.Webhook, *sentTexts) {
+	sent := new(sentTexts)
+	graph := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var envelope messengerbot.MessageEnvelope
+		json.NewDecoder(req.Body).Decode(&envelope)
+		if envelope.Message != nil {
+			sent.mu.Lock()
+			sent.texts = append(sent.texts, envelope.Message.Text)
+			sent.messages = append(sent.messages, envelope.Message)
+			sent.mu.Unlock()
+		}
+		fmt.Fprint(res, `{"recipient_id":"user","message_id":"mid.1"}`)
+	}))
+	t.Cleanup(graph.Close)
+	w := messengerbot.NewMessengerWebhook("token", "token")
+	w.SetGraphApiUrl(graph.URL)
+	store := messengerbot.NewMemorySessionStore(time.Minute)
+	t.Cleanup(func() { store.Close() })
+	w.UseSessionStore(store, time.Hour)
+	return w, sent
+}
+
+func post(w *messengerbot.Webhook, event string) {
+	body := `{"object":"page","entry":[{"id":"page","time":1458692752478,"messaging":[{
+		"sender":{"id":"user"},"recipient":{"id":"page"},"timestamp":1458692752478,` + event + `}]}]}`
+	w.Handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body)))
+}
+
+func say(w *messengerbot.Webhook, text string) {
+	post(w, fmt.Sprintf(`"message":{"mid":"mid.1","seq":1,"text":%q}`, text))
+}
+
+func bookingFlow(done *map[string]string) *Flow {
+	f := NewFlow("booking", "date")
+	f.AddState(&State{
+		Name:    "date",
+		Prompt:  messengerbot.NewTextMessage("Which date?", nil),
+		Expects: []InputType{TEXT_INPUT},
+		Validate: func(c *Context, in Input) error {
+			if _, err := time.Parse("2006-01-02", in.Text); err != nil {
+				return errors.New("Please use YYYY-MM-DD.")
+			}
+			return nil
+		},
+		Save: "date",
+		Next: "time",
+	})
+	f.AddState(&State{
+		Name:    "time",
+		Prompt:  messengerbot.NewTextMessage("Morning or evening?", nil),
+		Expects: []InputType{TEXT_INPUT},
+		Save:    "time",
+		On:      map[string]string{"morning": "confirm", "evening": "confirm"},
+		Retry:   "Morning or evening only.",
+	})
+	f.AddState(&State{
+		Name:    "confirm",
+		Prompt:  messengerbot.NewTextMessage("Confirm?", nil),
+		Expects: []InputType{POSTBACK_INPUT, QUICK_REPLY_INPUT},
+		On:      map[string]string{"YES": ""},
+	})
+	f.OnComplete = func(c *Context) {
+		*done = c.Data
+		c.ReplyText("Booked.")
+	}
+	return f
+}
+
+func TestEngine(t *testing.T) {
+	w, sent := newTestWebhook(t)
+	e := NewEngine(w)
+	var done map[string]string
+	e.Register(bookingFlow(&done))
+	w.ConversationMessageHandler(func(c *messengerbot.Conversation, m messengerbot.IncomingTextMessage) bool {
+		if m.Text == "book" {
+			if err := e.Start(c, "booking"); err != nil {
+				t.Error(err)
+			}
+		} else {
+			c.ReplyText("echo " + m.Text)
+		}
+		return true
+	})
+
+	steps := []struct {
+		say  string
+		want []string
+	}{
+		{"book", []string{"Which date?"}},
+		{"tomorrow", []string{"Please use YYYY-MM-DD.", "Which date?"}},
+		{"2026-10-20", []string{"Morning or evening?"}},
+		{"noon", []string{"Morning or evening only.", "Morning or evening?"}},
+		{"back", []string{"Which date?"}},
+		{"2026-10-21", []string{"Morning or evening?"}},
+		{"evening", []string{"Confirm?"}},
+		{"yes", []string{"Sorry, I didn't get that.", "Confirm?"}},
+	}
+	for _, step := range steps {
+		say(w, step.say)
+		if got := sent.take(); !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("after %q sent %q, want %q", step.say, got, step.want)
+		}
+	}
+	post(w, `"postback":{"payload":"YES"}`)
+	if got := sent.take(); !reflect.DeepEqual(got, []string{"Booked."}) {
+		t.Fatalf("after postback sent %q", got)
+	}
+	if want := map[string]string{"date": "2026-10-21", "time": "evening"}; !reflect.DeepEqual(done, want) {
+		t.Errorf("completed with %v, want %v", done, want)
+	}
+
+	say(w, "hello")
+	if got := sent.take(); !reflect.DeepEqual(got, []string{"echo hello"}) {
+		t.Errorf("after the flow sent %q", got)
+	}
+	say(w, "book")
+	say(w, "Cancel")
+	say(w, "hello")
+	if got := sent.take(); !reflect.DeepEqual(got, []string{"Which date?", "Cancelled.", "echo hello"}) {
+		t.Errorf("cancel sent %q", got)
+	}
+}
+
+func TestEngineTimeoutAndLocation(t *testing.T) {
+	w, sent := newTestWebhook(t)
+	e := NewEngine(w)
+	f := NewFlow("where", "location")
+	f.AddState(&State{
+		Name:    "location",
+		Prompt:  messengerbot.NewTextMessage("Where are you?", nil),
+		Expects: []InputType{LOCATION_INPUT},
+		Save:    "location",
+	})
+	var location string
+	f.OnComplete = func(c *Context) { location = c.Get("location") }
+	f.OnTimeout = func(c *Context) { c.ReplyText("Too slow.") }
+	e.Register(f)
+	w.ConversationMessageHandler(func(c *messengerbot.Conversation, m messengerbot.IncomingTextMessage) bool {
+		if m.Text == "where" {
+			e.Start(c, "where")
+		}
+		return true
+	})
+
+	say(w, "where")
+	post(w, `"message":{"mid":"mid.2","seq":2,"attachments":[{"type":"location",
+		"payload":{"coordinates":{"lat":6.9271,"long":79.8612}}}]}`)
+	if location != "6.9271,79.8612" {
+		t.Errorf("saved location %q", location)
+	}
+
+	f.Timeout = time.Nanosecond
+	say(w, "where")
+	time.Sleep(time.Second)
+	say(w, "somewhere")
+	if got := sent.take(); !reflect.DeepEqual(got, []string{"Where are you?", "Where are you?", "Too slow."}) {
+		t.Errorf("sent %q", got)
+	}
+}
@@ -0,0 +1,328 @@
+package dialog
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+type SlotType string
+
+const (
+	TEXT_SLOT   SlotType = "text"
+	EMAIL_SLOT  SlotType = "email"
+	PHONE_SLOT  SlotType = "phone"
+	DATE_SLOT   SlotType = "date"
+	NUMBER_SLOT SlotType = "number"
+	CHOICE_SLOT SlotType = "choice"
+)
+
+// skipPayload is the payload of the quick reply offered for optional slots
+const skipPayload = "dialog.skip"
+
+// Slot is a single value collected by a form
+type Slot struct {
+	// Name is the key of the value and matches the struct field tagged `form:"name"` or, without a tag,
+	// the field with that name ignoring case
+	Name   string
+	Type   SlotType
+	Prompt string
+	// Choices are offered as quick replies, and for CHOICE_SLOT the answer must be one of them
+	Choices []string
+	// Optional slots offer a quick reply to skip them, leaving the value empty
+	Optional bool
+	// When, if set, is asked with the values collected so far and the slot is only asked if it returns true
+	When func(values map[string]string) bool
+	// Error is sent when the answer cannot be parsed, instead of the default message of the slot type
+	Error string
+	// Validate is called with the parsed value and rejects it with an error sent to the user
+	Validate func(value string) error
+	// DateLayout is the layout DATE_SLOT answers are parsed and stored with, "2006-01-02" by default
+	DateLayout string
+}
+
+func (s *Slot) applies(values map[string]string) bool {
+	return s.When == nil || s.When(values)
+}
+
+func (s *Slot) prompt(skipText string) *messengerbot.Message {
+	var quickReplies []messengerbot.QuickReply
+	switch s.Type {
+	case EMAIL_SLOT:
+		quickReplies = append(quickReplies, messengerbot.QuickReply{ContentType: messengerbot.USER_EMAIL})
+	case PHONE_SLOT:
+		quickReplies = append(quickReplies, messengerbot.QuickReply{ContentType: messengerbot.USER_PHONE_NUMBER})
+	}
+	for _, choice := range s.Choices {
+		quickReplies = append(quickReplies, messengerbot.QuickReply{ContentType: messengerbot.TEXT, Title: choice, Payload: choice})
+	}
+	if s.Optional {
+		quickReplies = append(quickReplies, messengerbot.QuickReply{ContentType: messengerbot.TEXT, Title: skipText, Payload: skipPayload})
+	}
+	return messengerbot.NewTextMessage(s.Prompt, quickReplies)
+}
+
+// parse returns the normalised value of an answer, which must also fit a field of type t when it is a
+// number. t is nil when the slot has no field
+func (s *Slot) parse(answer string, t reflect.Type) (string, error) {
+	answer = strings.TrimSpace(answer)
+	value, err := s.parseType(answer)
+	if err == nil && t != nil {
+		err = fits(value, t)
+	}
+	if err != nil {
+		if s.Error != "" {
+			return "", errors.New(s.Error)
+		}
+		return "", err
+	}
+	if s.Validate != nil {
+		if err := s.Validate(value); err != nil {
+			return "", err
+		}
+	}
+	return value, nil
+}
+
+func (s *Slot) parseType(answer string) (string, error) {
+	switch s.Type {
+	case EMAIL_SLOT:
+		address, err := mail.ParseAddress(answer)
+		if err != nil || !strings.Contains(address.Address, "@") {
+			return "", errors.New("Please enter a valid email address.")
+		}
+		return address.Address, nil
+	case PHONE_SLOT:
+		phone := strings.Map(func(r rune) rune {
+			if strings.ContainsRune(" -().", r) {
+				return -1
+			}
+			return r
+		}, answer)
+		digits := strings.TrimPrefix(phone, "+")
+		if _, err := strconv.ParseUint(digits, 10, 64); err != nil || len(digits) < 7 || len(digits) > 15 {
+			return "", errors.New("Please enter a valid phone number.")
+		}
+		return phone, nil
+	case DATE_SLOT:
+		layout := s.DateLayout
+		if layout == "" {
+			layout = "2006-01-02"
+		}
+		date, err := time.Parse(layout, answer)
+		if err != nil {
+			return "", errors.New("Please enter a date like " + layout + ".")
+		}
+		return date.Format(layout), nil
+	case NUMBER_SLOT:
+		number, err := strconv.ParseFloat(answer, 64)
+		if err != nil {
+			return "", errors.New("Please enter a number.")
+		}
+		return strconv.FormatFloat(number, 'f', -1, 64), nil
+	case CHOICE_SLOT:
+		for _, choice := range s.Choices {
+			if strings.EqualFold(answer, choice) {
+				return choice, nil
+			}
+		}
+		return "", errors.New("Please choose one of " + strings.Join(s.Choices, ", ") + ".")
+	}
+	if answer == "" {
+		return "", errors.New("Please enter some text.")
+	}
+	return answer, nil
+}
+
+// fits checks that a value can be stored in a field of type t without losing part of it
+func fits(value string, t reflect.Type) error {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, err := strconv.ParseInt(value, 10, t.Bits()); errors.Is(err, strconv.ErrRange) {
+			max := int64(1)<<(t.Bits()-1) - 1
+			return fmt.Errorf("Please enter a number between %d and %d.", -max-1, max)
+		} else if err != nil {
+			return errors.New("Please enter a whole number.")
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, err := strconv.ParseUint(value, 10, t.Bits()); errors.Is(err, strconv.ErrRange) {
+			return fmt.Errorf("Please enter a number between 0 and %d.", ^uint64(0)>>(64-t.Bits()))
+		} else if err != nil {
+			return errors.New("Please enter a positive whole number.")
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, err := strconv.ParseFloat(value, t.Bits()); errors.Is(err, strconv.ErrRange) {
+			return errors.New("Please enter a smaller number.")
+		} else if err != nil {
+			return errors.New("Please enter a number.")
+		}
+	}
+	return nil
+}
+
+// Form collects a value for each of its slots, in order, and fills a struct with them
+type Form struct {
+	Name  string
+	Slots []*Slot
+	// SkipText is the title of the quick reply skipping optional slots
+	SkipText string
+	// OnComplete receives a pointer to a new struct of the type given to NewForm, filled with the answers
+	OnComplete func(c *Context, result interface{})
+	resultType reflect.Type
+}
+
+// NewForm creates a form whose results are structs of the same type as result, which may be a struct or a
+// pointer to one. Fields may be strings, numbers, bools or, for date slots, time.Time
+func NewForm(name string, result interface{}) *Form {
+	t := reflect.TypeOf(result)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		panic("dialog: form result must be a struct")
+	}
+	return &Form{Name: name, SkipText: "Skip", resultType: t}
+}
+
+// AddSlot appends a slot to the form
+func (f *Form) AddSlot(s *Slot) *Form {
+	f.Slots = append(f.Slots, s)
+	return f
+}
+
+// field returns the result field the slot is stored in
+func (f *Form) field(slot *Slot) (reflect.StructField, bool) {
+	for i := 0; i < f.resultType.NumField(); i++ {
+		field := f.resultType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Tag.Get("form")
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(slot.Name, name) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// nextSlot returns the name of the first slot after index i which applies to the values, or ""
+func (f *Form) nextSlot(i int, values map[string]string) string {
+	for _, s := range f.Slots[i+1:] {
+		if s.applies(values) {
+			return s.Name
+		}
+	}
+	return ""
+}
+
+// Flow compiles the form into a flow with a state per slot
+func (f *Form) Flow() *Flow {
+	flow := NewFlow(f.Name, f.nextSlot(-1, map[string]string{}))
+	for i, slot := range f.Slots {
+		i, slot := i, slot
+		var fieldType reflect.Type
+		if field, ok := f.field(slot); ok {
+			fieldType = field.Type
+		}
+		skipped := func(in Input) bool {
+			return slot.Optional && (in.Payload == skipPayload || strings.EqualFold(strings.TrimSpace(in.Text), f.SkipText))
+		}
+		flow.AddState(&State{
+			Name:    slot.Name,
+			Prompt:  slot.prompt(f.SkipText),
+			Expects: []InputType{TEXT_INPUT},
+			// the value parsed when validating is kept for Transition, so Slot.Validate runs once per answer
+			Validate: func(c *Context, in Input) error {
+				value := ""
+				if !skipped(in) {
+					var err error
+					if value, err = slot.parse(in.Value(), fieldType); err != nil {
+						return err
+					}
+				}
+				c.Set(slot.Name, value)
+				return nil
+			},
+			Transition: func(c *Context, in Input) string {
+				return f.nextSlot(i, c.Data)
+			},
+		})
+	}
+	flow.OnComplete = func(c *Context) {
+		if f.OnComplete != nil {
+			f.OnComplete(c, f.fill(c.Data))
+		}
+	}
+	return flow
+}
+
+// RegisterForm registers the flow of the form on the engine. Start the form with Engine.Start and its name
+func (e *Engine) RegisterForm(f *Form) {
+	e.Register(f.Flow())
+}
+
+// fill creates a new result struct from the collected values
+func (f *Form) fill(values map[string]string) interface{} {
+	result := reflect.New(f.resultType)
+	v := result.Elem()
+	for i := 0; i < f.resultType.NumField(); i++ {
+		field := f.resultType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Tag.Get("form")
+		if name == "" {
+			name = field.Name
+		}
+		for _, slot := range f.Slots {
+			if value, ok := values[slot.Name]; ok && value != "" && strings.EqualFold(slot.Name, name) {
+				setField(v.Field(i), slot, value)
+			}
+		}
+	}
+	return result.Interface()
+}
+
+func setField(field reflect.Value, slot *Slot, value string) {
+	if field.Type() == reflect.TypeOf(time.Time{}) {
+		layout := slot.DateLayout
+		if layout == "" {
+			layout = "2006-01-02"
+		}
+		if t, err := time.Parse(layout, value); err == nil {
+			field.Set(reflect.ValueOf(t))
+		}
+		return
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			field.SetInt(n)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, err := strconv.ParseUint(value, 10, 64); err == nil {
+			field.SetUint(n)
+		}
+	case reflect.Float32, reflect.Float64:
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			field.SetFloat(n)
+		}
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(value); err == nil {
+			field.SetBool(b)
+		} else {
+			field.SetBool(strings.EqualFold(value, "yes"))
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package dialog
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+type signup struct {
+	Email    string
+	Phone    string `form:"phone"`
+	Birthday time.Time
+	Guests   int    `form:"guests"`
+	Meal     string `form:"meal"`
+	Notes    string `form:"notes"`
+}
+
+func TestForm(t *testing.T) {
+	w, sent := newTestWebhook(t)
+	e := NewEngine(w)
+	form := NewForm("signup", signup{})
+	form.AddSlot(&Slot{Name: "email", Type: EMAIL_SLOT, Prompt: "Your email?"})
+	form.AddSlot(&Slot{Name: "phone", Type: PHONE_SLOT, Prompt: "Your phone?", Error: "That is not a phone number."})
+	form.AddSlot(&Slot{Name: "birthday", Type: DATE_SLOT, Prompt: "Your birthday?", DateLayout: "02/01/2006"})
+	form.AddSlot(&Slot{Name: "guests", Type: NUMBER_SLOT, Prompt: "How many guests?",
+		Validate: func(v string) error {
+			if v == "0" {
+				return fmt.Errorf("At least one guest please.")
+			}
+			return nil
+		}})
+	form.AddSlot(&Slot{Name: "meal", Type: CHOICE_SLOT, Prompt: "Meal?", Choices: []string{"Fish", "Veg"},
+		When: func(values map[string]string) bool { return values["guests"] != "1" }})
+	form.AddSlot(&Slot{Name: "notes", Type: TEXT_SLOT, Prompt: "Anything else?", Optional: true})
+	var result *signup
+	form.OnComplete = func(c *Context, r interface{}) { result = r.(*signup) }
+	e.RegisterForm(form)
+	w.ConversationMessageHandler(func(c *messengerbot.Conversation, m messengerbot.IncomingTextMessage) bool {
+		e.Start(c, "signup")
+		return true
+	})
+
+	say(w, "signup")
+	if got := sent.messages[0].QuickReplies; len(got) != 1 || got[0].ContentType != messengerbot.USER_EMAIL {
+		t.Errorf("email prompt quick replies = %v", got)
+	}
+	sent.take()
+	post(w, `"message":{"mid":"mid.1","seq":1,"text":"peter@example.com",
+		"quick_reply":{"payload":"peter@example.com"}}`)
+	if got := sent.take(); !reflect.DeepEqual(got, []string{"Your phone?"}) {
+		t.Fatalf("after email sent %q", got)
+	}
+	steps := []struct {
+		say  string
+		want []string
+	}{
+		{"call me", []string{"That is not a phone number.", "Your phone?"}},
+		{"+94 (77) 123-4567", []string{"Your birthday?"}},
+		{"1990-01-31", []string{"Please enter a date like 02/01/2006.", "Your birthday?"}},
+		{"31/01/1990", []string{"How many guests?"}},
+		{"2.5", []string{"Please enter a whole number.", "How many guests?"}},
+		{"0", []string{"At least one guest please.", "How many guests?"}},
+		{"2", []string{"Meal?"}},
+		{"veg", []string{"Anything else?"}},
+		{"skip", nil},
+	}
+	for _, step := range steps {
+		sent.messages = nil
+		say(w, step.say)
+		if got := sent.take(); !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("after %q sent %q, want %q", step.say, got, step.want)
+		}
+	}
+
+	want := &signup{
+		Email:    "peter@example.com",
+		Phone:    "+94771234567",
+		Birthday: time.Date(1990, 1, 31, 0, 0, 0, 0, time.UTC),
+		Guests:   2,
+		Meal:     "Veg",
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("result = %+v, want %+v", result, want)
+	}
+
+	// a single guest skips the meal slot
+	say(w, "signup")
+	for _, answer := range []string{"a@b.c", "0771234567", "01/02/2000", "1", "no"} {
+		say(w, answer)
+	}
+	if result.Guests != 1 || result.Meal != "" || result.Notes != "no" {
+		t.Errorf("result = %+v", result)
+	}
+}
+
+type booking struct {
+	Guests int8
+	Rooms  uint8
+	Budget float32
+}
+
+func TestFormFieldSize(t *testing.T) {
+	w, sent := newTestWebhook(t)
+	e := NewEngine(w)
+	form := NewForm("booking", booking{})
+	validated := 0
+	form.AddSlot(&Slot{Name: "guests", Type: NUMBER_SLOT, Prompt: "Guests?",
+		Validate: func(string) error {
+			validated++
+			return nil
+		}})
+	form.AddSlot(&Slot{Name: "rooms", Type: NUMBER_SLOT, Prompt: "Rooms?"})
+	form.AddSlot(&Slot{Name: "budget", Type: NUMBER_SLOT, Prompt: "Budget?"})
+	var result *booking
+	form.OnComplete = func(c *Context, r interface{}) { result = r.(*booking) }
+	e.RegisterForm(form)
+	w.ConversationMessageHandler(func(c *messengerbot.Conversation, m messengerbot.IncomingTextMessage) bool {
+		e.Start(c, "booking")
+		return true
+	})
+
+	say(w, "booking")
+	sent.take()
+	steps := []struct {
+		say  string
+		want []string
+	}{
+		{"300", []string{"Please enter a number between -128 and 127.", "Guests?"}},
+		{"-3", []string{"Rooms?"}},
+		{"256", []string{"Please enter a number between 0 and 255.", "Rooms?"}},
+		{"-1", []string{"Please enter a positive whole number.", "Rooms?"}},
+		{"2", []string{"Budget?"}},
+		{"1e39", []string{"Please enter a smaller number.", "Budget?"}},
+		{"99.5", nil},
+	}
+	for _, step := range steps {
+		sent.messages = nil
+		say(w, step.say)
+		if got := sent.take(); !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("after %q sent %q, want %q", step.say, got, step.want)
+		}
+	}
+	if want := (&booking{Guests: -3, Rooms: 2, Budget: 99.5}); !reflect.DeepEqual(result, want) || validated != 1 {
+		t.Errorf("result = %+v, validated %d times", result, validated)
+	}
+}
+
+func TestFormNothingToAsk(t *testing.T) {
+	w, sent := newTestWebhook(t)
+	e := NewEngine(w)
+	form := NewForm("notes", &signup{})
+	form.AddSlot(&Slot{Name: "notes", Type: TEXT_SLOT, Prompt: "Anything else?",
+		When: func(map[string]string) bool { return false }})
+	var result *signup
+	form.OnComplete = func(c *Context, r interface{}) { result = r.(*signup) }
+	e.RegisterForm(form)
+	w.ConversationMessageHandler(func(c *messengerbot.Conversation, m messengerbot.IncomingTextMessage) bool {
+		if err := e.Start(c, "notes"); err != nil {
+			t.Error(err)
+		}
+		return true
+	})
+
+	say(w, "notes")
+	if got := sent.take(); result == nil || len(got) != 0 {
+		t.Errorf("result %+v, sent %q", result, got)
+	}
+}
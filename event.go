@@ -0,0 +1,77 @@
+package messengerbot
+
+import (
+	"time"
+)
+
+type EventType string
+
+const (
+	OPTIN_EVENT      EventType = "optin"
+	MESSAGE_EVENT    EventType = "message"
+	ATTACHMENT_EVENT EventType = "attachment"
+	DELIVERY_EVENT   EventType = "delivery"
+	POSTBACK_EVENT   EventType = "postback"
+)
+
+// Event is a single messaging event received by the webhook. Exactly one of Optin, Message, Attachment,
+// Delivery and Postback is set, according to Type
+type Event struct {
+	Type       EventType
+	PageId     string
+	Sender     Sender
+	Recipient  Recipient
+	Timestamp  time.Time
+	Optin      *EventOptin
+	Message    *IncomingTextMessage
+	Attachment *IncomingAttachmentMessage
+	Delivery   *EventDelivery
+	Postback   *EventPostback
+	// Profile is set by ProfileMiddleware
+	Profile *UserProfile
+	// Session is set when the webhook has a session store
+	Session *Session
+	webhook *Webhook
+	// dedupKey identifies the event among redeliveries of the request it came in
+	dedupKey string
+}
+
+// EventHandler handles an event, returning whether it was handled
+type EventHandler func(*Event) bool
+
+// Middleware wraps the handling of every event received by the webhook
+type Middleware func(next EventHandler) EventHandler
+
+// Webhook returns the webhook the event was received by
+func (e *Event) Webhook() *Webhook {
+	return e.webhook
+}
+
+// Conversation returns the conversation of the event
+func (e *Event) Conversation() *Conversation {
+	return &Conversation{e}
+}
+
+// Use adds middlewares around the handling of all events. Middlewares run in the order they are added:
+// the first middleware added is the outermost, it sees the event first and the result last, and each
+// middleware decides whether to call the next one. The callbacks, router and dispatcher run innermost
+func (w *Webhook) Use(middlewares ...Middleware) {
+	w.middlewares = append(w.middlewares, middlewares...)
+}
+
+// dispatch runs the event through the middlewares and the callback registered for its type
+func (w *Webhook) dispatch(e *Event) bool {
+	e.webhook = w
+	if w.dedupStore != nil && w.duplicate(e) {
+		return true
+	}
+	h := EventHandler(w.handleEvent)
+	for i := len(w.middlewares) - 1; i >= 0; i-- {
+		h = w.middlewares[i](h)
+	}
+	if w.sessionStore != nil {
+		w.loadSession(e)
+		defer w.saveSession(e)
+	}
+	return h(e)
+}
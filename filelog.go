@@ -0,0 +1,119 @@
+package messengerbot
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// appendLog is a file of JSON records, one per line, which the file stores append a record to for each
+// change. The stores keep their data in memory, and compact the log to the records their data needs once
+// it holds more than twice as many and when it is opened
+type appendLog struct {
+	path string
+	// name tells what the records are in warnings
+	name    string
+	file    *os.File
+	records int
+	// retryAt is the number of records from which compaction is tried again after it failed
+	retryAt int
+}
+
+func newAppendLog(path, name string) *appendLog {
+	l := new(appendLog)
+	l.path = path
+	l.name = name
+	return l
+}
+
+// load calls apply with each record of the log, skipping the records which cannot be decoded
+func (l *appendLog) load(apply func(data []byte) error) error {
+	file, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if err := apply(scanner.Bytes()); err != nil {
+			// a crash while appending leaves a partial last record
+			log.Println("warning: skipping unreadable", l.name, "record", l.path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// append writes a record to the log and syncs it
+func (l *appendLog) append(r interface{}) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.records++
+	return nil
+}
+
+// full reports whether the log holds more than twice the records needed
+func (l *appendLog) full(needed int) bool {
+	return l.records > 2*needed+100 && l.records >= l.retryAt
+}
+
+// compactIfFull compacts the log when it is full. The records appended are durable whether it can be
+// compacted or not, so a failure is logged and compaction is tried again once the log has doubled
+func (l *appendLog) compactIfFull(needed int, snapshot func(write func(r interface{}) error) error) {
+	if !l.full(needed) {
+		return
+	}
+	if err := l.compact(snapshot); err != nil {
+		log.Println("warning: cannot compact", l.name, "log", l.path, err)
+		l.retryAt = 2 * l.records
+	}
+}
+
+// compact replaces the log with the records snapshot writes. The log is left as it was when it cannot be
+// replaced
+func (l *appendLog) compact(snapshot func(write func(r interface{}) error) error) error {
+	tmp := l.path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	records := 0
+	err = snapshot(func(r interface{}) error {
+		records++
+		return enc.Encode(r)
+	})
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// out now is the log, and is written to from its end
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = out
+	l.records = records
+	return nil
+}
+
+func (l *appendLog) close() error {
+	return l.file.Close()
+}
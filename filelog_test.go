@@ -0,0 +1,35 @@
+package messengerbot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAppendLogFailedCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	l := newAppendLog(path, "test")
+	snapshot := func(write func(r interface{}) error) error { return write("kept") }
+	if err := l.compact(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	// the log is moved away and a directory takes its place, so it cannot be replaced
+	moved := path + ".moved"
+	os.Rename(path, moved)
+	os.MkdirAll(filepath.Join(path, "in the way"), 0700)
+	if err := l.compact(snapshot); err == nil {
+		t.Fatal("compacted over a directory")
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary log left: %v", err)
+	}
+	if err := l.append("appended"); err != nil {
+		t.Fatal(err)
+	}
+	l.close()
+	if data, _ := ioutil.ReadFile(moved); strings.Join(strings.Fields(string(data)), " ") != `"kept" "appended"` {
+		t.Errorf("log holds %q", data)
+	}
+}
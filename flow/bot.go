@@ -0,0 +1,211 @@
+package flow
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+// session keys, variables are stored under varPrefix + name
+const (
+	nodeKey   = "flow.node"
+	varPrefix = "flow.var."
+)
+
+// Bot runs a flow definition on a webhook
+type Bot struct {
+	mu   sync.RWMutex
+	def  *Definition
+	path string
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewBot creates a bot running the given definition and adds it as a middleware to the webhook. Events
+// no transition of the user's node matches are passed on
+func NewBot(w *messengerbot.Webhook, def *Definition) *Bot {
+	b := &Bot{def: def}
+	w.Use(b.Middleware)
+	return b
+}
+
+// LoadBot loads the flow file at path and creates a bot running it
+func LoadBot(w *messengerbot.Webhook, path string) (*Bot, error) {
+	def, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	b := NewBot(w, def)
+	b.path = path
+	return b, nil
+}
+
+// Definition returns the definition the bot is running
+func (b *Bot) Definition() *Definition {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.def
+}
+
+// Reload loads the flow file again, keeping the running definition when the file is invalid
+func (b *Bot) Reload() error {
+	def, err := Load(b.path)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.def = def
+	b.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the flow file whenever its modification time or size changes, checking every interval.
+// Invalid files are logged and ignored. It does nothing for bots not created by LoadBot
+func (b *Bot) Watch(interval time.Duration) {
+	if b.path == "" || b.stop != nil {
+		return
+	}
+	b.stop = make(chan struct{})
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(b.path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+	modTime, size := stat()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m, s := stat()
+				if s < 0 || (m.Equal(modTime) && s == size) {
+					continue
+				}
+				modTime, size = m, s
+				if err := b.Reload(); err != nil {
+					log.Println("warning: keeping the running flow, cannot reload :", err)
+				} else {
+					log.Println("flow reloaded : ", b.path)
+				}
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops watching the flow file. Calling it again does nothing
+func (b *Bot) Close() {
+	b.once.Do(func() {
+		if b.stop != nil {
+			close(b.stop)
+		}
+	})
+}
+
+// Middleware moves users through the flow
+func (b *Bot) Middleware(next messengerbot.EventHandler) messengerbot.EventHandler {
+	return func(e *messengerbot.Event) bool {
+		if e.Session == nil || (e.Type != messengerbot.MESSAGE_EVENT && e.Type != messengerbot.POSTBACK_EVENT) {
+			return next(e)
+		}
+		def := b.Definition()
+		c := e.Conversation()
+		current := def.Nodes[e.Session.Get(nodeKey)]
+		if current == nil {
+			// first contact, or the node was removed by a reload
+			b.enter(c, def, def.Start)
+			return true
+		}
+		t, captures := match(current, e)
+		if t == nil {
+			return next(e)
+		}
+		vars := variables(c, def)
+		for k, v := range captures {
+			vars[k] = v
+			e.Session.Set(varPrefix+k, v)
+		}
+		for k, v := range t.Set {
+			e.Session.Set(varPrefix+k, interpolateString(v, vars))
+		}
+		b.enter(c, def, t.To)
+		return true
+	}
+}
+
+// enter sends the messages of the node and moves the user to it. Users entering a node without
+// transitions are moved back to the start node without sending its messages
+func (b *Bot) enter(c *messengerbot.Conversation, def *Definition, name string) {
+	node := def.Nodes[name]
+	vars := variables(c, def)
+	for _, raw := range node.Messages {
+		spec, err := decodeMessage(interpolate(raw, vars))
+		if err != nil {
+			log.Println("warning: cannot build message of node", name, err)
+			continue
+		}
+		c.Reply(spec.Message())
+	}
+	if len(node.Transitions) == 0 {
+		name = def.Start
+	}
+	c.Session.Set(nodeKey, name)
+}
+
+func match(node *Node, e *messengerbot.Event) (*Transition, map[string]string) {
+	text, payload := "", ""
+	switch e.Type {
+	case messengerbot.MESSAGE_EVENT:
+		text = e.Message.Text
+		if e.Message.QuickReply != nil {
+			payload = e.Message.QuickReply.Payload
+		}
+	case messengerbot.POSTBACK_EVENT:
+		payload = e.Postback.Payload
+	}
+	for _, t := range node.Transitions {
+		switch {
+		case t.Payload != "" && payload != "" && t.Payload == payload:
+			return t, nil
+		case t.pattern != nil && e.Type == messengerbot.MESSAGE_EVENT:
+			if m := t.pattern.FindStringSubmatch(text); m != nil {
+				captures := make(map[string]string)
+				for i, name := range t.pattern.SubexpNames() {
+					if name != "" {
+						captures[name] = m[i]
+					}
+				}
+				return t, captures
+			}
+		case t.Default:
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+// variables returns the global variables overridden by the sender's profile and their own variables
+func variables(c *messengerbot.Conversation, def *Definition) map[string]string {
+	vars := make(map[string]string)
+	for k, v := range def.Variables {
+		vars[k] = v
+	}
+	if p := c.Profile; p != nil {
+		vars["first_name"] = p.FirstName
+		vars["last_name"] = p.LastName
+	}
+	for k, v := range c.Session.Values {
+		if strings.HasPrefix(k, varPrefix) {
+			vars[strings.TrimPrefix(k, varPrefix)] = v
+		}
+	}
+	return vars
+}
@@ -0,0 +1,394 @@
+// Package flow runs conversations described in a JSON file on top of a messengerbot Webhook.
+//
+// A flow file has a start node, global variables and named nodes. Entering a node sends its messages,
+// and the next input from the user is matched against the node's transitions: a regular expression on
+// the text, an exact postback or quick reply payload, or a default. Named groups of matched expressions
+// and the "set" of the transition become variables of the user, and {{name}} in messages is replaced by
+// the variable's value. The node each user is at and their variables are kept in their
+// messengerbot.Session, so the webhook must have a session store.
+//
+// YAML is not supported, the module has no YAML parser.
+package flow
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+// Definition is a parsed flow file
+type Definition struct {
+	Start     string            `json:"start"`
+	Variables map[string]string `json:"variables,omitempty"`
+	Nodes     map[string]*Node  `json:"nodes"`
+}
+
+// Node is a point in the conversation
+type Node struct {
+	// Messages are MessageSpecs, kept raw so variables can be replaced before they are decoded
+	Messages    []json.RawMessage `json:"messages"`
+	Transitions []*Transition     `json:"transitions,omitempty"`
+}
+
+// Transition moves the user to another node. Exactly one of Text, Payload and Default is set
+type Transition struct {
+	// Text is a regular expression matched against text messages
+	Text string `json:"text,omitempty"`
+	// Payload is matched against postback and quick reply payloads
+	Payload string `json:"payload,omitempty"`
+	// Default matches any input
+	Default bool              `json:"default,omitempty"`
+	To      string            `json:"to"`
+	Set     map[string]string `json:"set,omitempty"`
+	pattern *regexp.Regexp
+}
+
+// MessageSpec describes one message of a node. Text alone is a text message, Text with Buttons a button
+// template, Image an image, Elements a generic template and Receipt a receipt template. QuickReplies may
+// be added to any of them
+type MessageSpec struct {
+	Text         string                                `json:"text,omitempty"`
+	Image        string                                `json:"image,omitempty"`
+	Buttons      []messengerbot.Button                 `json:"buttons,omitempty"`
+	Elements     []messengerbot.GenericTemplateElement `json:"elements,omitempty"`
+	Receipt      *messengerbot.ReceiptTemplate         `json:"receipt,omitempty"`
+	QuickReplies []messengerbot.QuickReply             `json:"quick_replies,omitempty"`
+}
+
+// Message builds the messenger message described by the spec
+func (s *MessageSpec) Message() *messengerbot.Message {
+	quickReplies := s.QuickReplies
+	for i := range quickReplies {
+		if quickReplies[i].ContentType == "" {
+			quickReplies[i].ContentType = messengerbot.TEXT
+		}
+	}
+	switch {
+	case s.Receipt != nil:
+		r := s.Receipt
+		return messengerbot.NewReceiptMessage(r.RecipientName, r.OrderNumber, r.Currency, r.PaymentMethod,
+			r.Timestamp, r.OrderUrl, r.Elements, r.ShippingAddress, r.PaymentSummary, r.Adjustments, quickReplies)
+	case len(s.Elements) > 0:
+		return messengerbot.NewGenericMessage(s.Elements, quickReplies)
+	case s.Image != "":
+		return messengerbot.NewImageMessage(s.Image, quickReplies)
+	case len(s.Buttons) > 0:
+		return messengerbot.NewButtonMessage(s.Text, s.Buttons, quickReplies)
+	}
+	return messengerbot.NewTextMessage(s.Text, quickReplies)
+}
+
+func (s *MessageSpec) validate() string {
+	kinds := 0
+	for _, set := range []bool{s.Receipt != nil, len(s.Elements) > 0, s.Image != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds > 1 || (kinds == 1 && s.Text != "") {
+		return "message must have only one of text, image, elements and receipt"
+	}
+	if kinds == 0 && s.Text == "" {
+		return "message must have text, image, elements or receipt"
+	}
+	return ""
+}
+
+// Error is a problem in a flow file, located by line and column
+type Error struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+}
+
+// Load reads and validates the flow file at path
+func Load(path string) (*Definition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(path, data)
+}
+
+// Parse validates and parses a flow file. name is only used in errors
+func Parse(name string, data []byte) (*Definition, error) {
+	errorAt := func(offset int64, format string, args ...interface{}) error {
+		line, column := lineAndColumn(data, offset)
+		return &Error{name, line, column, fmt.Sprintf(format, args...)}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	def := new(Definition)
+	if err := dec.Decode(def); err != nil {
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			// the offset is just past the offending character
+			return nil, errorAt(e.Offset-1, "%v", e)
+		case *json.UnmarshalTypeError:
+			return nil, errorAt(e.Offset, "%s must be %s, not %s", e.Field, e.Type, e.Value)
+		}
+		return nil, errorAt(unknownFieldOffset(err, data, reflect.TypeOf(def), 0, dec.InputOffset()), "%v", err)
+	}
+	positions, err := jsonPositions(data)
+	if err != nil {
+		return nil, errorAt(0, "%v", err)
+	}
+	at := func(path string) int64 {
+		// fall back to the closest enclosing value which has a position
+		for path != "" {
+			if offset, ok := positions[path]; ok {
+				return offset
+			}
+			if i := strings.LastIndexAny(path, ".["); i >= 0 {
+				path = path[:i]
+			} else {
+				break
+			}
+		}
+		return 0
+	}
+
+	if def.Start == "" {
+		return nil, errorAt(0, "start node is missing")
+	}
+	if def.Nodes[def.Start] == nil {
+		return nil, errorAt(at("start"), "start node %q is not defined", def.Start)
+	}
+	for _, name := range def.NodeNames() {
+		node := def.Nodes[name]
+		path := "nodes." + name
+		if node == nil {
+			return nil, errorAt(at(path), "node %q is empty", name)
+		}
+		for i, raw := range node.Messages {
+			mpath := fmt.Sprintf("%s.messages[%d]", path, i)
+			if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+				return nil, errorAt(at(mpath), "message is empty")
+			}
+			spec, err := decodeMessage(raw)
+			if err != nil {
+				return nil, errorAt(unknownFieldOffset(err, raw, reflect.TypeOf(spec), at(mpath), at(mpath)), "%v", err)
+			}
+			if msg := spec.validate(); msg != "" {
+				return nil, errorAt(at(mpath), "%s", msg)
+			}
+		}
+		for i, t := range node.Transitions {
+			tpath := fmt.Sprintf("%s.transitions[%d]", path, i)
+			if t == nil {
+				return nil, errorAt(at(tpath), "transition is empty")
+			}
+			kinds := 0
+			for _, set := range []bool{t.Text != "", t.Payload != "", t.Default} {
+				if set {
+					kinds++
+				}
+			}
+			if kinds != 1 {
+				return nil, errorAt(at(tpath), "transition must have exactly one of text, payload and default")
+			}
+			if t.Text != "" {
+				if t.pattern, err = regexp.Compile(t.Text); err != nil {
+					return nil, errorAt(at(tpath+".text"), "invalid text pattern: %v", err)
+				}
+			}
+			if def.Nodes[t.To] == nil {
+				return nil, errorAt(at(tpath+".to"), "transition to undefined node %q", t.To)
+			}
+		}
+	}
+	return def, nil
+}
+
+// unknownFieldOffset locates the key an unknown field error is about: the first key of an object in data
+// which is not a field of the struct it is decoded into, t being the type data is decoded into. data starts
+// at base, and other errors are located at fallback
+func unknownFieldOffset(err error, data []byte, t reflect.Type, base, fallback int64) int64 {
+	if !strings.HasPrefix(err.Error(), "json: unknown field ") {
+		return fallback
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	offset := int64(-1)
+	var walk func(t reflect.Type) error
+	walk = func(t reflect.Type) error {
+		if t != nil && t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		delim, ok := tok.(json.Delim)
+		if !ok {
+			return nil
+		}
+		for dec.More() {
+			var child reflect.Type
+			if delim == '{' {
+				start := skipSeparators(data, dec.InputOffset())
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				var known bool
+				if child, known = fieldType(t, key.(string)); !known && offset < 0 {
+					offset = start
+				}
+			} else if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+				child = t.Elem()
+			}
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+		return err
+	}
+	if walk(t) != nil || offset < 0 {
+		return fallback
+	}
+	return base + offset
+}
+
+// fieldType returns the type the value of key is decoded into in a JSON object decoded into t, and whether
+// the key is known. Objects decoded into anything but a struct take any key
+func fieldType(t reflect.Type, key string) (reflect.Type, bool) {
+	switch {
+	case t == nil:
+		return nil, true
+	case t.Kind() == reflect.Map:
+		return t.Elem(), true
+	case t.Kind() != reflect.Struct:
+		return nil, true
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		// like encoding/json, keys match fields regardless of case
+		if strings.EqualFold(name, key) {
+			return f.Type, true
+		}
+	}
+	return nil, false
+}
+
+// NodeNames returns the names of the nodes in sorted order
+func (d *Definition) NodeNames() []string {
+	names := make([]string, 0, len(d.Nodes))
+	for name := range d.Nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Specs decodes the messages of the node without replacing variables
+func (n *Node) Specs() []*MessageSpec {
+	specs := make([]*MessageSpec, 0, len(n.Messages))
+	for _, raw := range n.Messages {
+		if spec, err := decodeMessage(raw); err == nil {
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
+
+func decodeMessage(raw []byte) (*MessageSpec, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	spec := new(MessageSpec)
+	if err := dec.Decode(spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+var variablePattern = regexp.MustCompile(`{{\s*([A-Za-z0-9_]+)\s*}}`)
+
+// interpolate replaces {{name}} in the string values of a raw message with the variable's value
+func interpolate(raw []byte, vars map[string]string) []byte {
+	return variablePattern.ReplaceAllFunc(raw, func(m []byte) []byte {
+		value := vars[string(variablePattern.FindSubmatch(m)[1])]
+		quoted, _ := json.Marshal(value)
+		return quoted[1 : len(quoted)-1]
+	})
+}
+
+// interpolateString replaces {{name}} in s with the variable's value
+func interpolateString(s string, vars map[string]string) string {
+	return variablePattern.ReplaceAllStringFunc(s, func(m string) string {
+		return vars[variablePattern.FindStringSubmatch(m)[1]]
+	})
+}
+
+// jsonPositions maps the path of every value in a JSON document, such as "nodes.a.transitions[0].to",
+// to the offset where the value starts
+func jsonPositions(data []byte) (map[string]int64, error) {
+	positions := make(map[string]int64)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var walk func(path string) error
+	walk = func(path string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		delim, ok := tok.(json.Delim)
+		if !ok {
+			return nil
+		}
+		for i := 0; dec.More(); i++ {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			if delim == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				p = strings.TrimPrefix(path+"."+key.(string), ".")
+			}
+			positions[p] = skipSeparators(data, dec.InputOffset())
+			if err := walk(p); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+		return err
+	}
+	return positions, walk("")
+}
+
+// skipSeparators returns the offset of the first token at or after offset
+func skipSeparators(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+func lineAndColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
@@ -0,0 +1,192 @@
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		src  string
+		want string
+	}{
+		{`{"start": "a",
+  "nodes": {"a": {"messages": [{"text": "hi"}],}}}`, "test.json:2:48: invalid character '}'"},
+		{`{"start": "b",
+  "nodes": {"a": {"messages": []}}}`, "test.json:1:11: start node \"b\" is not defined"},
+		{`{"start": "a", "nodes": {
+  "a": {"messages": [
+    {"text": "hi", "colour": "red"}
+  ]}}}`, "test.json:3:20: json: unknown field \"colour\""},
+		{`{"start": "a", "variables": {"colour": "red"}, "nodes": {
+  "a": {"messages": [{"text": "hi",
+    "colour": "red"}]}}}`, "test.json:3:5: json: unknown field \"colour\""},
+		{`{"start": "a", "nodes": {
+  "a": {"messages": [], "transitions": [{"default": true, "to": "a"}],
+    "to": "a"}}}`, "test.json:3:5: json: unknown field \"to\""},
+		{`{"start": "a", "nodes": {
+  "a": {"messages": [
+    {"text": "hi", "image": "http://example.com/a.png"}
+  ]}}}`, "test.json:3:5: message must have only one of"},
+		{`{"start": "a", "nodes": {
+  "a": {"messages": [], "transitions": [
+    {"text": "hi", "to": "a"},
+    {"text": "ho", "to": "nowhere"}
+  ]}}}`, "test.json:4:26: transition to undefined node \"nowhere\""},
+		{`{"start": "a", "nodes": {
+  "a": {"messages": [], "transitions": [{"text": "(", "to": "a"}]}}}`, "test.json:2:50: invalid text pattern"},
+		{`{"start": "a", "nodes": {"a": {"messages": "hi"}}}`, "test.json:1:48: nodes.a.messages must be"},
+		{`{"start":"a","nodes":{"a":{"transitions":[null]}}}`, "test.json:1:43: transition is empty"},
+		{`{"start": "a", "nodes": {"a": {"messages": [{"text": "hi"}, null]}}}`, "test.json:1:61: message is empty"},
+	}
+	for _, c := range cases {
+		_, err := Parse("test.json", []byte(c.src))
+		if err == nil || !strings.HasPrefix(err.Error(), c.want) {
+			t.Errorf("Parse(%s)\nerr  = %v\nwant = %s...", c.src, err, c.want)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	data, err := os.ReadFile(filepath.Join("testdata", "shop.json"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Add([]byte(`{"start":"a","nodes":{"a":{"transitions":[null]}}}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Bot.Watch parses files as they are saved, so any content must give a definition or an *Error
+		def, err := Parse("test.json", data)
+		if _, ok := err.(*Error); err != nil && !ok {
+			t.Errorf("Parse failed with %T %v", err, err)
+		}
+		if err == nil && def.Nodes[def.Start] == nil {
+			t.Errorf("start node %q is not defined", def.Start)
+		}
+	})
+}
+
+type sent struct {
+	mu       sync.Mutex
+	messages []*messengerbot.Message
+}
+
+func (s *sent) texts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var texts []string
+	for _, m := range s.messages {
+		if m.Text != "" {
+			texts = append(texts, m.Text)
+		} else {
+			texts = append(texts, "<template>")
+		}
+	}
+	s.messages = nil
+	return texts
+}
+
+func newTestWebhook(t *testing.T) (*messengerbot.Webhook, *sent) {
+	s := new(sent)
+	graph := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		// attachments do not unmarshal into Message, only the text matters here
+		var envelope map[string]json.RawMessage
+		json.NewDecoder(req.Body).Decode(&envelope)
+		if m, ok := envelope["message"]; ok && string(m) != "null" {
+			message := new(messengerbot.Message)
+			json.Unmarshal(m, &struct{ Text *string }{&message.Text})
+			s.mu.Lock()
+			s.messages = append(s.messages, message)
+			s.mu.Unlock()
+		}
+		fmt.Fprint(res, `{"recipient_id":"user","message_id":"mid.1"}`)
+	}))
+	t.Cleanup(graph.Close)
+	w := messengerbot.NewMessengerWebhook("token", "token")
+	w.SetGraphApiUrl(graph.URL)
+	store := messengerbot.NewMemorySessionStore(time.Minute)
+	t.Cleanup(func() { store.Close() })
+	w.UseSessionStore(store, time.Hour)
+	return w, s
+}
+
+func post(w *messengerbot.Webhook, event string) {
+	body := `{"object":"page","entry":[{"id":"page","time":1458692752478,"messaging":[{
+		"sender":{"id":"user"},"recipient":{"id":"page"},"timestamp":1458692752478,` + event + `}]}]}`
+	w.Handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body)))
+}
+
+func say(w *messengerbot.Webhook, text string) {
+	post(w, fmt.Sprintf(`"message":{"mid":"mid.1","seq":1,"text":%q}`, text))
+}
+
+func TestBot(t *testing.T) {
+	w, s := newTestWebhook(t)
+	var unmatched []string
+	w.MessageHandler(func(pageId string, sender messengerbot.Sender, r messengerbot.Recipient, ts time.Time,
+		m messengerbot.IncomingTextMessage) bool {
+		unmatched = append(unmatched, m.Text)
+		return true
+	})
+	if _, err := LoadBot(w, "testdata/shop.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	say(w, "hi")
+	if got := s.texts(); !reflect.DeepEqual(got, []string{"Welcome to VB Store!"}) {
+		t.Fatalf("first contact sent %q", got)
+	}
+	say(w, "what?")
+	post(w, `"message":{"mid":"mid.2","seq":2,"text":"Browse","quick_reply":{"payload":"BROWSE"}}`)
+	post(w, `"postback":{"payload":"BUY_RIFT"}`)
+	say(w, "ORDER 42")
+	want := []string{"<template>", "You bought a rift from VB Store.", "Order 42 is on its way."}
+	if got := s.texts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	if !reflect.DeepEqual(unmatched, []string{"what?"}) {
+		t.Errorf("passed on %q", unmatched)
+	}
+}
+
+func TestBotWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flow.json")
+	write := func(greeting string) {
+		src := `{"start": "a", "nodes": {"a": {"messages": [{"text": "` + greeting + `"}],
+			"transitions": [{"default": true, "to": "a"}]}}}`
+		if err := os.WriteFile(path, []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("hello")
+	w, s := newTestWebhook(t)
+	b, err := LoadBot(w, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Watch(5 * time.Millisecond)
+	defer b.Close()
+
+	os.WriteFile(path, []byte(`{"start": "a", "nodes": {}}`), 0600)
+	time.Sleep(50 * time.Millisecond)
+	say(w, "hi")
+	write("hello again")
+	time.Sleep(50 * time.Millisecond)
+	say(w, "hi")
+	if got := s.texts(); !reflect.DeepEqual(got, []string{"hello", "hello again"}) {
+		t.Errorf("sent %q", got)
+	}
+	// closed again by the deferred call
+	b.Close()
+}
@@ -0,0 +1,149 @@
+package flowgraph
+
+import (
+	"sort"
+
+	"github.com/vimukthi-git/messengerbot"
+	"github.com/vimukthi-git/messengerbot/dialog"
+	"github.com/vimukthi-git/messengerbot/flow"
+)
+
+// endId is the id of the node dialog flows complete at
+const endId = "(end)"
+
+// Dialog builds the graph of a dialog flow. States with a Transition function are marked dynamic, as
+// where they lead cannot be known
+func Dialog(f *dialog.Flow) *Graph {
+	g := &Graph{Name: f.Name, Start: []string{f.Start}}
+	target := func(name string) string {
+		if name == "" {
+			g.addNode(&Node{Id: endId, Label: "end", Kind: END_NODE, Exit: true})
+			return endId
+		}
+		return name
+	}
+	names := make([]string, 0, len(f.States))
+	for name := range f.States {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g.addNode(&Node{Id: name, Label: name, Kind: STATE_NODE, Dynamic: f.States[name].Transition != nil})
+	}
+	for _, name := range names {
+		s := f.States[name]
+		drawn := make(map[string]bool)
+		g.addPayloadEdges(name, []*messengerbot.Message{s.Prompt}, func(payload string) (string, bool) {
+			if s.Transition != nil {
+				return "", true
+			}
+			if to, ok := s.On[payload]; ok {
+				drawn[payload] = true
+				return target(to), true
+			}
+			if len(s.On) == 0 || s.Next != "" {
+				drawn["*"] = true
+				return target(s.Next), true
+			}
+			return "", false
+		})
+		if s.Transition != nil {
+			continue
+		}
+		values := make([]string, 0, len(s.On))
+		for value := range s.On {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		for _, value := range values {
+			if !drawn[value] {
+				g.addEdge(name, target(s.On[value]), value, TRANSITION_EDGE)
+			}
+		}
+		if drawn["*"] {
+			continue
+		}
+		if len(s.On) == 0 {
+			g.addEdge(name, target(s.Next), "", TRANSITION_EDGE)
+		} else if s.Next != "" {
+			g.addEdge(name, target(s.Next), "*", TRANSITION_EDGE)
+		}
+	}
+	return g
+}
+
+// Flow builds the graph of a declarative flow definition. Nodes without transitions, after which users
+// return to the start node, are exits
+func Flow(name string, d *flow.Definition) *Graph {
+	g := &Graph{Name: name, Start: []string{d.Start}}
+	for _, id := range d.NodeNames() {
+		g.addNode(&Node{Id: id, Label: id, Kind: STATE_NODE, Exit: len(d.Nodes[id].Transitions) == 0})
+	}
+	for _, id := range d.NodeNames() {
+		node := d.Nodes[id]
+		var messages []*messengerbot.Message
+		for _, spec := range node.Specs() {
+			messages = append(messages, spec.Message())
+		}
+		drawn := make(map[*flow.Transition]bool)
+		g.addPayloadEdges(id, messages, func(payload string) (string, bool) {
+			for _, t := range node.Transitions {
+				if t.Payload == payload {
+					drawn[t] = true
+					return t.To, true
+				}
+				if t.Default {
+					return t.To, true
+				}
+			}
+			return "", false
+		})
+		for _, t := range node.Transitions {
+			switch {
+			case drawn[t]:
+			case t.Payload != "":
+				g.addEdge(id, t.To, t.Payload, TRANSITION_EDGE)
+			case t.Text != "":
+				g.addEdge(id, t.To, "/"+t.Text+"/", TRANSITION_EDGE)
+			default:
+				g.addEdge(id, t.To, "*", TRANSITION_EDGE)
+			}
+		}
+	}
+	return g
+}
+
+// Router builds the graph of the routes of a router and the actions of a dispatcher, either of which
+// may be nil. Text messages and postbacks are the input nodes, routes, actions and callbacks the handlers
+func Router(name string, r *messengerbot.Router, d *messengerbot.Dispatcher) *Graph {
+	g := &Graph{Name: name, Start: []string{"message", "postback"}}
+	g.addNode(&Node{Id: "message", Label: "text message", Kind: INPUT_NODE})
+	g.addNode(&Node{Id: "postback", Label: "postback", Kind: INPUT_NODE})
+	handler := func(id, label string) string {
+		g.addNode(&Node{Id: id, Label: label, Kind: HANDLER_NODE, Exit: true})
+		return id
+	}
+	if d != nil {
+		actions := d.Actions()
+		sort.Strings(actions)
+		for _, action := range actions {
+			id := handler("action:"+action, "action "+action)
+			g.addEdge("postback", id, "", TRANSITION_EDGE)
+			g.addEdge("message", id, "quick reply", QUICK_REPLY_EDGE)
+		}
+	}
+	if r != nil {
+		for _, rt := range r.Routes() {
+			id := handler("route:"+rt.Kind()+":"+rt.Pattern(), rt.Kind()+" "+rt.Pattern())
+			g.addEdge("message", id, "", TRANSITION_EDGE)
+		}
+		if r.HasFallback() {
+			g.addEdge("message", handler("fallback", "router fallback"), "*", TRANSITION_EDGE)
+		}
+	}
+	if r == nil || !r.HasFallback() {
+		g.addEdge("message", handler("MessageHandler", "MessageHandler"), "*", TRANSITION_EDGE)
+	}
+	g.addEdge("postback", handler("PostbackHandler", "PostbackHandler"), "*", TRANSITION_EDGE)
+	return g
+}
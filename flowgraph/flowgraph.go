@@ -0,0 +1,396 @@
+// Package flowgraph draws the conversation flows defined with messengerbot as Graphviz DOT or Mermaid
+// diagrams, and lints them for transitions to undefined nodes, unreachable nodes, dead ends and payloads
+// nothing consumes.
+//
+// Graphs are built from dialog flows, declarative flow definitions, or a router with its dispatcher.
+// Nodes are states, edges are transitions; transitions taken by tapping a button or quick reply sent
+// with the node are drawn as button or quick reply edges labelled with its title.
+package flowgraph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+type NodeKind string
+
+const (
+	STATE_NODE NodeKind = "state"
+	// INPUT_NODE is where incoming events enter a router graph
+	INPUT_NODE NodeKind = "input"
+	// HANDLER_NODE is a route, action or callback of a router graph
+	HANDLER_NODE NodeKind = "handler"
+	// END_NODE is where a dialog flow completes
+	END_NODE NodeKind = "end"
+	// UNDEFINED_NODE stands for a node which a transition or the start leads to but which is not defined
+	UNDEFINED_NODE NodeKind = "undefined"
+)
+
+type EdgeKind string
+
+const (
+	TRANSITION_EDGE  EdgeKind = "transition"
+	BUTTON_EDGE      EdgeKind = "button"
+	QUICK_REPLY_EDGE EdgeKind = "quick_reply"
+)
+
+type Node struct {
+	Id    string
+	Label string
+	Kind  NodeKind
+	// Exit nodes end or restart the conversation
+	Exit bool
+	// Dynamic nodes have transitions decided by code, which cannot be drawn
+	Dynamic bool
+}
+
+type Edge struct {
+	From  string
+	To    string
+	Label string
+	Kind  EdgeKind
+}
+
+// PayloadUse is a button or quick reply payload sent with the messages of a node
+type PayloadUse struct {
+	Node    string
+	Title   string
+	Payload string
+	// Consumed is set when a transition of the node is taken on the payload
+	Consumed bool
+}
+
+// Graph is a conversation flow. Start holds the ids of the nodes conversations begin at
+type Graph struct {
+	Name     string
+	Start    []string
+	Nodes    []*Node
+	Edges    []*Edge
+	Payloads []*PayloadUse
+}
+
+func (g *Graph) node(id string) *Node {
+	for _, n := range g.Nodes {
+		if n.Id == id {
+			return n
+		}
+	}
+	return nil
+}
+
+func (g *Graph) addNode(n *Node) *Node {
+	if existing := g.node(n.Id); existing != nil {
+		return existing
+	}
+	g.Nodes = append(g.Nodes, n)
+	return n
+}
+
+func (g *Graph) addEdge(from, to, label string, kind EdgeKind) {
+	g.Edges = append(g.Edges, &Edge{from, to, label, kind})
+}
+
+// addPayloadEdges records the payloads sent with the messages of a node. consumes returns the target of
+// the transition a payload takes and whether there is one, and a button or quick reply edge is added for
+// each payload with a target
+func (g *Graph) addPayloadEdges(node string, messages []*messengerbot.Message, consumes func(payload string) (string, bool)) {
+	for _, m := range messages {
+		for _, p := range payloadsOf(m) {
+			use := &PayloadUse{Node: node, Title: p.title, Payload: p.payload}
+			if to, ok := consumes(p.payload); ok {
+				use.Consumed = true
+				// dynamic transitions consume payloads without a known target
+				if to != "" {
+					g.addEdge(node, to, p.title, p.kind)
+				}
+			}
+			g.Payloads = append(g.Payloads, use)
+		}
+	}
+}
+
+type payloadOf struct {
+	title   string
+	payload string
+	kind    EdgeKind
+}
+
+// payloadsOf returns the postback button and text quick reply payloads of a message
+func payloadsOf(m *messengerbot.Message) []payloadOf {
+	var payloads []payloadOf
+	if m == nil {
+		return nil
+	}
+	for _, qr := range m.QuickReplies {
+		if qr.Payload != "" {
+			payloads = append(payloads, payloadOf{qr.Title, qr.Payload, QUICK_REPLY_EDGE})
+		}
+	}
+	var buttons []messengerbot.Button
+	if m.Attachment != nil {
+		switch p := m.Attachment.Payload.(type) {
+		case messengerbot.ButtonTemplate:
+			buttons = p.Buttons
+		case messengerbot.GenericTemplate:
+			for _, e := range p.Elements {
+				buttons = append(buttons, e.Buttons...)
+			}
+		}
+	}
+	for _, b := range buttons {
+		if b.Type == messengerbot.POSTBACK {
+			payloads = append(payloads, payloadOf{b.Title, b.Payload, BUTTON_EDGE})
+		}
+	}
+	return payloads
+}
+
+// undefined returns the sorted ids edges and starts lead to which are not nodes of the graph
+func (g *Graph) undefined() []string {
+	seen := make(map[string]bool)
+	var ids []string
+	check := func(id string) {
+		if !seen[id] && g.node(id) == nil {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range g.Start {
+		check(id)
+	}
+	for _, e := range g.Edges {
+		check(e.To)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// reachable returns the ids of the nodes reachable from the start nodes
+func (g *Graph) reachable() map[string]bool {
+	seen := make(map[string]bool)
+	queue := append([]string{}, g.Start...)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		for _, e := range g.Edges {
+			if e.From == id {
+				queue = append(queue, e.To)
+			}
+		}
+	}
+	return seen
+}
+
+// exits returns the ids of the nodes from which an exit, a dynamic node or an undefined node, which is
+// reported on its own, can be reached
+func (g *Graph) exits() map[string]bool {
+	can := make(map[string]bool)
+	for _, n := range g.Nodes {
+		if n.Exit || n.Dynamic {
+			can[n.Id] = true
+		}
+	}
+	for _, id := range g.undefined() {
+		can[id] = true
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, e := range g.Edges {
+			if can[e.To] && !can[e.From] {
+				can[e.From] = true
+				changed = true
+			}
+		}
+	}
+	return can
+}
+
+type IssueKind string
+
+const (
+	UNREACHABLE_ISSUE        IssueKind = "unreachable"
+	DEAD_END_ISSUE           IssueKind = "dead end"
+	UNCONSUMED_PAYLOAD_ISSUE IssueKind = "unconsumed payload"
+	UNDEFINED_ISSUE          IssueKind = "undefined"
+)
+
+type Issue struct {
+	Kind    IssueKind
+	Node    string
+	Message string
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%s: %s: %s", i.Kind, i.Node, i.Message)
+}
+
+// Lint reports start nodes and transition targets which are not defined, nodes which cannot be reached
+// from a start node, state nodes from which the conversation can never end, and payloads sent with a node
+// which neither a transition of the node nor an action of the dispatcher consumes. d may be nil
+func (g *Graph) Lint(d *messengerbot.Dispatcher) []Issue {
+	var issues []Issue
+	reachable := g.reachable()
+	exits := g.exits()
+	for _, n := range g.Nodes {
+		if !reachable[n.Id] {
+			issues = append(issues, Issue{UNREACHABLE_ISSUE, n.Id, "no transition leads to " + n.Label})
+		} else if n.Kind == STATE_NODE && !exits[n.Id] {
+			issues = append(issues, Issue{DEAD_END_ISSUE, n.Id, "the conversation cannot end or restart after " + n.Label})
+		}
+	}
+	undefined := make(map[string]bool)
+	for _, id := range g.undefined() {
+		undefined[id] = true
+	}
+	for _, id := range g.Start {
+		if undefined[id] {
+			issues = append(issues, Issue{UNDEFINED_ISSUE, id, fmt.Sprintf("start node %q is not defined", id)})
+		}
+	}
+	reported := make(map[[2]string]bool)
+	for _, e := range g.Edges {
+		if undefined[e.To] && !reported[[2]string{e.From, e.To}] {
+			reported[[2]string{e.From, e.To}] = true
+			issues = append(issues, Issue{UNDEFINED_ISSUE, e.From, fmt.Sprintf("transition to undefined node %q", e.To)})
+		}
+	}
+	actions := make(map[string]bool)
+	if d != nil {
+		for _, action := range d.Actions() {
+			actions[action] = true
+		}
+	}
+	for _, p := range g.Payloads {
+		if p.Consumed {
+			continue
+		}
+		if action, _, err := messengerbot.DecodePayload(p.Payload); err == nil && actions[action] {
+			continue
+		}
+		issues = append(issues, Issue{UNCONSUMED_PAYLOAD_ISSUE, p.Node,
+			fmt.Sprintf("nothing handles payload %q of %q", p.Payload, p.Title)})
+	}
+	return issues
+}
+
+// sortedNodes returns the nodes sorted by id, with a placeholder node for each undefined id
+func (g *Graph) sortedNodes() []*Node {
+	nodes := append([]*Node{}, g.Nodes...)
+	for _, id := range g.undefined() {
+		nodes = append(nodes, &Node{Id: id, Label: id, Kind: UNDEFINED_NODE})
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].Id < nodes[j].Id })
+	return nodes
+}
+
+// DOT renders the graph in the Graphviz DOT language. Unreachable nodes are drawn dashed and red,
+// undefined nodes as red octagons, button edges bold and quick reply edges dotted
+func (g *Graph) DOT() string {
+	var b strings.Builder
+	reachable := g.reachable()
+	fmt.Fprintf(&b, "digraph %s {\n\trankdir=LR;\n", dotQuote(g.Name))
+	for _, n := range g.sortedNodes() {
+		attrs := []string{"label=" + dotQuote(n.Label)}
+		switch n.Kind {
+		case INPUT_NODE:
+			attrs = append(attrs, "shape=ellipse")
+		case END_NODE:
+			attrs = append(attrs, "shape=doublecircle")
+		case UNDEFINED_NODE:
+			attrs = append(attrs, "shape=octagon", "color=red")
+		default:
+			attrs = append(attrs, "shape=box")
+		}
+		if !reachable[n.Id] && n.Kind != UNDEFINED_NODE {
+			attrs = append(attrs, "style=dashed", "color=red")
+		}
+		fmt.Fprintf(&b, "\t%s [%s];\n", dotQuote(n.Id), strings.Join(attrs, ", "))
+	}
+	for _, e := range g.Edges {
+		var attrs []string
+		if e.Label != "" {
+			attrs = append(attrs, "label="+dotQuote(e.Label))
+		}
+		switch e.Kind {
+		case BUTTON_EDGE:
+			attrs = append(attrs, "style=bold")
+		case QUICK_REPLY_EDGE:
+			attrs = append(attrs, "style=dotted")
+		}
+		if len(attrs) == 0 {
+			fmt.Fprintf(&b, "\t%s -> %s;\n", dotQuote(e.From), dotQuote(e.To))
+		} else {
+			fmt.Fprintf(&b, "\t%s -> %s [%s];\n", dotQuote(e.From), dotQuote(e.To), strings.Join(attrs, ", "))
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Mermaid renders the graph as a Mermaid flowchart. Unreachable nodes get the class "unreachable", and
+// undefined nodes are hexagons of the class "undefined"
+func (g *Graph) Mermaid() string {
+	var b strings.Builder
+	reachable := g.reachable()
+	ids := make(map[string]string)
+	b.WriteString("flowchart LR\n")
+	for i, n := range g.sortedNodes() {
+		ids[n.Id] = fmt.Sprintf("n%d", i)
+		open, close := "[", "]"
+		switch n.Kind {
+		case INPUT_NODE:
+			open, close = "([", "])"
+		case END_NODE:
+			open, close = "((", "))"
+		case UNDEFINED_NODE:
+			open, close = "{{", "}}"
+		}
+		fmt.Fprintf(&b, "\t%s%s\"%s\"%s\n", ids[n.Id], open, mermaidEscape(n.Label), close)
+	}
+	for _, e := range g.Edges {
+		arrow := "-->"
+		switch e.Kind {
+		case BUTTON_EDGE:
+			arrow = "==>"
+		case QUICK_REPLY_EDGE:
+			arrow = "-.->"
+		}
+		if e.Label != "" {
+			fmt.Fprintf(&b, "\t%s %s|\"%s\"| %s\n", ids[e.From], arrow, mermaidEscape(e.Label), ids[e.To])
+		} else {
+			fmt.Fprintf(&b, "\t%s %s %s\n", ids[e.From], arrow, ids[e.To])
+		}
+	}
+	var unreachable, undefined []string
+	for _, n := range g.sortedNodes() {
+		if n.Kind == UNDEFINED_NODE {
+			undefined = append(undefined, ids[n.Id])
+		} else if !reachable[n.Id] {
+			unreachable = append(unreachable, ids[n.Id])
+		}
+	}
+	if len(unreachable) > 0 {
+		b.WriteString("\tclassDef unreachable stroke:#f00,stroke-dasharray:5 5\n")
+		fmt.Fprintf(&b, "\tclass %s unreachable\n", strings.Join(unreachable, ","))
+	}
+	if len(undefined) > 0 {
+		b.WriteString("\tclassDef undefined stroke:#f00,color:#f00\n")
+		fmt.Fprintf(&b, "\tclass %s undefined\n", strings.Join(undefined, ","))
+	}
+	return b.String()
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func mermaidEscape(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "\n", " ").Replace(s)
+}
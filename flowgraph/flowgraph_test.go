@@ -0,0 +1,179 @@
+package flowgraph
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/vimukthi-git/messengerbot"
+	"github.com/vimukthi-git/messengerbot/dialog"
+	"github.com/vimukthi-git/messengerbot/flow"
+)
+
+func issues(g *Graph, d *messengerbot.Dispatcher) []string {
+	var found []string
+	for _, i := range g.Lint(d) {
+		found = append(found, string(i.Kind)+" "+i.Node)
+	}
+	sort.Strings(found)
+	return found
+}
+
+func TestDialog(t *testing.T) {
+	w := messengerbot.NewMessengerWebhook("token", "token")
+	d := messengerbot.NewDispatcher(w)
+	d.Action("help", func(c *messengerbot.Conversation, action string, params map[string]string) bool { return true })
+	help, _ := messengerbot.NewActionButton("Help", "help", nil)
+	f := dialog.NewFlow("order", "size")
+	f.AddState(&dialog.State{
+		Name: "size",
+		Prompt: messengerbot.NewButtonMessage("Which size?", []messengerbot.Button{
+			{Type: messengerbot.POSTBACK, Title: "Small", Payload: "SMALL"},
+			{Type: messengerbot.POSTBACK, Title: "Large", Payload: "LARGE"},
+			{Type: messengerbot.POSTBACK, Title: "Gift", Payload: "GIFT"},
+			help,
+		}, nil),
+		On: map[string]string{"SMALL": "confirm", "LARGE": "confirm"},
+	})
+	f.AddState(&dialog.State{
+		Name:   "confirm",
+		Prompt: messengerbot.NewTextMessage("Sure?", nil),
+		On:     map[string]string{"yes": "", "no": "size"},
+	})
+	// orphan is never entered, and leads to loop and trap which never end the flow
+	f.AddState(&dialog.State{Name: "loop", Next: "trap"})
+	f.AddState(&dialog.State{Name: "trap", Next: "loop"})
+	f.AddState(&dialog.State{Name: "orphan", Next: "loop"})
+
+	g := Dialog(f)
+	want := []string{"unconsumed payload size", "unreachable loop", "unreachable orphan", "unreachable trap"}
+	if got := issues(g, d); !reflect.DeepEqual(got, want) {
+		t.Errorf("Lint = %q, want %q", got, want)
+	}
+	if got := issues(g, nil); len(got) != len(want)+1 {
+		t.Errorf("without the dispatcher the help payload is not consumed, Lint = %q", got)
+	}
+
+	dot := g.DOT()
+	for _, s := range []string{
+		`digraph "order" {`,
+		`"size" -> "confirm" [label="Small", style=bold];`,
+		`"confirm" -> "(end)" [label="yes"];`,
+		`"confirm" -> "size" [label="no"];`,
+		`"orphan" [label="orphan", shape=box, style=dashed, color=red];`,
+		`"(end)" [label="end", shape=doublecircle];`,
+	} {
+		if !strings.Contains(dot, s) {
+			t.Errorf("DOT has no %s\n%s", s, dot)
+		}
+	}
+	mermaid := g.Mermaid()
+	for _, s := range []string{"flowchart LR", `n0(("end"))`, `n1["confirm"]`, `n4 ==>|"Large"| n1`,
+		`n1 -->|"no"| n4`, "class n2,n3,n5 unreachable"} {
+		if !strings.Contains(mermaid, s) {
+			t.Errorf("Mermaid has no %s\n%s", s, mermaid)
+		}
+	}
+}
+
+func TestUndefined(t *testing.T) {
+	f := dialog.NewFlow("order", "size")
+	f.AddState(&dialog.State{Name: "size", Prompt: messengerbot.NewTextMessage("Which size?", nil),
+		On: map[string]string{"small": "confirm", "large": "cofnirm"}, Next: "cofnirm"})
+	f.AddState(&dialog.State{Name: "confirm", Next: ""})
+
+	g := Dialog(f)
+	want := []string{"undefined size"}
+	if got := issues(g, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("Lint = %q, want %q", got, want)
+	}
+	if dot := g.DOT(); !strings.Contains(dot, `"cofnirm" [label="cofnirm", shape=octagon, color=red];`) {
+		t.Errorf("DOT has no placeholder\n%s", dot)
+	}
+	mermaid := g.Mermaid()
+	for _, s := range []string{`n1{{"cofnirm"}}`, `n3 -->|"large"| n1`, "class n1 undefined"} {
+		if !strings.Contains(mermaid, s) {
+			t.Errorf("Mermaid has no %s\n%s", s, mermaid)
+		}
+	}
+
+	g = Dialog(dialog.NewFlow("empty", "start"))
+	if got := issues(g, nil); !reflect.DeepEqual(got, []string{"undefined start"}) {
+		t.Errorf("Lint = %q", got)
+	}
+	if mermaid := g.Mermaid(); !strings.Contains(mermaid, `n0{{"start"}}`) {
+		t.Errorf("Mermaid has no placeholder\n%s", mermaid)
+	}
+}
+
+func TestFlow(t *testing.T) {
+	def, err := flow.Load("../flow/testdata/shop.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := Flow("shop", def)
+	if got := issues(g, nil); len(got) != 0 {
+		t.Errorf("Lint = %q", got)
+	}
+	if len(g.Payloads) == 0 {
+		t.Error("no payloads found in the shop flow")
+	}
+	for _, e := range g.Edges {
+		if g.node(e.From) == nil || g.node(e.To) == nil {
+			t.Errorf("edge %s -> %s has no node", e.From, e.To)
+		}
+	}
+
+	def, err = flow.Parse("test.json", []byte(`{"start": "a", "nodes": {
+		"a": {"messages": [{"text": "hi", "quick_replies": [{"title": "Go", "payload": "GO"}]}],
+			"transitions": [{"text": "^b", "to": "b"}, {"text": "^c", "to": "c"}]},
+		"b": {"messages": [{"text": "bye"}]},
+		"c": {"messages": [{"text": "lost"}], "transitions": [{"default": true, "to": "c"}]},
+		"d": {"messages": [{"text": "never"}], "transitions": [{"default": true, "to": "b"}]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g = Flow("test", def)
+	want := []string{"dead end c", "unconsumed payload a", "unreachable d"}
+	if got := issues(g, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("Lint = %q, want %q", got, want)
+	}
+	if dot := g.DOT(); !strings.Contains(dot, `"a" -> "b" [label="/^b/"];`) {
+		t.Errorf("DOT has no text transition\n%s", dot)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	w := messengerbot.NewMessengerWebhook("token", "token")
+	r := messengerbot.NewRouter(w)
+	cb := func(c *messengerbot.Conversation, m messengerbot.IncomingTextMessage, params map[string]string) bool {
+		return true
+	}
+	r.Exact("hi", cb)
+	r.Keyword("help", cb)
+	d := messengerbot.NewDispatcher(w)
+	d.Action("buy", func(c *messengerbot.Conversation, action string, params map[string]string) bool { return true })
+
+	g := Router("bot", r, d)
+	if got := issues(g, d); len(got) != 0 {
+		t.Errorf("Lint = %q", got)
+	}
+	dot := g.DOT()
+	for _, s := range []string{
+		`"message" -> "route:exact:hi";`,
+		`"message" -> "route:keyword:help";`,
+		`"postback" -> "action:buy";`,
+		`"message" -> "action:buy" [label="quick reply", style=dotted];`,
+		`"message" -> "MessageHandler" [label="*"];`,
+	} {
+		if !strings.Contains(dot, s) {
+			t.Errorf("DOT has no %s\n%s", s, dot)
+		}
+	}
+
+	r.Fallback(cb)
+	if dot := Router("bot", r, nil).DOT(); strings.Contains(dot, "MessageHandler") || !strings.Contains(dot, `"fallback"`) {
+		t.Errorf("with a fallback the message handler is never reached\n%s", dot)
+	}
+}
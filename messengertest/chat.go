@@ -0,0 +1,264 @@
+package messengertest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+// Chat is a conversation between a test user and a bot, driven step by step:
+//
+//	c := messengertest.Test(t, w)
+//	c.UserSays("hi")
+//	c.ExpectText("Hello!")
+//	c.ExpectQuickReplies("Yes", "No")
+//	c.TapButton("Call Postback")
+//
+// Expect methods take the bot's messages in the order they were sent, skipping sender actions, and fail the
+// test with the transcript of the chat when the next message is not as expected. They first wait for the
+// webhook to be done with the user's messages, so asynchronous handling, pacing and the outbox work too
+type Chat struct {
+	t      testing.TB
+	w      *messengerbot.Webhook
+	Server *Server
+	Client *Client
+	// Psid is the id of the test user
+	Psid string
+	// read is the number of send calls already added to the transcript
+	read       int
+	received   []*Envelope
+	pending    []*Envelope
+	last       *Envelope
+	transcript []string
+}
+
+// Test starts a fake Graph API for the webhook and returns a chat between the user "user" and the page
+// "page". The server is closed when the test ends
+func Test(t testing.TB, w *messengerbot.Webhook) *Chat {
+	s := NewServer()
+	t.Cleanup(s.Close)
+	s.Attach(w)
+	c := new(Chat)
+	c.t = t
+	c.w = w
+	c.Server = s
+	c.Client = NewClient(w, "page")
+	c.Psid = "user"
+	return c
+}
+
+// sync waits for the webhook to be idle, then adds the messages the bot sent since the last call to the
+// transcript
+func (c *Chat) sync() {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	if err := c.w.Flush(ctx); err != nil {
+		c.t.Logf("webhook still busy after %v", flushTimeout)
+	}
+	calls := c.Server.CallsOf(SEND_CALL)
+	for _, call := range calls[c.read:] {
+		e, err := call.Envelope()
+		if err != nil || e.Message == nil || e.Recipient.Id != c.Psid {
+			continue
+		}
+		c.received = append(c.received, e)
+		c.pending = append(c.pending, e)
+		c.transcript = append(c.transcript, "bot:  "+describe(e.Message))
+	}
+	c.read = len(calls)
+}
+
+func (c *Chat) user(line string) {
+	c.sync()
+	c.transcript = append(c.transcript, "user: "+line)
+}
+
+// Transcript returns the chat so far, one message per line
+func (c *Chat) Transcript() string {
+	c.sync()
+	return strings.Join(c.transcript, "\n")
+}
+
+func (c *Chat) fail(step, want, got string) {
+	c.t.Helper()
+	c.t.Fatalf("%s\n  want: %s\n  got:  %s\ntranscript:\n  %s", step, want, got,
+		strings.Replace(c.Transcript(), "\n", "\n  ", -1))
+}
+
+// UserSays sends a text message from the user
+func (c *Chat) UserSays(text string) {
+	c.user(text)
+	c.Client.Text(c.Psid, text)
+}
+
+// UserSendsAttachment sends an attachment of the given type, e.g. "image", from the user
+func (c *Chat) UserSendsAttachment(attachmentType, url string) {
+	c.user(fmt.Sprintf("<%s %s>", attachmentType, url))
+	c.Client.Attachment(c.Psid, attachmentType, url)
+}
+
+// UserSendsLocation sends a location from the user
+func (c *Chat) UserSendsLocation(lat, long float64) {
+	c.user(fmt.Sprintf("<location %v,%v>", lat, long))
+	c.Client.Location(c.Psid, lat, long)
+}
+
+// TapButton sends the postback of the postback button with the given title in the latest message which
+// has one
+func (c *Chat) TapButton(title string) {
+	c.t.Helper()
+	c.sync()
+	for i := len(c.received) - 1; i >= 0; i-- {
+		for _, b := range c.received[i].Message.Buttons() {
+			if b.Title != title {
+				continue
+			}
+			if b.Type != messengerbot.POSTBACK {
+				c.fail(fmt.Sprintf("TapButton(%q)", title), "a postback button", fmt.Sprintf("a %s button", b.Type))
+			}
+			c.user("[" + title + "]")
+			c.Client.Postback(c.Psid, title, b.Payload)
+			return
+		}
+	}
+	c.fail(fmt.Sprintf("TapButton(%q)", title), "a message with the button", "none")
+}
+
+// TapQuickReply taps the quick reply with the given title. Like in Messenger, only the quick replies of
+// the latest message can be tapped
+func (c *Chat) TapQuickReply(title string) {
+	c.t.Helper()
+	c.sync()
+	step := fmt.Sprintf("TapQuickReply(%q)", title)
+	if len(c.received) == 0 {
+		c.fail(step, "a message with quick replies", "no messages")
+	}
+	latest := c.received[len(c.received)-1]
+	for _, qr := range latest.Message.QuickReplies {
+		if qr.Title == title {
+			c.user("(" + title + ")")
+			c.Client.QuickReply(c.Psid, title, qr.Payload)
+			return
+		}
+	}
+	c.fail(step, "the latest message to have the quick reply", describe(latest.Message))
+}
+
+// next takes the next message of the bot
+func (c *Chat) next(step, want string) *Envelope {
+	c.t.Helper()
+	c.sync()
+	if len(c.pending) == 0 {
+		c.fail(step, want, "no more messages")
+	}
+	c.last = c.pending[0]
+	c.pending = c.pending[1:]
+	return c.last
+}
+
+// ExpectText expects the next message to be a text message, or button template, with the given text
+func (c *Chat) ExpectText(text string) {
+	c.t.Helper()
+	step := fmt.Sprintf("ExpectText(%q)", text)
+	e := c.next(step, fmt.Sprintf("%q", text))
+	if got := e.Message.DisplayText(); got != text || (e.Message.Attachment != nil &&
+		e.Message.TemplateType() != messengerbot.BUTTON) {
+		c.fail(step, fmt.Sprintf("%q", text), describe(e.Message))
+	}
+}
+
+// ExpectMessage expects the next message to satisfy match, and returns it
+func (c *Chat) ExpectMessage(description string, match func(m *Message) bool) *Message {
+	c.t.Helper()
+	step := fmt.Sprintf("ExpectMessage(%q)", description)
+	e := c.next(step, description)
+	if !match(e.Message) {
+		c.fail(step, description, describe(e.Message))
+	}
+	return e.Message
+}
+
+// ExpectQuickReplies expects the message taken by the previous Expect to have quick replies with the given
+// titles, in order
+func (c *Chat) ExpectQuickReplies(titles ...string) {
+	c.t.Helper()
+	step := fmt.Sprintf("ExpectQuickReplies(%q)", titles)
+	if c.last == nil {
+		c.fail(step, "an expected message", "none")
+	}
+	var got []string
+	for _, qr := range c.last.Message.QuickReplies {
+		got = append(got, qr.Title)
+	}
+	if !equal(got, titles) {
+		c.fail(step, fmt.Sprintf("quick replies %q", titles), describe(c.last.Message))
+	}
+}
+
+// ExpectButtons expects the message taken by the previous Expect to have buttons with the given titles, in
+// order
+func (c *Chat) ExpectButtons(titles ...string) {
+	c.t.Helper()
+	step := fmt.Sprintf("ExpectButtons(%q)", titles)
+	if c.last == nil {
+		c.fail(step, "an expected message", "none")
+	}
+	var got []string
+	for _, b := range c.last.Message.Buttons() {
+		got = append(got, b.Title)
+	}
+	if !equal(got, titles) {
+		c.fail(step, fmt.Sprintf("buttons %q", titles), describe(c.last.Message))
+	}
+}
+
+// ExpectNoMoreMessages expects every message the bot sent to have been taken by an Expect
+func (c *Chat) ExpectNoMoreMessages() {
+	c.t.Helper()
+	c.sync()
+	if len(c.pending) > 0 {
+		c.fail("ExpectNoMoreMessages()", "no more messages", describe(c.pending[0].Message))
+	}
+}
+
+// flushTimeout bounds how long Chat and Simulator wait for the webhook to send its replies
+const flushTimeout = 10 * time.Second
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// describe renders a message on one line, e.g. `"Pick one" [Start] (Yes) (No)` for a button template
+// with a button and two quick replies
+func describe(m *Message) string {
+	var s string
+	switch t := m.TemplateType(); {
+	case m.Attachment == nil:
+		s = fmt.Sprintf("%q", m.Text)
+	case t == messengerbot.BUTTON:
+		s = fmt.Sprintf("%q", m.DisplayText())
+	case t != "":
+		s = fmt.Sprintf("<%s template %s>", t, m.DisplayText())
+	default:
+		s = fmt.Sprintf("<%s %s>", m.Attachment.Type, m.DisplayText())
+	}
+	for _, b := range m.Buttons() {
+		s += " [" + b.Title + "]"
+	}
+	for _, qr := range m.QuickReplies {
+		s += " (" + qr.Title + ")"
+	}
+	return s
+}
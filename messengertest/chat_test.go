@@ -0,0 +1,178 @@
+package messengertest
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+func newDemoWebhook() *messengerbot.Webhook {
+	w := messengerbot.NewMessengerWebhook("verify", "token")
+	w.ConversationMessageHandler(func(c *messengerbot.Conversation, m messengerbot.IncomingTextMessage) bool {
+		switch {
+		case m.QuickReply != nil:
+			c.ReplyText("You said " + m.QuickReply.Payload)
+		case m.Text == "button":
+			c.Reply(messengerbot.NewButtonMessage("VB Super", []messengerbot.Button{
+				{Type: messengerbot.WEB_URL, Title: "Open Web URL", Url: "https://www.oculus.com/en-us/rift/"},
+				{Type: messengerbot.POSTBACK, Title: "Call Postback", Payload: "Payload for first bubble"},
+			}, nil))
+		default:
+			c.Typing(true)
+			c.ReplyWithQuickReplies("Hello!", []messengerbot.QuickReply{
+				{ContentType: messengerbot.TEXT, Title: "Yes", Payload: "YES"},
+				{ContentType: messengerbot.TEXT, Title: "No", Payload: "NO"},
+			})
+		}
+		return true
+	})
+	w.ConversationPostbackHandler(func(c *messengerbot.Conversation, p messengerbot.EventPostback) bool {
+		c.ReplyText("Postback: " + p.Payload)
+		return true
+	})
+	return w
+}
+
+func TestChat(t *testing.T) {
+	w := newDemoWebhook()
+	var timestamps []time.Time
+	w.Use(func(next messengerbot.EventHandler) messengerbot.EventHandler {
+		return func(e *messengerbot.Event) bool {
+			timestamps = append(timestamps, e.Timestamp)
+			return next(e)
+		}
+	})
+	c := Test(t, w)
+	at := time.Date(2016, 3, 23, 0, 25, 52, 478e6, time.UTC)
+	c.Client.Now = func() time.Time { return at }
+
+	c.UserSays("hi")
+	c.ExpectText("Hello!")
+	c.ExpectQuickReplies("Yes", "No")
+	c.TapQuickReply("No")
+	c.ExpectText("You said NO")
+	c.UserSays("button")
+	c.ExpectText("VB Super")
+	c.ExpectButtons("Open Web URL", "Call Postback")
+	c.TapButton("Call Postback")
+	c.ExpectText("Postback: Payload for first bubble")
+	c.ExpectNoMoreMessages()
+
+	want := `user: hi
+bot:  "Hello!" (Yes) (No)
+user: (No)
+bot:  "You said NO"
+user: button
+bot:  "VB Super" [Open Web URL] [Call Postback]
+user: [Call Postback]
+bot:  "Postback: Payload for first bubble"`
+	if got := c.Transcript(); got != want {
+		t.Errorf("transcript\n%s\nwant\n%s", got, want)
+	}
+	for _, ts := range timestamps {
+		if !ts.Equal(at) {
+			t.Errorf("event timestamp %v, want %v", ts, at)
+		}
+	}
+}
+
+func TestChatAsync(t *testing.T) {
+	w := newDemoWebhook()
+	w.ProcessAsync(2, 10, messengerbot.BLOCK_WHEN_FULL)
+	w.UsePacing(messengerbot.Pacing{MinDelay: 10 * time.Millisecond})
+	c := Test(t, w)
+
+	c.UserSays("button")
+	c.ExpectText("VB Super")
+	c.TapButton("Call Postback")
+	c.ExpectText("Postback: Payload for first bubble")
+	c.ExpectNoMoreMessages()
+}
+
+// recordingT records the failure of a chat step, ending the goroutine running the steps like testing.T
+type recordingT struct {
+	testing.TB
+	failure string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Fatalf(format string, args ...interface{}) {
+	t.failure = fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
+
+func failure(t *testing.T, steps func(c *Chat)) string {
+	rt := &recordingT{TB: t}
+	c := Test(t, newDemoWebhook())
+	c.t = rt
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		steps(c)
+	}()
+	<-done
+	return rt.failure
+}
+
+func TestChatFailures(t *testing.T) {
+	cases := []struct {
+		steps func(c *Chat)
+		want  string
+	}{
+		{func(c *Chat) {
+			c.UserSays("hi")
+			c.ExpectText("Bye")
+		}, `ExpectText("Bye")
+  want: "Bye"
+  got:  "Hello!" (Yes) (No)
+transcript:
+  user: hi
+  bot:  "Hello!" (Yes) (No)`},
+		{func(c *Chat) {
+			c.UserSays("hi")
+			c.ExpectText("Hello!")
+			c.ExpectQuickReplies("Yes", "Maybe")
+		}, `ExpectQuickReplies(["Yes" "Maybe"])
+  want: quick replies ["Yes" "Maybe"]
+  got:  "Hello!" (Yes) (No)`},
+		{func(c *Chat) {
+			c.UserSays("hi")
+			c.ExpectText("Hello!")
+			c.ExpectText("Hello again!")
+		}, `ExpectText("Hello again!")
+  want: "Hello again!"
+  got:  no more messages`},
+		{func(c *Chat) {
+			c.UserSays("button")
+			c.TapButton("Open Web URL")
+		}, `TapButton("Open Web URL")
+  want: a postback button
+  got:  a web_url button`},
+		{func(c *Chat) {
+			c.UserSays("hi")
+			c.UserSays("button")
+			c.TapQuickReply("Yes")
+		}, `TapQuickReply("Yes")
+  want: the latest message to have the quick reply
+  got:  "VB Super" [Open Web URL] [Call Postback]`},
+		{func(c *Chat) {
+			c.UserSays("hi")
+			c.ExpectNoMoreMessages()
+		}, `ExpectNoMoreMessages()
+  want: no more messages
+  got:  "Hello!" (Yes) (No)`},
+	}
+	for _, tc := range cases {
+		if got := failure(t, tc.steps); !strings.HasPrefix(got, tc.want) {
+			t.Errorf("failure\n%s\nwant\n%s", got, tc.want)
+		}
+	}
+	if got := failure(t, func(c *Chat) { c.UserSays("hi"); c.ExpectText("Hello!") }); got != "" {
+		t.Errorf("passing steps failed with %s", got)
+	}
+}
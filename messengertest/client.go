@@ -0,0 +1,143 @@
+package messengertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+// Client injects webhook events sent to a page into Webhook.Handler, the way Messenger delivers them. Each
+// message gets a unique mid, the next seq of its sender and the current time as timestamp
+type Client struct {
+	w      *messengerbot.Webhook
+	PageId string
+	// Now is the time events are sent at, time.Now when nil
+	Now func() time.Time
+	mu  sync.Mutex
+	seq map[string]int
+}
+
+// NewClient creates a client sending events to the given page of the webhook
+func NewClient(w *messengerbot.Webhook, pageId string) *Client {
+	c := new(Client)
+	c.w = w
+	c.PageId = pageId
+	c.seq = make(map[string]int)
+	return c
+}
+
+func (c *Client) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+// Post sends a raw webhook request body to the handler
+func (c *Client) Post(body []byte) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	c.w.Handler(res, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(string(body))))
+	return res
+}
+
+// Event sends a messaging event from the PSID to the page. fields are the event specific fields, e.g.
+// {"postback": {"payload": "START"}}, which are merged with the sender, recipient and timestamp
+func (c *Client) Event(psid string, fields map[string]interface{}) *httptest.ResponseRecorder {
+	ts := c.now().UnixNano() / int64(time.Millisecond)
+	event := map[string]interface{}{
+		"sender":    map[string]string{"id": psid},
+		"recipient": map[string]string{"id": c.PageId},
+		"timestamp": ts,
+	}
+	for k, v := range fields {
+		event[k] = v
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"object": "page",
+		"entry": []interface{}{map[string]interface{}{
+			"id":        c.PageId,
+			"time":      ts,
+			"messaging": []interface{}{event},
+		}},
+	})
+	return c.Post(body)
+}
+
+// Verify sends the subscription verification request and returns the response
+func (c *Client) Verify(token, challenge string) *httptest.ResponseRecorder {
+	query := url.Values{"hub.mode": {"subscribe"}, "hub.verify_token": {token}, "hub.challenge": {challenge}}
+	res := httptest.NewRecorder()
+	c.w.Handler(res, httptest.NewRequest(http.MethodGet, "/webhook?"+query.Encode(), nil))
+	return res
+}
+
+// message sends a message event with a new mid and seq, returning the mid
+func (c *Client) message(psid string, fields map[string]interface{}) string {
+	c.mu.Lock()
+	c.seq[psid]++
+	seq := c.seq[psid]
+	c.mu.Unlock()
+	now := c.now()
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s:%s:%d", c.PageId, psid, seq)
+	mid := fmt.Sprintf("mid.%d:%016x", now.UnixNano()/int64(time.Millisecond), h.Sum64())
+	fields["mid"] = mid
+	fields["seq"] = seq
+	c.Event(psid, map[string]interface{}{"message": fields})
+	return mid
+}
+
+// Text sends a text message and returns its mid
+func (c *Client) Text(psid, text string) string {
+	return c.message(psid, map[string]interface{}{"text": text})
+}
+
+// QuickReply sends the tap of a quick reply and returns its mid
+func (c *Client) QuickReply(psid, title, payload string) string {
+	return c.message(psid, map[string]interface{}{"text": title,
+		"quick_reply": map[string]string{"payload": payload}})
+}
+
+// Attachment sends an attachment of the given type, e.g. "image", and returns its mid
+func (c *Client) Attachment(psid, attachmentType, url string) string {
+	return c.message(psid, map[string]interface{}{"attachments": []interface{}{map[string]interface{}{
+		"type": attachmentType, "payload": map[string]string{"url": url}}}})
+}
+
+// Location sends a location and returns its mid
+func (c *Client) Location(psid string, lat, long float64) string {
+	return c.message(psid, map[string]interface{}{"attachments": []interface{}{map[string]interface{}{
+		"type": "location", "title": "Pinned Location",
+		"payload": map[string]interface{}{"coordinates": messengerbot.Coordinates{Lat: lat, Long: long}}}}})
+}
+
+// Postback sends the tap of a postback button
+func (c *Client) Postback(psid, title, payload string) {
+	c.Event(psid, map[string]interface{}{"postback": map[string]string{"title": title, "payload": payload}})
+}
+
+// Delivery sends the delivery of the given mids of messages sent by the page, with the current time as
+// watermark
+func (c *Client) Delivery(psid string, mids ...string) {
+	if mids == nil {
+		mids = []string{}
+	}
+	c.mu.Lock()
+	seq := c.seq[psid]
+	c.mu.Unlock()
+	c.Event(psid, map[string]interface{}{"delivery": map[string]interface{}{
+		"mids": mids, "watermark": c.now().UnixNano() / int64(time.Millisecond), "seq": seq}})
+}
+
+// Optin sends an authentication event with the data-ref of the plugin
+func (c *Client) Optin(psid, ref string) {
+	c.Event(psid, map[string]interface{}{"optin": map[string]string{"ref": ref}})
+}
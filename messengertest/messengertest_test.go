@@ -0,0 +1,214 @@
+package messengertest
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+func texts(envelopes []*Envelope) []string {
+	var texts []string
+	for _, e := range envelopes {
+		if e.Message != nil {
+			texts = append(texts, e.Message.DisplayText())
+		} else {
+			texts = append(texts, string(e.SenderAction))
+		}
+	}
+	return texts
+}
+
+func TestConversation(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetProfile("user", &messengerbot.UserProfile{FirstName: "Ann", LastName: "Lee"})
+	w := messengerbot.NewMessengerWebhook("verify", "token")
+	w.AddPageAccessToken("page", "page-token")
+	s.Attach(w)
+	w.Use(messengerbot.ProfileMiddleware(time.Minute))
+
+	var locations []messengerbot.Coordinates
+	w.ConversationMessageHandler(func(c *messengerbot.Conversation, m messengerbot.IncomingTextMessage) bool {
+		switch {
+		case m.QuickReply != nil:
+			c.ReplyText("You picked " + m.QuickReply.Payload)
+		case m.Text == "menu":
+			c.Reply(messengerbot.NewButtonMessage("Menu", []messengerbot.Button{
+				{Type: messengerbot.POSTBACK, Title: "Start", Payload: "START"},
+			}, []messengerbot.QuickReply{{ContentType: messengerbot.TEXT, Title: "Red", Payload: "RED"}}))
+		default:
+			c.Typing(true)
+			if c.Profile != nil {
+				c.ReplyText("Hi " + c.Profile.FirstName)
+			} else {
+				c.ReplyText("Hi stranger")
+			}
+		}
+		return true
+	})
+	w.ConversationPostbackHandler(func(c *messengerbot.Conversation, p messengerbot.EventPostback) bool {
+		c.ReplyText("Started " + p.Payload)
+		return true
+	})
+	w.ConversationAttachmentHandler(func(c *messengerbot.Conversation, a messengerbot.IncomingAttachmentMessage) bool {
+		if a.Coordinates != nil {
+			locations = append(locations, *a.Coordinates)
+		}
+		return true
+	})
+
+	client := NewClient(w, "page")
+	if res := client.Verify("verify", "challenge"); res.Body.String() != "challenge" {
+		t.Errorf("verification answered %q", res.Body.String())
+	}
+	client.Text("user", "hello")
+	client.Text("other", "hello")
+	client.Text("user", "menu")
+	client.QuickReply("user", "Red", "RED")
+	client.Postback("user", "Start", "START")
+	client.Location("user", 6.9, 79.8)
+
+	want := []string{"typing_on", "Hi Ann", "typing_on", "Hi stranger", "Menu", "You picked RED", "Started START"}
+	if got := texts(s.Sent()); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	menu := s.Sent()[4]
+	if menu.Recipient.Id != "user" || menu.MessagingType != messengerbot.RESPONSE ||
+		menu.Message.TemplateType() != messengerbot.BUTTON || menu.Message.Buttons()[0].Payload != "START" ||
+		menu.Message.QuickReplies[0].Payload != "RED" {
+		t.Errorf("menu sent as %+v", menu.Message)
+	}
+	for _, c := range s.Calls() {
+		if c.AccessToken != "page-token" {
+			t.Errorf("%s %s used token %q", c.Method, c.Path, c.AccessToken)
+		}
+	}
+	if calls := s.CallsOf(PROFILE_CALL); len(calls) != 2 || calls[1].Status != http.StatusBadRequest {
+		t.Errorf("profile calls %+v", calls)
+	}
+	if !reflect.DeepEqual(locations, []messengerbot.Coordinates{{Lat: 6.9, Long: 79.8}}) {
+		t.Errorf("locations %v", locations)
+	}
+
+	s.Reset()
+	s.Fail(SEND_CALL, http.StatusForbidden, 10, "(#10) This message is sent outside of allowed window.")
+	client.Postback("user", "Start", "AGAIN")
+	if calls := s.Calls(); len(calls) != 1 || calls[0].Status != http.StatusForbidden {
+		t.Errorf("calls after failing sends %+v", calls)
+	}
+	s.Respond(SEND_CALL, nil)
+	client.Postback("user", "Start", "AGAIN")
+	if calls := s.Calls(); len(calls) != 2 || calls[1].Status != http.StatusOK {
+		t.Errorf("calls after restoring sends %+v", calls)
+	}
+}
+
+func TestClient(t *testing.T) {
+	w := messengerbot.NewMessengerWebhook("verify", "token")
+	var events []*messengerbot.Event
+	w.Use(func(next messengerbot.EventHandler) messengerbot.EventHandler {
+		return func(e *messengerbot.Event) bool {
+			events = append(events, e)
+			return true
+		}
+	})
+	client := NewClient(w, "page")
+	at := time.Date(2016, 3, 23, 0, 25, 52, 478e6, time.UTC)
+	client.Now = func() time.Time { return at }
+
+	first := client.Text("user", "one")
+	second := client.QuickReply("user", "Two", "TWO")
+	client.Text("other", "three")
+	client.Delivery("user", first, second)
+	client.Optin("user", "REF")
+	if first == second || !strings.HasPrefix(first, "mid.1458692752478:") {
+		t.Errorf("mids %q and %q", first, second)
+	}
+	var seqs []float64
+	for _, e := range events[:3] {
+		seqs = append(seqs, e.Message.Seq)
+	}
+	if !reflect.DeepEqual(seqs, []float64{1, 2, 1}) {
+		t.Errorf("seqs %v", seqs)
+	}
+	if events[1].Message.QuickReply.Payload != "TWO" || events[1].Message.Mid != second {
+		t.Errorf("quick reply %+v", events[1].Message)
+	}
+	if len(events) != 5 || !reflect.DeepEqual(events[3].Delivery.Mids, []string{first, second}) ||
+		events[4].Optin.Ref != "REF" {
+		t.Errorf("events %+v", events)
+	}
+
+	res := client.Post([]byte(`{"object":"page","entry":[]}`))
+	if res.Code != http.StatusOK {
+		t.Errorf("empty entry answered %d", res.Code)
+	}
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	res, err := http.Post(s.URL+"/me/pass_thread_control?access_token=token", "application/json",
+		bytes.NewReader([]byte(`{"recipient":{"id":"user"},"target_app_id":123}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if calls := s.CallsOf(HANDOVER_CALL); len(calls) != 1 || calls[0].Status != http.StatusOK ||
+		!bytes.Contains(calls[0].Body, []byte("target_app_id")) {
+		t.Errorf("handover calls %+v", calls)
+	}
+	res, _ = http.Post(s.URL+"/me/messages", "application/json", bytes.NewReader([]byte(`{}`)))
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("send without recipient answered %d", res.StatusCode)
+	}
+}
+
+func TestServerBatch(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	w := messengerbot.NewMessengerWebhook("token", "token")
+	s.Attach(w)
+	s.SetProfile("ann", &messengerbot.UserProfile{FirstName: "Ann"})
+
+	buttons := []messengerbot.Button{{Type: messengerbot.POSTBACK, Title: "Yes", Payload: "YES"}}
+	envelopes := []messengerbot.MessageEnvelope{
+		{Recipient: messengerbot.Recipient{Id: "ann"}, Message: messengerbot.NewTextMessage("Hi & bye", nil)},
+		{Recipient: messengerbot.Recipient{Id: "bob"}, Message: messengerbot.NewButtonMessage("Coming?", buttons, nil)},
+	}
+	responses, errs := w.SendMessages(context.Background(), "page", envelopes)
+	if errs[0] != nil || errs[1] != nil || responses[1].MessageId != "mid.$fake2" {
+		t.Errorf("sent %+v, %v", responses, errs)
+	}
+	sent := s.Sent()
+	if got := texts(sent); !reflect.DeepEqual(got, []string{"Hi & bye", "Coming?"}) || sent[1].Recipient.Id != "bob" ||
+		!reflect.DeepEqual(sent[1].Message.Buttons(), buttons) {
+		t.Errorf("sent %q", got)
+	}
+	if calls := s.CallsOf(SEND_CALL); calls[0].Batch != 1 || calls[1].Batch != 1 {
+		t.Errorf("send calls %+v", calls)
+	}
+
+	profiles, errs := w.GetUserProfiles(context.Background(), "page", []string{"ann", "bob"})
+	if errs[0] != nil || profiles[0].FirstName != "Ann" || errs[1] == nil {
+		t.Errorf("profiles %+v, %v", profiles, errs)
+	}
+	calls := s.CallsOf(PROFILE_CALL)
+	if len(calls) != 2 || calls[0].Path != "/ann" || calls[0].AccessToken != "token" || calls[0].Query.Get("fields") == "" ||
+		calls[1].Status != http.StatusBadRequest || calls[1].Batch != 2 {
+		t.Errorf("profile calls %+v", calls)
+	}
+
+	s.Fail(SEND_CALL, http.StatusForbidden, 10, "(#10) This message is sent outside of allowed window.")
+	_, errs = w.SendMessages(context.Background(), "page", envelopes)
+	if serr, ok := errs[1].(*messengerbot.SendError); !ok || serr.Code != 10 || serr.Status != http.StatusForbidden {
+		t.Errorf("failed send answered %v", errs[1])
+	}
+}
@@ -0,0 +1,378 @@
+// Package messengertest runs messengerbot webhooks offline. Server is a fake Graph API which records every
+// Send API, user profile and handover call, including the operations of batch requests, and answers with
+// configurable responses or errors, and Client injects synthetic webhook events into Webhook.Handler, so
+// whole conversations can be asserted in tests.
+//
+//	s := messengertest.NewServer()
+//	defer s.Close()
+//	s.Attach(w)
+//	messengertest.NewClient(w, "page").Text("user", "hi")
+//	sent := s.Sent() // the envelopes the bot sent in reply
+package messengertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+type CallKind string
+
+const (
+	SEND_CALL     CallKind = "send"
+	PROFILE_CALL  CallKind = "profile"
+	HANDOVER_CALL CallKind = "handover"
+	// OTHER_CALL is any other Graph API request, answered with 404
+	OTHER_CALL CallKind = "other"
+)
+
+// Call is a request received by the fake Graph API
+type Call struct {
+	Kind        CallKind
+	Method      string
+	Path        string
+	AccessToken string
+	Query       url.Values
+	Body        []byte
+	// Status is the status code the call was answered with
+	Status int
+	// Batch numbers, from 1, the batch request the call is an operation of, and is 0 for calls made on
+	// their own
+	Batch int
+}
+
+// Envelope decodes the body of a Send API call
+func (c *Call) Envelope() (*Envelope, error) {
+	e := new(Envelope)
+	if err := json.Unmarshal(c.Body, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Envelope is a Send API request as received by the Graph API. It mirrors messengerbot.MessageEnvelope,
+// whose attachment payloads cannot be decoded into
+type Envelope struct {
+	Recipient        messengerbot.Recipient        `json:"recipient"`
+	Message          *Message                      `json:"message"`
+	SenderAction     messengerbot.SenderActionType `json:"sender_action"`
+	NotificationType messengerbot.NotificationType `json:"notification_type"`
+	MessagingType    messengerbot.MessagingType    `json:"messaging_type"`
+	Tag              messengerbot.MessageTag       `json:"tag"`
+}
+
+type Message struct {
+	Text         string                    `json:"text"`
+	Attachment   *Attachment               `json:"attachment"`
+	QuickReplies []messengerbot.QuickReply `json:"quick_replies"`
+}
+
+// Attachment keeps the payload raw, as its shape depends on the type of attachment and template
+type Attachment struct {
+	Type    messengerbot.PayloadType `json:"type"`
+	Payload json.RawMessage          `json:"payload"`
+}
+
+type attachmentPayload struct {
+	TemplateType messengerbot.TemplateType `json:"template_type"`
+	Text         string                    `json:"text"`
+	Url          string                    `json:"url"`
+	Buttons      []messengerbot.Button     `json:"buttons"`
+	Elements     []struct {
+		Title   string                `json:"title"`
+		Buttons []messengerbot.Button `json:"buttons"`
+	} `json:"elements"`
+}
+
+func (m *Message) payload() *attachmentPayload {
+	p := new(attachmentPayload)
+	if m.Attachment != nil {
+		json.Unmarshal(m.Attachment.Payload, p)
+	}
+	return p
+}
+
+// TemplateType returns the template type of a template message, or "" for other messages
+func (m *Message) TemplateType() messengerbot.TemplateType {
+	return m.payload().TemplateType
+}
+
+// DisplayText returns the text of text messages and button templates, the url of images and the titles
+// of the elements of other templates
+func (m *Message) DisplayText() string {
+	if m.Attachment == nil {
+		return m.Text
+	}
+	p := m.payload()
+	switch {
+	case p.Text != "":
+		return p.Text
+	case p.Url != "":
+		return p.Url
+	}
+	var titles []string
+	for _, e := range p.Elements {
+		titles = append(titles, e.Title)
+	}
+	return strings.Join(titles, ", ")
+}
+
+// Buttons returns the buttons of a button template and of the elements of a generic template
+func (m *Message) Buttons() []messengerbot.Button {
+	p := m.payload()
+	buttons := append([]messengerbot.Button{}, p.Buttons...)
+	for _, e := range p.Elements {
+		buttons = append(buttons, e.Buttons...)
+	}
+	return buttons
+}
+
+// Responder answers a call with a status code and a body, which is encoded as JSON unless it is a string
+type Responder func(c *Call) (status int, body interface{})
+
+// GraphError is the error object of a failed Graph API call
+type GraphError struct {
+	Message   string `json:"message"`
+	Type      string `json:"type"`
+	Code      int    `json:"code"`
+	FbtraceId string `json:"fbtrace_id,omitempty"`
+}
+
+// Server is a fake Graph API. Send calls are answered with a recipient and message id, profile calls with
+// the profile set for the PSID and handover calls with success, unless another Responder is set
+type Server struct {
+	*httptest.Server
+	mu         sync.Mutex
+	calls      []*Call
+	responders map[CallKind]Responder
+	profiles   map[string]*messengerbot.UserProfile
+	messages   int
+	batches    int
+}
+
+// NewServer starts a fake Graph API, which must be closed when done
+func NewServer() *Server {
+	s := new(Server)
+	s.responders = make(map[CallKind]Responder)
+	s.profiles = make(map[string]*messengerbot.UserProfile)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Attach points the webhook at the fake Graph API
+func (s *Server) Attach(w *messengerbot.Webhook) {
+	w.SetGraphApiUrl(s.URL)
+}
+
+// SetProfile sets the profile returned for the PSID. Profiles of other PSIDs are not found
+func (s *Server) SetProfile(psid string, p *messengerbot.UserProfile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.profiles[psid] = p
+}
+
+// Respond answers calls of the given kind with r. A nil r restores the default response
+func (s *Server) Respond(kind CallKind, r Responder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r == nil {
+		delete(s.responders, kind)
+	} else {
+		s.responders[kind] = r
+	}
+}
+
+// Fail answers calls of the given kind with a Graph API error until Respond(kind, nil) is called
+func (s *Server) Fail(kind CallKind, status, code int, message string) {
+	s.Respond(kind, func(c *Call) (int, interface{}) {
+		return status, errorBody(code, message)
+	})
+}
+
+// Calls returns the calls received so far
+func (s *Server) Calls() []*Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Call{}, s.calls...)
+}
+
+// CallsOf returns the calls of the given kind received so far
+func (s *Server) CallsOf(kind CallKind) []*Call {
+	var calls []*Call
+	for _, c := range s.Calls() {
+		if c.Kind == kind {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// Sent returns the envelopes of the Send API calls received so far, including sender actions and calls
+// answered with an error
+func (s *Server) Sent() []*Envelope {
+	var envelopes []*Envelope
+	for _, c := range s.CallsOf(SEND_CALL) {
+		if e, err := c.Envelope(); err == nil {
+			envelopes = append(envelopes, e)
+		}
+	}
+	return envelopes
+}
+
+// Reset forgets the calls received so far
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = nil
+}
+
+func (s *Server) handle(res http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	if req.Method == http.MethodPost && strings.Trim(req.URL.Path, "/") == "" {
+		if form, err := url.ParseQuery(string(body)); err == nil && form.Get("batch") != "" {
+			s.handleBatch(res, form)
+			return
+		}
+	}
+	c := &Call{
+		Kind:        callKind(req.Method, req.URL.Path),
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		AccessToken: req.URL.Query().Get("access_token"),
+		Query:       req.URL.Query(),
+		Body:        body,
+	}
+	status, out := s.call(c)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(out)
+}
+
+// handleBatch answers each operation of a batch request as a call of its own. The parameters of Send API
+// operations are turned back into the JSON body of a Send API call
+func (s *Server) handleBatch(res http.ResponseWriter, form url.Values) {
+	res.Header().Set("Content-Type", "application/json")
+	var ops []messengerbot.BatchRequest
+	if err := json.Unmarshal([]byte(form.Get("batch")), &ops); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(res).Encode(errorBody(100, "(#100) The parameter batch must be a JSON array"))
+		return
+	}
+	s.mu.Lock()
+	s.batches++
+	batch := s.batches
+	s.mu.Unlock()
+	answers := make([]map[string]interface{}, len(ops))
+	for i, op := range ops {
+		u, _ := url.Parse("/" + op.RelativeUrl)
+		c := &Call{
+			Kind:        callKind(op.Method, u.Path),
+			Method:      op.Method,
+			Path:        u.Path,
+			AccessToken: form.Get("access_token"),
+			Query:       u.Query(),
+			Body:        batchBody(op.Body),
+			Batch:       batch,
+		}
+		status, out := s.call(c)
+		answers[i] = map[string]interface{}{"code": status, "body": string(out)}
+	}
+	json.NewEncoder(res).Encode(answers)
+}
+
+// call answers a call with its responder and records it
+func (s *Server) call(c *Call) (int, []byte) {
+	s.mu.Lock()
+	responder := s.responders[c.Kind]
+	s.mu.Unlock()
+	if responder == nil {
+		responder = s.respond
+	}
+	status, out := responder(c)
+	c.Status = status
+	s.mu.Lock()
+	s.calls = append(s.calls, c)
+	s.mu.Unlock()
+
+	if str, ok := out.(string); ok {
+		return status, []byte(str)
+	}
+	data, _ := json.Marshal(out)
+	return status, data
+}
+
+// batchBody returns the url-encoded parameters of a batch operation as a JSON object, the parameters holding
+// objects being JSON
+func batchBody(body string) []byte {
+	params, err := url.ParseQuery(body)
+	if err != nil || len(params) == 0 {
+		return nil
+	}
+	fields := make(map[string]json.RawMessage)
+	for name := range params {
+		value := params.Get(name)
+		if !json.Valid([]byte(value)) || !strings.HasPrefix(value, "{") && !strings.HasPrefix(value, "[") {
+			quoted, _ := json.Marshal(value)
+			value = string(quoted)
+		}
+		fields[name] = json.RawMessage(value)
+	}
+	data, _ := json.Marshal(fields)
+	return data
+}
+
+// respond gives the default response to a call
+func (s *Server) respond(c *Call) (int, interface{}) {
+	switch c.Kind {
+	case SEND_CALL:
+		e, err := c.Envelope()
+		if err != nil || e.Recipient.Id == "" {
+			return http.StatusBadRequest, errorBody(100, "(#100) The parameter recipient is required")
+		}
+		if e.SenderAction != "" {
+			return http.StatusOK, map[string]string{"recipient_id": e.Recipient.Id}
+		}
+		s.mu.Lock()
+		s.messages++
+		mid := fmt.Sprintf("mid.$fake%d", s.messages)
+		s.mu.Unlock()
+		return http.StatusOK, map[string]string{"recipient_id": e.Recipient.Id, "message_id": mid}
+	case PROFILE_CALL:
+		s.mu.Lock()
+		p, ok := s.profiles[strings.TrimPrefix(c.Path, "/")]
+		s.mu.Unlock()
+		if !ok {
+			return http.StatusBadRequest, errorBody(100, "(#100) No profile available for that user.")
+		}
+		return http.StatusOK, p
+	case HANDOVER_CALL:
+		return http.StatusOK, map[string]bool{"success": true}
+	}
+	return http.StatusNotFound, errorBody(803, "(#803) Some of the aliases you requested do not exist")
+}
+
+func callKind(method, path string) CallKind {
+	path = strings.TrimPrefix(path, "/")
+	switch {
+	case path == "me/messages":
+		return SEND_CALL
+	case path == "me/pass_thread_control", path == "me/take_thread_control",
+		path == "me/request_thread_control", path == "me/thread_owner", path == "me/secondary_receivers":
+		return HANDOVER_CALL
+	case method == http.MethodGet && path != "" && !strings.Contains(path, "/"):
+		return PROFILE_CALL
+	}
+	return OTHER_CALL
+}
+
+func errorBody(code int, message string) map[string]GraphError {
+	return map[string]GraphError{"error": {Message: message, Type: "OAuthException", Code: code,
+		FbtraceId: "AbCdEfGhIjK"}}
+}
@@ -0,0 +1,261 @@
+package messengertest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+// Simulator lets a person chat with a webhook in a terminal. Messages of the bot are rendered as text, with
+// their buttons and quick replies numbered; typing a number taps the button or quick reply, and /say sends
+// it as text. Lines starting with a slash are commands, see /help
+type Simulator struct {
+	w      *messengerbot.Webhook
+	Server *Server
+	Client *Client
+	// Psid is the id of the simulated user
+	Psid    string
+	read    int
+	options []simOption
+}
+
+// simOption is a numbered button or quick reply the user can tap
+type simOption struct {
+	title   string
+	payload string
+	url     string
+	quick   bool
+	stale   bool
+}
+
+// simPayload is the union of the attachment payloads the simulator renders
+type simPayload struct {
+	TemplateType  messengerbot.TemplateType `json:"template_type"`
+	Text          string                    `json:"text"`
+	Url           string                    `json:"url"`
+	Buttons       []messengerbot.Button     `json:"buttons"`
+	Elements      []json.RawMessage         `json:"elements"`
+	RecipientName string                    `json:"recipient_name"`
+	OrderNumber   string                    `json:"order_number"`
+	Currency      string                    `json:"currency"`
+	PaymentMethod string                    `json:"payment_method"`
+	Address       *messengerbot.Address     `json:"address"`
+	Summary       messengerbot.Summary      `json:"summary"`
+	Adjustments   []messengerbot.Adjustment `json:"adjustments"`
+}
+
+const simHelp = `type a message, or the number of a button or quick reply to tap it
+/say TEXT           send the text as is, e.g. a number
+/postback PAYLOAD   send a postback
+/image URL          send an image
+/location LAT,LONG  send a location
+/quit               leave`
+
+// NewSimulator starts a fake Graph API for the webhook. Close it when done
+func NewSimulator(w *messengerbot.Webhook) *Simulator {
+	m := new(Simulator)
+	m.w = w
+	m.Server = NewServer()
+	m.Server.Attach(w)
+	m.Client = NewClient(w, "page")
+	m.Psid = "user"
+	return m
+}
+
+// Close stops the fake Graph API
+func (m *Simulator) Close() {
+	m.Server.Close()
+}
+
+// Run reads lines from in until it ends or the user quits, writing the chat to out
+func (m *Simulator) Run(in io.Reader, out io.Writer) error {
+	fmt.Fprintln(out, simHelp)
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "you> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == "/quit" {
+			return nil
+		}
+		if err := m.send(line); err != nil {
+			fmt.Fprintln(out, err)
+			continue
+		}
+		m.render(out)
+	}
+}
+
+// send sends what the user typed
+func (m *Simulator) send(line string) error {
+	if n, err := strconv.Atoi(line); err == nil {
+		if n < 1 || n > len(m.options) {
+			return fmt.Errorf("there is no option %d", n)
+		}
+		o := m.options[n-1]
+		switch {
+		case o.stale:
+			return fmt.Errorf("only the quick replies of the latest message can be tapped")
+		case o.url != "":
+			return fmt.Errorf("%s opens %s", o.title, o.url)
+		case o.quick:
+			m.Client.QuickReply(m.Psid, o.title, o.payload)
+		default:
+			m.Client.Postback(m.Psid, o.title, o.payload)
+		}
+		return nil
+	}
+	command, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		command, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	switch command {
+	case "/help":
+		return fmt.Errorf("%s", simHelp)
+	case "/say":
+		m.Client.Text(m.Psid, arg)
+	case "/postback":
+		m.Client.Postback(m.Psid, arg, arg)
+	case "/image":
+		m.Client.Attachment(m.Psid, "image", arg)
+	case "/location":
+		parts := strings.Split(arg, ",")
+		if len(parts) != 2 {
+			return fmt.Errorf("usage: /location LAT,LONG")
+		}
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		long, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("usage: /location LAT,LONG")
+		}
+		m.Client.Location(m.Psid, lat, long)
+	default:
+		if strings.HasPrefix(line, "/") {
+			return fmt.Errorf("unknown command %s, see /help", command)
+		}
+		m.Client.Text(m.Psid, line)
+	}
+	return nil
+}
+
+// render waits for the webhook to be idle, then writes the messages the bot sent since the last call,
+// numbering their options
+func (m *Simulator) render(out io.Writer) {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	if err := m.w.Flush(ctx); err != nil {
+		fmt.Fprintf(out, "bot is still busy after %v\n", flushTimeout)
+	}
+	calls := m.Server.CallsOf(SEND_CALL)
+	fresh := calls[m.read:]
+	m.read = len(calls)
+	if len(fresh) == 0 {
+		return
+	}
+	m.options = nil
+	for _, call := range fresh {
+		e, err := call.Envelope()
+		if err != nil || e.Recipient.Id != m.Psid {
+			continue
+		}
+		if e.Message == nil {
+			if e.SenderAction == messengerbot.TYPING_ON {
+				fmt.Fprintln(out, "bot is typing...")
+			}
+			continue
+		}
+		// quick replies of earlier messages cannot be tapped anymore
+		for i := range m.options {
+			if m.options[i].quick {
+				m.options[i].stale = true
+			}
+		}
+		m.renderMessage(out, e.Message)
+	}
+}
+
+func (m *Simulator) renderMessage(out io.Writer, msg *Message) {
+	if msg.Attachment == nil {
+		fmt.Fprintln(out, "bot> "+msg.Text)
+	} else {
+		p := new(simPayload)
+		json.Unmarshal(msg.Attachment.Payload, p)
+		switch p.TemplateType {
+		case messengerbot.BUTTON:
+			fmt.Fprintln(out, "bot> "+p.Text)
+			m.renderButtons(out, "     ", p.Buttons)
+		case messengerbot.GENERIC:
+			fmt.Fprintln(out, "bot> carousel:")
+			for _, raw := range p.Elements {
+				var el messengerbot.GenericTemplateElement
+				json.Unmarshal(raw, &el)
+				line := "     | " + el.Title
+				if el.Subtitle != "" {
+					line += " - " + el.Subtitle
+				}
+				fmt.Fprintln(out, line)
+				if el.ImageUrl != "" {
+					fmt.Fprintln(out, "     |   image "+el.ImageUrl)
+				}
+				m.renderButtons(out, "     |   ", el.Buttons)
+			}
+		case messengerbot.RECEIPT:
+			fmt.Fprintf(out, "bot> receipt %s for %s, paid with %s\n", p.OrderNumber, p.RecipientName, p.PaymentMethod)
+			for _, raw := range p.Elements {
+				var el messengerbot.ReceiptTemplateElement
+				json.Unmarshal(raw, &el)
+				fmt.Fprintf(out, "     %d x %s  %.2f %s\n", el.Quantity, el.Title, el.Price, p.Currency)
+			}
+			for _, a := range p.Adjustments {
+				fmt.Fprintf(out, "     %s  %.2f %s\n", a.Name, -a.Amount, p.Currency)
+			}
+			if a := p.Address; a != nil && a.Street1 != "" {
+				fmt.Fprintf(out, "     ship to %s, %s %s, %s\n", a.Street1, a.City, a.PostalCode, a.Country)
+			}
+			fmt.Fprintf(out, "     total %.2f %s\n", p.Summary.TotalCost, p.Currency)
+		default:
+			fmt.Fprintf(out, "bot> [%s] %s\n", msg.Attachment.Type, p.Url)
+		}
+	}
+	if len(msg.QuickReplies) > 0 {
+		var replies []string
+		for _, qr := range msg.QuickReplies {
+			o := simOption{title: qr.Title, payload: qr.Payload, quick: true}
+			// Messenger fills these in from the user's profile
+			switch qr.ContentType {
+			case messengerbot.USER_EMAIL:
+				o.title, o.payload = "user@example.com", "user@example.com"
+			case messengerbot.USER_PHONE_NUMBER:
+				o.title, o.payload = "+16505550123", "+16505550123"
+			}
+			m.options = append(m.options, o)
+			replies = append(replies, fmt.Sprintf("(%d) %s", len(m.options), o.title))
+		}
+		fmt.Fprintln(out, "     "+strings.Join(replies, "  "))
+	}
+}
+
+func (m *Simulator) renderButtons(out io.Writer, indent string, buttons []messengerbot.Button) {
+	for _, b := range buttons {
+		o := simOption{title: b.Title, payload: b.Payload}
+		line := b.Title
+		if b.Type == messengerbot.WEB_URL {
+			o.url = b.Url
+			line += " -> " + b.Url
+		}
+		m.options = append(m.options, o)
+		fmt.Fprintf(out, "%s[%d] %s\n", indent, len(m.options), line)
+	}
+}
@@ -0,0 +1,36 @@
+package messengertest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSimulator(t *testing.T) {
+	sim := NewSimulator(newDemoWebhook())
+	defer sim.Close()
+	var out bytes.Buffer
+	in := strings.NewReader("hi\n2\nbutton\n1\n2\n/postback START\n9\n/say 9\n/nope\n/quit\nnever read\n")
+	if err := sim.Run(in, &out); err != nil {
+		t.Fatal(err)
+	}
+	want := `you> bot is typing...
+bot> Hello!
+     (1) Yes  (2) No
+you> bot> You said NO
+you> bot> VB Super
+     [1] Open Web URL -> https://www.oculus.com/en-us/rift/
+     [2] Call Postback
+you> Open Web URL opens https://www.oculus.com/en-us/rift/
+you> bot> Postback: Payload for first bubble
+you> bot> Postback: START
+you> there is no option 9
+you> bot is typing...
+bot> Hello!
+     (1) Yes  (2) No
+you> unknown command /nope, see /help
+you> `
+	if got := out.String()[len(simHelp)+1:]; got != want {
+		t.Errorf("simulator wrote\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,143 @@
+package messengerbot
+
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// RecoverMiddleware recovers from panics in the handlers it wraps, logging the panic and reporting the
+// event as not handled. Add it first so it also covers the other middlewares
+func RecoverMiddleware() Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(e *Event) (handled bool) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("panic while handling %s event from %s : %v\n%s", e.Type, e.Sender.Id, r, debug.Stack())
+					handled = false
+				}
+			}()
+			return next(e)
+		}
+	}
+}
+
+// LoggingMiddleware logs every event and whether it was handled
+func LoggingMiddleware() Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(e *Event) bool {
+			log.Println("event : ", e.Type, "page :", e.PageId, "sender :", e.Sender.Id)
+			handled := next(e)
+			log.Println("event handled : ", e.Type, handled)
+			return handled
+		}
+	}
+}
+
+// TimingMiddleware reports how long the handlers it wraps took for each event. A nil cb logs the duration
+func TimingMiddleware(cb func(e *Event, elapsed time.Duration)) Middleware {
+	if cb == nil {
+		cb = func(e *Event, elapsed time.Duration) {
+			log.Println("event : ", e.Type, "took :", elapsed)
+		}
+	}
+	return func(next EventHandler) EventHandler {
+		return func(e *Event) bool {
+			start := time.Now()
+			handled := next(e)
+			cb(e, time.Since(start))
+			return handled
+		}
+	}
+}
+
+// ProfileMiddleware sets Event.Profile to the profile of the sender, caching profiles for the given ttl.
+// Profiles looked up while another lookup is being made are fetched together in a batch request. Events are
+// still handled, without a profile, when the lookup fails
+func ProfileMiddleware(ttl time.Duration) Middleware {
+	cache := newProfileCache(ttl)
+	return func(next EventHandler) EventHandler {
+		return func(e *Event) bool {
+			key := e.PageId + ":" + e.Sender.Id
+			if profile, ok := cache.get(key); ok {
+				e.Profile = profile
+			} else if profile, err := e.webhook.profiles.get(e.PageId, e.Sender.Id); err == nil {
+				e.Profile = profile
+				cache.put(key, profile)
+			} else {
+				log.Println("warning: cannot get profile of ", e.Sender.Id, err)
+			}
+			return next(e)
+		}
+	}
+}
+
+// profileCache holds the profiles found by ProfileMiddleware until they expire. Expired profiles are removed
+// when they are looked up, and all at once whenever the cache doubled in size since they last were
+type profileCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedProfile
+	sweepAt int
+}
+
+type cachedProfile struct {
+	profile *UserProfile
+	expires time.Time
+}
+
+func newProfileCache(ttl time.Duration) *profileCache {
+	c := new(profileCache)
+	c.ttl = ttl
+	c.entries = make(map[string]cachedProfile)
+	c.sweepAt = 1024
+	return c
+}
+
+func (c *profileCache) get(key string) (*UserProfile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.profile, ok
+}
+
+func (c *profileCache) put(key string, profile *UserProfile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.entries[key] = cachedProfile{profile, now.Add(c.ttl)}
+	if len(c.entries) < c.sweepAt {
+		return
+	}
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.sweepAt = 2 * len(c.entries)
+	if c.sweepAt < 1024 {
+		c.sweepAt = 1024
+	}
+}
+
+// BlockMiddleware drops events sent by any of the given PSIDs without calling the handlers it wraps
+func BlockMiddleware(psids ...string) Middleware {
+	blocked := make(map[string]bool)
+	for _, psid := range psids {
+		blocked[psid] = true
+	}
+	return func(next EventHandler) EventHandler {
+		return func(e *Event) bool {
+			if blocked[e.Sender.Id] {
+				log.Println("event from blocked sender dropped : ", e.Sender.Id)
+				return true
+			}
+			return next(e)
+		}
+	}
+}
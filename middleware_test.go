@@ -0,0 +1,91 @@
+package messengerbot
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	w := NewMessengerWebhook("token", "token")
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next EventHandler) EventHandler {
+			return func(e *Event) bool {
+				calls = append(calls, name+" before")
+				handled := next(e)
+				calls = append(calls, name+" after")
+				return handled
+			}
+		}
+	}
+	w.Use(trace("first"), trace("second"))
+	w.Use(trace("third"))
+	w.MessageHandler(func(pageId string, s Sender, r Recipient, ts time.Time, m IncomingTextMessage) bool {
+		calls = append(calls, "handler")
+		return true
+	})
+
+	postTextMessage(w, "page", "user", "hi")
+	want := []string{"first before", "second before", "third before", "handler",
+		"third after", "second after", "first after"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestBuiltinMiddlewares(t *testing.T) {
+	graph := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(res, `{"first_name":"Peter","last_name":"Chang"}`)
+	}))
+	defer graph.Close()
+
+	w := NewMessengerWebhook("token", "token")
+	w.graphApiUrl = graph.URL
+	var timed int
+	w.Use(RecoverMiddleware(), BlockMiddleware("spammer"), ProfileMiddleware(time.Minute),
+		TimingMiddleware(func(e *Event, elapsed time.Duration) { timed++ }))
+	var names []string
+	w.ConversationMessageHandler(func(c *Conversation, m IncomingTextMessage) bool {
+		if m.Text == "panic" {
+			panic("boom")
+		}
+		names = append(names, c.Profile.FirstName)
+		return true
+	})
+
+	postTextMessage(w, "page", "user", "hi")
+	postTextMessage(w, "page", "spammer", "hi")
+	postTextMessage(w, "page", "user", "panic")
+	if !reflect.DeepEqual(names, []string{"Peter"}) {
+		t.Errorf("handled messages from %v", names)
+	}
+	// the panic unwinds through the timing middleware before it can report
+	if timed != 1 {
+		t.Errorf("timed %d events, want 1", timed)
+	}
+}
+
+func TestProfileCache(t *testing.T) {
+	c := newProfileCache(10 * time.Millisecond)
+	for i := 0; i < 1000; i++ {
+		c.put(fmt.Sprint("old", i), &UserProfile{})
+	}
+	c.put("user", &UserProfile{FirstName: "Ann"})
+	if p, ok := c.get("user"); !ok || p.FirstName != "Ann" {
+		t.Errorf("user: %+v", p)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if p, ok := c.get("user"); ok {
+		t.Errorf("expired user: %+v", p)
+	}
+	for i := 0; i < 1000; i++ {
+		c.put(fmt.Sprint("new", i), &UserProfile{})
+	}
+	if n := len(c.entries); n > 1100 {
+		t.Errorf("%d profiles cached", n)
+	}
+}
@@ -1,6 +1,8 @@
 package messengerbot
 
 import (
+	"encoding/json"
+	"fmt"
 	"time"
 )
 
@@ -16,10 +18,18 @@ type IncomingAttachmentMessage struct {
 	Seq  float64 `json:"seq,omitempty"`
 	AttachmentType string
 	AttachmentUrl string
+	Coordinates *Coordinates
 }
 
+type Coordinates struct {
+	Lat  float64 `json:"lat"`
+	Long float64 `json:"long"`
+}
+
+// EventDelivery tells which messages sent by the page were delivered. Mid is the first of Mids
 type EventDelivery struct {
 	Mid  string  `json:"mid,omitempty"`
+	Mids  []string  `json:"mids,omitempty"`
 	Watermark  float64 `json:"watermark,omitempty"`
 	Seq  float64 `json:"seq,omitempty"`
 }
@@ -28,6 +38,10 @@ type EventPostback  struct {
 	Payload  string  `json:"payload,omitempty"`
 }
 
+type EventOptin struct {
+	Ref string `json:"ref,omitempty"`
+}
+
 
 type VerifiedCallback func() string
 
@@ -43,6 +57,8 @@ type DeliveryCallback func(string, Sender, Recipient, EventDelivery) bool
 
 type PostbackCallback func(string, Sender, Recipient, time.Time, EventPostback) bool
 
+type ErrorCallback func(error)
+
 // send api
 // https://developers.facebook.com/docs/messenger-platform/send-api-reference
 
@@ -62,6 +78,24 @@ const (
 	NO_PUSH NotificationType = "NO_PUSH"
 )
 
+type MessagingType string
+
+const (
+	RESPONSE MessagingType = "RESPONSE"
+	UPDATE MessagingType = "UPDATE"
+	MESSAGE_TAG MessagingType = "MESSAGE_TAG"
+)
+
+// MessageTag lets a MESSAGE_TAG message be sent outside the 24 hour window, for the use it names
+type MessageTag string
+
+const (
+	CONFIRMED_EVENT_UPDATE MessageTag = "CONFIRMED_EVENT_UPDATE"
+	POST_PURCHASE_UPDATE MessageTag = "POST_PURCHASE_UPDATE"
+	ACCOUNT_UPDATE MessageTag = "ACCOUNT_UPDATE"
+	HUMAN_AGENT MessageTag = "HUMAN_AGENT"
+)
+
 type PayloadType string
 
 const (
@@ -81,6 +115,8 @@ type QuickReplyContentType string
 
 const (
 	TEXT QuickReplyContentType = "text"
+	USER_EMAIL QuickReplyContentType = "user_email"
+	USER_PHONE_NUMBER QuickReplyContentType = "user_phone_number"
 )
 
 type ButtonType string
@@ -115,6 +151,51 @@ type Attachment struct {
 	Payload AttachmentPayload `json:"payload"`
 }
 
+// UnmarshalJSON decodes the payload into the ImagePayload or template its type and template type name
+func (a *Attachment) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Type    PayloadType     `json:"type"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	a.Type = raw.Type
+	switch raw.Type {
+	case IMAGE:
+		p := ImagePayload{}
+		err := json.Unmarshal(raw.Payload, &p)
+		a.Payload = p
+		return err
+	case TEMPLATE:
+		var template struct {
+			TemplateType TemplateType `json:"template_type"`
+		}
+		if err := json.Unmarshal(raw.Payload, &template); err != nil {
+			return err
+		}
+		switch template.TemplateType {
+		case GENERIC:
+			p := GenericTemplate{}
+			err := json.Unmarshal(raw.Payload, &p)
+			a.Payload = p
+			return err
+		case BUTTON:
+			p := ButtonTemplate{}
+			err := json.Unmarshal(raw.Payload, &p)
+			a.Payload = p
+			return err
+		case RECEIPT:
+			p := ReceiptTemplate{}
+			err := json.Unmarshal(raw.Payload, &p)
+			a.Payload = p
+			return err
+		}
+		return fmt.Errorf("messengerbot: unknown template type %q", template.TemplateType)
+	}
+	return fmt.Errorf("messengerbot: unknown attachment type %q", raw.Type)
+}
+
 type AttachmentPayload interface {
 	AttachmentPayloadType() PayloadType
 }
@@ -197,7 +278,8 @@ type ReceiptTemplate struct {
 	Timestamp string `json:"timestamp,omitempty"`
 	OrderUrl string `json:"order_url,omitempty"`
 	Elements []ReceiptTemplateElement `json:"elements"`
-	ShippingAddress Address `json:"address,omitempty"`
+	// ShippingAddress is left out when empty
+	ShippingAddress Address `json:"address"`
 	PaymentSummary Summary `json:"summary"`
 	Adjustments []Adjustment `json:"adjustments,omitempty"`
 }
@@ -230,11 +312,25 @@ func (a ReceiptTemplate) AttachmentPayloadType() PayloadType {
 	return TEMPLATE
 }
 
+// MarshalJSON leaves out an empty shipping address, which omitempty cannot do for a struct
+func (a ReceiptTemplate) MarshalJSON() ([]byte, error) {
+	type receiptTemplate ReceiptTemplate
+	var out struct {
+		receiptTemplate
+		ShippingAddress *Address `json:"address,omitempty"`
+	}
+	out.receiptTemplate = receiptTemplate(a)
+	if a.ShippingAddress != (Address{}) {
+		out.ShippingAddress = &a.ShippingAddress
+	}
+	return json.Marshal(out)
+}
+
 type ReceiptTemplateElement struct {
 	Title string `json:"title"`
 	Subtitle string `json:"subtitle,omitempty"`
 	Quantity int64 `json:"quantity,omitempty"`
-	Price float64 `json:"price,omitempty"`
+	Price float64 `json:"price"`
 	Currency string `json:"currency,omitempty"`
 	ImageUrl string `json:"image_url,omitempty"`
 }
@@ -262,7 +358,7 @@ type Adjustment struct {
 }
 
 type Recipient struct {
-	Id string `json:"id"`
+	Id string `json:"id,omitempty"`
 	PhoneNumber string `json:"phone_number,omitempty"`
 }
 
@@ -272,7 +368,9 @@ type Sender struct {
 
 type MessageEnvelope struct {
 	Recipient Recipient `json:"recipient"`
-	Message   *Message   `json:"message"`
-	SenderAction SenderActionType `json:"sender_action"`
+	Message   *Message   `json:"message,omitempty"`
+	SenderAction SenderActionType `json:"sender_action,omitempty"`
 	NotificationType NotificationType `json:"notification_type,omitempty"`
+	MessagingType MessagingType `json:"messaging_type,omitempty"`
+	Tag MessageTag `json:"tag,omitempty"`
 }
@@ -0,0 +1,121 @@
+package messengerbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+var testQuickReplies = []QuickReply{
+	{ContentType: TEXT, Title: "Red", Payload: "RED"},
+	{ContentType: USER_EMAIL},
+	{ContentType: USER_PHONE_NUMBER},
+}
+
+var testButtons = []Button{
+	{Type: WEB_URL, Title: "Open Web URL", Url: "https://www.oculus.com/en-us/rift/"},
+	{Type: POSTBACK, Title: "Call Postback", Payload: "Payload for first bubble"},
+}
+
+func testReceipt(address Address, adjustments []Adjustment) *Message {
+	return NewReceiptMessage("Stephane Crozatier", "12345678902", "USD", "Visa 2345", "1428444852",
+		"http://petersapparel.parseapp.com/order?order_id=123456",
+		[]ReceiptTemplateElement{
+			{Title: "Classic White T-Shirt", Subtitle: "100% Soft and Luxurious Cotton", Quantity: 2, Price: 50,
+				Currency: "USD", ImageUrl: "http://petersapparel.parseapp.com/img/whiteshirt.png"},
+			{Title: "Gift wrap", Price: 0},
+		},
+		address, Summary{Subtotal: 75, ShippingCost: 4.95, TotalTax: 6.19, TotalCost: 56.14}, adjustments, nil)
+}
+
+// goldenMessages are the outgoing messages whose JSON is checked against testdata/golden/<name>.json
+var goldenMessages = map[string]interface{}{
+	"text":                       NewTextMessage("hello, world!", nil),
+	"text_quick_replies":         NewTextMessage("Pick one", testQuickReplies),
+	"image":                      NewImageMessage("https://petersapparel.com/img/shirt.png", nil),
+	"image_quick_replies":        NewImageMessage("https://petersapparel.com/img/shirt.png", testQuickReplies[:1]),
+	"button_template":            NewButtonMessage("What do you want to do next?", testButtons, nil),
+	"button_template_no_buttons": NewButtonMessage("Just text", nil, nil),
+	"generic_template": NewGenericMessage([]GenericTemplateElement{
+		{Title: "rift", Subtitle: "Next-generation virtual reality", ItemUrl: "https://www.oculus.com/en-us/rift/",
+			ImageUrl: "http://messengerdemo.parseapp.com/img/rift.png", Buttons: testButtons},
+		{Title: "touch"},
+	}, testQuickReplies[:1]),
+	"receipt_template": testReceipt(Address{Street1: "1 Hacker Way", Street2: "Building 3", City: "Menlo Park",
+		PostalCode: "94025", State: "CA", Country: "US"},
+		[]Adjustment{{Name: "New Customer Discount", Amount: 20}, {Name: "$10 Off Coupon", Amount: 10}}),
+	"receipt_template_minimal": testReceipt(Address{}, nil),
+	"envelope_message": MessageEnvelope{Recipient: Recipient{Id: "USER_ID"},
+		Message: NewTextMessage("hello", nil), NotificationType: SILENT_PUSH, MessagingType: RESPONSE},
+	"envelope_phone_number": MessageEnvelope{Recipient: Recipient{PhoneNumber: "+1(212)555-2368"},
+		Message: NewTextMessage("hello", nil), MessagingType: UPDATE},
+	"envelope_sender_action": MessageEnvelope{Recipient: Recipient{Id: "USER_ID"}, SenderAction: TYPING_ON},
+}
+
+func TestGoldenJSON(t *testing.T) {
+	for name, v := range goldenMessages {
+		got, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		got = append(got, '\n')
+		path := filepath.Join("testdata", "golden", name+".json")
+		if *update {
+			if err := ioutil.WriteFile(path, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("%s: %v, run go test -update to create it", name, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s marshals to\n%s\nwant %s\n(run go test -update if the change is intended)", name, got, want)
+		}
+	}
+}
+
+// TestRoundTrip checks every model decodes back to the value it was encoded from
+func TestRoundTrip(t *testing.T) {
+	values := []interface{}{
+		IncomingTextMessage{Mid: "mid.1", Seq: 73, Text: "hi", QuickReply: &QuickReply{Payload: "RED"}},
+		IncomingAttachmentMessage{Mid: "mid.2", Seq: 74, AttachmentType: "location",
+			Coordinates: &Coordinates{Lat: 6.9, Long: 79.8}},
+		EventDelivery{Mid: "mid.3", Mids: []string{"mid.3", "mid.4"}, Watermark: 1458668856253, Seq: 37},
+		EventPostback{Payload: "START"},
+		EventOptin{Ref: "PASS_THROUGH_PARAM"},
+		UserProfile{FirstName: "Peter", LastName: "Chang", Locale: "en_US", Timezone: -7, Gender: "male"},
+	}
+	for _, v := range goldenMessages {
+		values = append(values, v)
+	}
+	for _, v := range values {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Errorf("%#v: %v", v, err)
+			continue
+		}
+		decoded := reflect.New(reflect.TypeOf(v))
+		if err := json.Unmarshal(data, decoded.Interface()); err != nil {
+			t.Errorf("%s: %v", data, err)
+			continue
+		}
+		if got := decoded.Elem().Interface(); !reflect.DeepEqual(got, v) {
+			t.Errorf("%s decodes to %#v, want %#v", data, got, v)
+		}
+	}
+
+	var a Attachment
+	if err := json.Unmarshal([]byte(`{"type":"template","payload":{"template_type":"list"}}`), &a); err == nil {
+		t.Error("unknown template types decode")
+	}
+}
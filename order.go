@@ -0,0 +1,82 @@
+package messengerbot
+
+import (
+	"sort"
+	"sync"
+)
+
+// conversationKey identifies the conversation of an event, the sender talking to a page
+func conversationKey(e *Event) string {
+	return sessionKey(e.PageId, e.Sender.Id)
+}
+
+// orderEvents sorts the events of each conversation of a request by timestamp, keeping the order of events
+// with the same timestamp, such as the attachments of a message
+func orderEvents(events []*Event) {
+	positions := make(map[string][]int)
+	var keys []string
+	for i, e := range events {
+		key := conversationKey(e)
+		if _, ok := positions[key]; !ok {
+			keys = append(keys, key)
+		}
+		positions[key] = append(positions[key], i)
+	}
+	for _, key := range keys {
+		group := make([]*Event, 0, len(positions[key]))
+		for _, i := range positions[key] {
+			group = append(group, events[i])
+		}
+		sort.SliceStable(group, func(i, j int) bool { return group[i].Timestamp.Before(group[j].Timestamp) })
+		for n, i := range positions[key] {
+			events[i] = group[n]
+		}
+	}
+}
+
+// conversationLocks lets a synchronous webhook handle the events of a conversation one at a time when
+// requests are served concurrently
+type conversationLocks struct {
+	mu    sync.Mutex
+	locks map[string]*conversationLock
+}
+
+type conversationLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock waits until no other event of the conversation is being handled, and returns the function
+// releasing the conversation
+func (l *conversationLocks) lock(key string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*conversationLock)
+	}
+	c, ok := l.locks[key]
+	if !ok {
+		c = new(conversationLock)
+		l.locks[key] = c
+	}
+	c.refs++
+	l.mu.Unlock()
+
+	c.Lock()
+	return func() {
+		c.Unlock()
+		l.mu.Lock()
+		c.refs--
+		if c.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// dispatchLocked handles the event holding the lock of its conversation, which is released even when a
+// handler panics
+func (w *Webhook) dispatchLocked(e *Event) {
+	unlock := w.locks.lock(conversationKey(e))
+	defer unlock()
+	w.dispatch(e)
+}
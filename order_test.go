@@ -0,0 +1,168 @@
+package messengerbot
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// conversationTracker records the texts each user's messages were handled in, how many of a user's
+// messages were handled at once and how many messages were handled at once overall
+type conversationTracker struct {
+	mu         sync.Mutex
+	handled    map[string][]int
+	active     map[string]int
+	running    int
+	maxPerUser int
+	maxRunning int
+}
+
+func trackingWebhook() (*Webhook, *conversationTracker) {
+	c := &conversationTracker{handled: make(map[string][]int), active: make(map[string]int)}
+	w := NewMessengerWebhook("token", "token")
+	w.MessageHandler(func(pageId string, s Sender, r Recipient, ts time.Time, m IncomingTextMessage) bool {
+		c.mu.Lock()
+		c.active[s.Id]++
+		c.running++
+		if c.active[s.Id] > c.maxPerUser {
+			c.maxPerUser = c.active[s.Id]
+		}
+		if c.running > c.maxRunning {
+			c.maxRunning = c.running
+		}
+		c.mu.Unlock()
+
+		time.Sleep(200 * time.Microsecond)
+		n, _ := strconv.Atoi(m.Text)
+
+		c.mu.Lock()
+		c.handled[s.Id] = append(c.handled[s.Id], n)
+		c.active[s.Id]--
+		c.running--
+		c.mu.Unlock()
+		return true
+	})
+	return w, c
+}
+
+// postUsers posts messages numbered from 0 for each user in parallel. Each user's messages are posted one
+// after the other, as Messenger does, unless concurrent is set
+func postUsers(t *testing.T, w *Webhook, users, messages int, concurrent bool) {
+	var wg sync.WaitGroup
+	for u := 0; u < users; u++ {
+		sender := fmt.Sprint("user", u)
+		if concurrent {
+			for i := 0; i < messages; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					post(w, textFrom(sender, fmt.Sprint(i)))
+				}(i)
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < messages; i++ {
+				if code := post(w, textFrom(sender, fmt.Sprint(i))); code != 200 {
+					t.Errorf("%s message %d answered %d", sender, i, code)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestOrderUnderLoad(t *testing.T) {
+	const users, messages = 16, 40
+	for _, async := range []bool{true, false} {
+		w, c := trackingWebhook()
+		if async {
+			w.ProcessAsync(4, 8, BLOCK_WHEN_FULL)
+		}
+		postUsers(t, w, users, messages, false)
+		if err := w.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		for u := 0; u < users; u++ {
+			got := c.handled[fmt.Sprint("user", u)]
+			if len(got) != messages {
+				t.Fatalf("async %v: user%d had %d messages handled", async, u, len(got))
+			}
+			for i, n := range got {
+				if n != i {
+					t.Fatalf("async %v: user%d messages handled in order %v", async, u, got)
+				}
+			}
+		}
+		if c.maxPerUser != 1 {
+			t.Errorf("async %v: %d messages of a user handled at once", async, c.maxPerUser)
+		}
+		if c.maxRunning < 2 {
+			t.Errorf("async %v: users were not handled in parallel", async)
+		}
+	}
+}
+
+func TestOrderConcurrentRequests(t *testing.T) {
+	w, c := trackingWebhook()
+	postUsers(t, w, 4, 20, true)
+	if c.maxPerUser != 1 {
+		t.Errorf("%d messages of a user handled at once", c.maxPerUser)
+	}
+	if c.maxRunning < 2 {
+		t.Errorf("users were not handled in parallel")
+	}
+	if len(w.locks.locks) != 0 {
+		t.Errorf("%d conversation locks left", len(w.locks.locks))
+	}
+}
+
+func TestOrderWithinRequest(t *testing.T) {
+	event := func(sender string, ts int, text string) string {
+		return fmt.Sprintf(`{"sender":{"id":%q},"recipient":{"id":"page"},"timestamp":%d,
+			"message":{"mid":"mid.%d","seq":%d,"text":%q}}`, sender, ts, ts, ts, text)
+	}
+	body := `{"object":"page","entry":[{"id":"page","messaging":[` + strings.Join([]string{
+		event("a", 3000, "a3"), event("b", 2000, "b2"), event("a", 1000, "a1"), event("b", 1000, "b1"),
+		event("c", 5000, "c5"), event("a", 2000, "a2")}, ",") + `]}]}`
+	w, handled, errors := recordingWebhook()
+	post(w, body)
+	want := []string{"message a>page a1", "message b>page b1", "message a>page a2", "message b>page b2",
+		"message c>page c5", "message a>page a3"}
+	if len(*errors) != 0 || !reflect.DeepEqual(*handled, want) {
+		t.Errorf("handled %q, errors %v", *handled, *errors)
+	}
+}
+
+func TestOrderAfterPanic(t *testing.T) {
+	w := NewMessengerWebhook("token", "token")
+	w.MessageHandler(func(pageId string, s Sender, r Recipient, ts time.Time, m IncomingTextMessage) bool {
+		if m.Text == "panic" {
+			panic("handler failed")
+		}
+		return true
+	})
+	// net/http recovers the panic of the request
+	func() {
+		defer func() { recover() }()
+		post(w, textFrom("user", "panic"))
+	}()
+	done := make(chan int)
+	go func() { done <- post(w, textFrom("user", "hi")) }()
+	select {
+	case code := <-done:
+		if code != http.StatusOK || len(w.locks.locks) != 0 {
+			t.Errorf("answered %d, %d conversation locks left", code, len(w.locks.locks))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the conversation is still locked")
+	}
+}
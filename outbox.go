@@ -0,0 +1,249 @@
+package messengerbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OutboxItem is a message waiting in an outbox to be accepted by the Send API
+type OutboxItem struct {
+	Id       string          `json:"id"`
+	PageId   string          `json:"page_id"`
+	Envelope MessageEnvelope `json:"envelope"`
+	Created  time.Time       `json:"created"`
+}
+
+// Outbox stores the messages sent by a webhook until the Send API accepts them, so they are not lost when
+// the process stops. Done marks a message accepted with the message id given by the Send API, Fail marks
+// a message which cannot be sent. Pending returns the other messages, in the order they were added
+type Outbox interface {
+	Add(item *OutboxItem) error
+	Done(id, messageId string) error
+	Fail(id, reason string) error
+	Pending() ([]*OutboxItem, error)
+}
+
+// OutboxError is a message of the outbox which could not be sent
+type OutboxError struct {
+	Item *OutboxItem
+	Err  error
+}
+
+func (e *OutboxError) Error() string {
+	return e.Err.Error() + " : outbox message " + e.Item.Id + " to " + outboxRecipient(e.Item)
+}
+
+func (e *OutboxError) Unwrap() error {
+	return e.Err
+}
+
+// UseOutbox makes the webhook add the messages it sends to the outbox, and starts workers goroutines
+// sending them, so messages are sent at least once even when the process stops before the Send API
+// answers. Messages pending in the outbox are sent first. The messages of a recipient are sent in order
+// by the same worker, which waits backoff, one second when not positive, doubling up to a minute, before
+// sending again a message which failed with a temporary error. Messages which failed maxAttempts times, or
+// with an error which is not temporary, are marked failed and reported to the error callback; maxAttempts
+// below 1 retries for ever. Call it once, before sending messages
+func (w *Webhook) UseOutbox(o Outbox, workers, maxAttempts int, backoff time.Duration) error {
+	pending, err := o.Pending()
+	if err != nil {
+		return err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	s := new(outboxSender)
+	s.w = w
+	s.outbox = o
+	s.maxAttempts = maxAttempts
+	s.backoff = backoff
+	if s.backoff <= 0 {
+		s.backoff = time.Second
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for i := 0; i < workers; i++ {
+		shard := &outboxShard{wake: make(chan struct{}, 1)}
+		s.shards = append(s.shards, shard)
+		s.wg.Add(1)
+		go s.run(shard)
+	}
+	for _, item := range pending {
+		s.push(item)
+	}
+	w.outbox = s
+	return nil
+}
+
+// outboxSender sends the messages of an outbox, each worker taking the messages of its shard of recipients
+type outboxSender struct {
+	w           *Webhook
+	outbox      Outbox
+	maxAttempts int
+	backoff     time.Duration
+	shards      []*outboxShard
+	seq         uint64
+	// mu keeps messages from being added while the sender is closed
+	mu     sync.RWMutex
+	closed bool
+	// ctx is cancelled when the workers are aborted
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type outboxShard struct {
+	mu     sync.Mutex
+	items  []*OutboxItem
+	closed bool
+	wake   chan struct{}
+	// sending is whether an item taken from the shard is being sent
+	sending bool
+}
+
+func outboxRecipient(item *OutboxItem) string {
+	r := item.Envelope.Recipient
+	return sessionKey(item.PageId, r.Id+r.PhoneNumber)
+}
+
+// add stores a message in the outbox and queues it. A message the outbox cannot store is sent right away,
+// and a message added once the sender is closed is reported to the error callback with ErrShuttingDown
+func (s *outboxSender) add(pageId string, data MessageEnvelope) {
+	item := &OutboxItem{Id: fmt.Sprintf("%d.%d", time.Now().UnixNano(), atomic.AddUint64(&s.seq, 1)),
+		PageId: pageId, Envelope: data, Created: time.Now()}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		s.w.errorCallback(&OutboxError{item, ErrShuttingDown})
+		return
+	}
+	if err := s.outbox.Add(item); err != nil {
+		log.Println("warning: cannot add message to outbox, sending it right away :", err)
+		if _, err := s.w.SendMessage(context.Background(), pageId, data); err != nil {
+			log.Println("warning: send api call failed :", err)
+		}
+		return
+	}
+	s.push(item)
+}
+
+func (s *outboxSender) push(item *OutboxItem) {
+	shard := s.shards[shardIndex(outboxRecipient(item), len(s.shards))]
+	shard.mu.Lock()
+	shard.items = append(shard.items, item)
+	shard.mu.Unlock()
+	select {
+	case shard.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next message of the shard, waiting for one unless the shard is closed
+func (shard *outboxShard) next(stop <-chan struct{}) (*OutboxItem, bool) {
+	for {
+		shard.mu.Lock()
+		shard.sending = false
+		if len(shard.items) > 0 {
+			item := shard.items[0]
+			shard.items = shard.items[1:]
+			shard.sending = true
+			shard.mu.Unlock()
+			return item, true
+		}
+		closed := shard.closed
+		shard.mu.Unlock()
+		if closed {
+			return nil, false
+		}
+		select {
+		case <-shard.wake:
+		case <-stop:
+			return nil, false
+		}
+	}
+}
+
+func (s *outboxSender) run(shard *outboxShard) {
+	defer s.wg.Done()
+	for {
+		item, ok := shard.next(s.ctx.Done())
+		if !ok {
+			return
+		}
+		s.send(item)
+	}
+}
+
+// send sends a message until it is accepted, it fails for good or the sender is stopped, leaving it
+// pending in the outbox
+func (s *outboxSender) send(item *OutboxItem) {
+	backoff := s.backoff
+	for attempt := 1; ; attempt++ {
+		r, err := s.w.SendMessage(s.ctx, item.PageId, item.Envelope)
+		if err == nil {
+			if err := s.outbox.Done(item.Id, r.MessageId); err != nil {
+				log.Println("warning: cannot mark outbox message done :", item.Id, err)
+			}
+			return
+		}
+		if s.ctx.Err() != nil {
+			return
+		}
+		if !temporary(err) || (s.maxAttempts > 0 && attempt >= s.maxAttempts) {
+			s.w.errorCallback(&OutboxError{item, err})
+			// a paced reply is preceded by the typing indicator
+			if p := s.w.pacer; p != nil && item.Envelope.Message != nil {
+				p.sendAction(item.PageId, item.Envelope.Recipient, TYPING_OFF)
+			}
+			if err := s.outbox.Fail(item.Id, err.Error()); err != nil {
+				log.Println("warning: cannot mark outbox message failed :", item.Id, err)
+			}
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// idle reports whether no message is queued or being sent
+func (s *outboxSender) idle() bool {
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		busy := shard.sending || len(shard.items) > 0
+		shard.mu.Unlock()
+		if busy {
+			return false
+		}
+	}
+	return true
+}
+
+// close lets the workers return once the queued messages are sent
+func (s *outboxSender) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		shard.closed = true
+		shard.mu.Unlock()
+		select {
+		case shard.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// abort makes the workers return without sending the queued messages, which stay pending in the outbox
+func (s *outboxSender) abort() {
+	s.cancel()
+}
@@ -0,0 +1,130 @@
+package messengerbot
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+)
+
+const (
+	fileOutboxAdd  = "add"
+	fileOutboxDone = "done"
+	fileOutboxFail = "fail"
+)
+
+type fileOutboxRecord struct {
+	Op        string      `json:"op"`
+	Id        string      `json:"id"`
+	Item      *OutboxItem `json:"item,omitempty"`
+	MessageId string      `json:"message_id,omitempty"`
+	Reason    string      `json:"reason,omitempty"`
+}
+
+// FileOutbox is an Outbox persisting messages to a log file, one JSON record per change, and keeping the
+// pending messages in memory
+type FileOutbox struct {
+	mu      sync.Mutex
+	log     *appendLog
+	pending map[string]*list.Element
+	// order holds the pending messages in the order they were added
+	order *list.List
+}
+
+// NewFileOutbox opens the outbox log at path, creating it if it does not exist
+func NewFileOutbox(path string) (*FileOutbox, error) {
+	f := new(FileOutbox)
+	f.log = newAppendLog(path, "outbox")
+	f.pending = make(map[string]*list.Element)
+	f.order = list.New()
+	err := f.log.load(func(data []byte) error {
+		var r fileOutboxRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		f.apply(r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := f.compact(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileOutbox) apply(r fileOutboxRecord) {
+	switch r.Op {
+	case fileOutboxAdd:
+		if r.Item != nil {
+			if _, ok := f.pending[r.Id]; !ok {
+				f.pending[r.Id] = f.order.PushBack(r.Item)
+			}
+		}
+	case fileOutboxDone, fileOutboxFail:
+		if el, ok := f.pending[r.Id]; ok {
+			f.order.Remove(el)
+			delete(f.pending, r.Id)
+		}
+	}
+}
+
+func (f *FileOutbox) append(r fileOutboxRecord) error {
+	if err := f.log.append(r); err != nil {
+		return err
+	}
+	f.apply(r)
+	// the change is durable, so a failed compaction must not fail it and have the message sent again
+	f.log.compactIfFull(len(f.pending), f.snapshot)
+	return nil
+}
+
+// compact rewrites the log with a record per pending message
+func (f *FileOutbox) compact() error {
+	return f.log.compact(f.snapshot)
+}
+
+func (f *FileOutbox) snapshot(write func(r interface{}) error) error {
+	for el := f.order.Front(); el != nil; el = el.Next() {
+		item := el.Value.(*OutboxItem)
+		if err := write(fileOutboxRecord{Op: fileOutboxAdd, Id: item.Id, Item: item}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FileOutbox) Add(item *OutboxItem) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.append(fileOutboxRecord{Op: fileOutboxAdd, Id: item.Id, Item: item})
+}
+
+func (f *FileOutbox) Done(id, messageId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.append(fileOutboxRecord{Op: fileOutboxDone, Id: id, MessageId: messageId})
+}
+
+func (f *FileOutbox) Fail(id, reason string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.append(fileOutboxRecord{Op: fileOutboxFail, Id: id, Reason: reason})
+}
+
+func (f *FileOutbox) Pending() ([]*OutboxItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	items := make([]*OutboxItem, 0, f.order.Len())
+	for el := f.order.Front(); el != nil; el = el.Next() {
+		items = append(items, el.Value.(*OutboxItem))
+	}
+	return items, nil
+}
+
+// Close closes the log file
+func (f *FileOutbox) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.log.close()
+}
@@ -0,0 +1,127 @@
+package messengerbot_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+// doneOutbox records the message ids its messages were marked done with
+type doneOutbox struct {
+	*messengerbot.FileOutbox
+	mu   sync.Mutex
+	mids []string
+}
+
+func (d *doneOutbox) Done(id, messageId string) error {
+	d.mu.Lock()
+	d.mids = append(d.mids, messageId)
+	d.mu.Unlock()
+	return d.FileOutbox.Done(id, messageId)
+}
+
+func TestOutbox(t *testing.T) {
+	// every seventh call fails with a temporary error, bad is not a valid recipient
+	api := newSendServer(func(recipient string, call int) int {
+		if recipient == "bad" {
+			return 100
+		}
+		if call%7 == 1 {
+			return 2
+		}
+		return 0
+	})
+	defer api.Close()
+	file, err := messengerbot.NewFileOutbox(filepath.Join(t.TempDir(), "outbox.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	o := &doneOutbox{FileOutbox: file}
+
+	w := newWebhook(t, api)
+	var mu sync.Mutex
+	var errs []error
+	w.ErrorHandler(func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	})
+	if err := w.UseOutbox(o, 3, 5, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	users := []string{"a", "b", "c", "d"}
+	for i := 0; i < 10; i++ {
+		for _, user := range users {
+			w.SendTextMessageByRecipientId(user, fmt.Sprint(i), nil, messengerbot.REGULAR)
+		}
+	}
+	w.SendTextMessageByRecipientId("bad", "never", nil, messengerbot.REGULAR)
+	if err := w.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}
+	for _, user := range users {
+		if texts := textsTo(api, user); !reflect.DeepEqual(texts, want) {
+			t.Errorf("%s received %q", user, texts)
+		}
+	}
+	mu.Lock()
+	var serr *messengerbot.SendError
+	if len(errs) != 1 || !errors.As(errs[0], &serr) || serr.Code != 100 {
+		t.Errorf("errors %v", errs)
+	}
+	mu.Unlock()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if pending, _ := o.Pending(); len(pending) != 0 || len(o.mids) != 40 || o.mids[0] == "" {
+		t.Errorf("%d pending, done with %q", len(pending), o.mids)
+	}
+}
+
+func TestOutboxResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.log")
+	down := newSendServer(func(string, int) int { return 2 })
+	defer down.Close()
+	o, err := messengerbot.NewFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := newWebhook(t, down)
+	w.UseOutbox(o, 2, 0, time.Millisecond)
+	for i := 0; i < 3; i++ {
+		w.Conversation("page", messengerbot.Sender{Id: "user"}, messengerbot.Recipient{Id: "page"}, time.Now()).ReplyText(fmt.Sprint(i))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := w.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v", err)
+	}
+	o.Close()
+
+	// the process restarts
+	up := newSendServer(func(string, int) int { return 0 })
+	defer up.Close()
+	if o, err = messengerbot.NewFileOutbox(path); err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	w = newWebhook(t, up)
+	w.UseOutbox(o, 2, 0, time.Millisecond)
+	w.Shutdown(context.Background())
+	if texts := textsTo(up, "user"); !reflect.DeepEqual(texts, []string{"0", "1", "2"}) {
+		t.Errorf("received %q after restart", texts)
+	}
+	if pending, _ := o.Pending(); len(pending) != 0 {
+		t.Errorf("%d pending after restart", len(pending))
+	}
+}
@@ -0,0 +1,161 @@
+package messengerbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFileOutbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.log")
+	o, err := NewFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []*OutboxItem
+	for i := 0; i < 3; i++ {
+		item := &OutboxItem{Id: fmt.Sprint(i), PageId: "page", Created: time.Now().UTC().Round(0),
+			Envelope: MessageEnvelope{Recipient: Recipient{Id: "user"}, Message: NewTextMessage(fmt.Sprint(i), nil)}}
+		items = append(items, item)
+		if err := o.Add(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.Done("0", "mid.1")
+	o.Fail("2", "blocked")
+	o.Close()
+	// a crash while appending
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"op":"done","id":"1"`)
+	f.Close()
+
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	o, err = NewFileOutbox(path)
+	log.SetOutput(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	pending, _ := o.Pending()
+	if len(pending) != 1 || !reflect.DeepEqual(pending[0], items[1]) {
+		t.Errorf("pending %+v", pending)
+	}
+}
+
+func TestFileOutboxFailedCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.log")
+	o, err := NewFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a directory is in the way of the compacted log
+	os.Mkdir(path+".tmp", 0700)
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	for i := 0; i < 100; i++ {
+		item := &OutboxItem{Id: fmt.Sprint(i), PageId: "page",
+			Envelope: MessageEnvelope{Recipient: Recipient{Id: "user"}, Message: NewTextMessage("hi", nil)}}
+		if err := o.Add(item); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.Done(item.Id, "mid"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log.SetOutput(out)
+	o.Close()
+
+	os.Remove(path + ".tmp")
+	o, err = NewFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if pending, _ := o.Pending(); len(pending) != 0 {
+		t.Errorf("%d messages pending", len(pending))
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	o, err := NewFileOutbox(filepath.Join(t.TempDir(), "outbox.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	w := NewMessengerWebhook("token", "token")
+	w.UseOutbox(o, 1, 0, 0)
+	defer w.Shutdown(context.Background())
+	if w.outbox.backoff != time.Second {
+		t.Errorf("backoff %v", w.outbox.backoff)
+	}
+}
+
+func TestOutboxUnreadableAnswer(t *testing.T) {
+	// the message is accepted but the answer cannot be decoded
+	var calls int32
+	api := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		fmt.Fprint(res, `{"recipient_id":`)
+	}))
+	defer api.Close()
+	o, err := NewFileOutbox(filepath.Join(t.TempDir(), "outbox.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(out)
+
+	w := NewMessengerWebhook("token", "token")
+	w.graphApiUrl = api.URL
+	var mu sync.Mutex
+	var errs []error
+	w.ErrorHandler(func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	})
+	w.UseOutbox(o, 1, 5, time.Millisecond)
+	w.SendTextMessageByRecipientId("user", "once", nil, REGULAR)
+	w.Shutdown(context.Background())
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 || len(errs) != 1 {
+		t.Errorf("sent %d times, errors %v", calls, errs)
+	}
+}
+
+func TestOutboxClosed(t *testing.T) {
+	o, err := NewFileOutbox(filepath.Join(t.TempDir(), "outbox.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	w := NewMessengerWebhook("token", "token")
+	var errs []error
+	w.ErrorHandler(func(err error) { errs = append(errs, err) })
+	w.UseOutbox(o, 1, 0, time.Millisecond)
+	w.Shutdown(context.Background())
+	w.SendTextMessageByRecipientId("user", "late", nil, REGULAR)
+	var oerr *OutboxError
+	if len(errs) != 1 || !errors.As(errs[0], &oerr) || !errors.Is(errs[0], ErrShuttingDown) ||
+		oerr.Item.Envelope.Message.Text != "late" {
+		t.Errorf("errors %v", errs)
+	}
+	if pending, _ := o.Pending(); len(pending) != 0 {
+		t.Errorf("%d pending", len(pending))
+	}
+}
@@ -0,0 +1,142 @@
+package messengerbot
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pacing is how fast a paced conversation types its replies
+type Pacing struct {
+	// WordsPerMinute is the typing speed, 200 words per minute when zero
+	WordsPerMinute float64
+	// MinDelay and MaxDelay bound the typing time of a reply. A zero MaxDelay does not bound it
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// MarkSeen marks the messages of users seen as soon as they are received, before they are handled
+	MarkSeen bool
+}
+
+// Delay returns how long typing the message takes. Messages without text, such as images, take MinDelay
+func (p Pacing) Delay(m *Message) time.Duration {
+	text := m.Text
+	if m.Attachment != nil {
+		if b, ok := m.Attachment.Payload.(ButtonTemplate); ok {
+			text = b.Text
+		}
+	}
+	wpm := p.WordsPerMinute
+	if wpm <= 0 {
+		wpm = 200
+	}
+	d := time.Duration(float64(len(strings.Fields(text))) / wpm * float64(time.Minute))
+	if d < p.MinDelay {
+		d = p.MinDelay
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// UsePacing makes conversations reply like a human typing: each reply is preceded by the typing indicator
+// for the time Pacing.Delay gives, and Messenger turns the indicator off when the reply arrives, or the
+// webhook does when the reply fails. Replies and sender actions are queued per user and sent in order in the
+// background, so handlers return right away and the replies to other users are not delayed
+func (w *Webhook) UsePacing(p Pacing) {
+	pc := new(pacer)
+	pc.w = w
+	pc.pacing = p
+	pc.queues = make(map[string]*pacedQueue)
+	w.pacer = pc
+	if p.MarkSeen {
+		w.Use(pc.markSeen)
+	}
+}
+
+// pacer sends the paced replies of every user, with a goroutine per user with replies waiting
+type pacer struct {
+	w      *Webhook
+	pacing Pacing
+	mu     sync.Mutex
+	queues map[string]*pacedQueue
+	wg     sync.WaitGroup
+}
+
+type pacedReply struct {
+	pageId   string
+	envelope MessageEnvelope
+}
+
+type pacedQueue struct {
+	replies []pacedReply
+}
+
+// send queues a reply or sender action for its recipient
+func (p *pacer) send(pageId string, envelope MessageEnvelope) {
+	key := sessionKey(pageId, envelope.Recipient.Id)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if q, ok := p.queues[key]; ok {
+		q.replies = append(q.replies, pacedReply{pageId, envelope})
+		return
+	}
+	q := &pacedQueue{replies: []pacedReply{{pageId, envelope}}}
+	p.queues[key] = q
+	p.wg.Add(1)
+	go p.drain(key, q)
+}
+
+func (p *pacer) drain(key string, q *pacedQueue) {
+	defer p.wg.Done()
+	for {
+		p.mu.Lock()
+		if len(q.replies) == 0 {
+			delete(p.queues, key)
+			p.mu.Unlock()
+			return
+		}
+		r := q.replies[0]
+		q.replies = q.replies[1:]
+		p.mu.Unlock()
+
+		typing := false
+		if m := r.envelope.Message; m != nil {
+			if d := p.pacing.Delay(m); d > 0 {
+				p.w.callSendApiForPage(r.pageId, MessageEnvelope{Recipient: r.envelope.Recipient, SenderAction: TYPING_ON})
+				typing = true
+				time.Sleep(d)
+			}
+		}
+		// the outbox turns the indicator off when the reply fails for good
+		if p.w.outbox != nil {
+			p.w.outbox.add(r.pageId, r.envelope)
+			continue
+		}
+		if _, err := p.w.SendMessage(context.Background(), r.pageId, r.envelope); err != nil {
+			log.Println("warning: send api call failed :", err)
+			if typing {
+				p.sendAction(r.pageId, r.envelope.Recipient, TYPING_OFF)
+			}
+		}
+	}
+}
+
+// sendAction sends a sender action right away, without queueing it
+func (p *pacer) sendAction(pageId string, r Recipient, action SenderActionType) {
+	if _, err := p.w.SendMessage(context.Background(), pageId, MessageEnvelope{Recipient: r, SenderAction: action}); err != nil {
+		log.Println("warning: send api call failed :", err)
+	}
+}
+
+// markSeen marks the messages of users seen before they are handled, ahead of the replies queued for them
+func (p *pacer) markSeen(next EventHandler) EventHandler {
+	return func(e *Event) bool {
+		if e.Type == MESSAGE_EVENT || e.Type == ATTACHMENT_EVENT {
+			p.sendAction(e.PageId, Recipient{Id: e.Sender.Id}, MARK_SEEN)
+		}
+		return next(e)
+	}
+}
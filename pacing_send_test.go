@@ -0,0 +1,96 @@
+package messengerbot_test
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+	"github.com/vimukthi-git/messengerbot/messengertest"
+)
+
+func TestPacing(t *testing.T) {
+	s := newSendServer(func(string, int) int { return 0 })
+	defer s.Close()
+	w := newWebhook(t, s)
+	// 20ms per word
+	w.UsePacing(messengerbot.Pacing{WordsPerMinute: 3000, MinDelay: 40 * time.Millisecond, MarkSeen: true})
+	w.ConversationMessageHandler(func(c *messengerbot.Conversation, m messengerbot.IncomingTextMessage) bool {
+		c.ReplyText("one two three")
+		c.ReplyText(m.Text)
+		return true
+	})
+	client := messengertest.NewClient(w, "page")
+	start := time.Now()
+	client.Text("a", "a")
+	client.Text("b", "b")
+	if elapsed := time.Since(start); elapsed > 30*time.Millisecond {
+		t.Errorf("handling took %v", elapsed)
+	}
+	w.Shutdown(context.Background())
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("replies took %v", elapsed)
+	}
+
+	sent := make(map[string][]string)
+	var order []string
+	for _, e := range s.Sent() {
+		what := string(e.SenderAction)
+		if e.Message != nil {
+			what = e.Message.DisplayText()
+			order = append(order, e.Recipient.Id+" "+what)
+		}
+		sent[e.Recipient.Id] = append(sent[e.Recipient.Id], what)
+	}
+	for _, user := range []string{"a", "b"} {
+		want := []string{"mark_seen", "typing_on", "one two three", "typing_on", user}
+		if !reflect.DeepEqual(sent[user], want) {
+			t.Errorf("%s was sent %q", user, sent[user])
+		}
+	}
+	// the users were answered at the same time
+	if len(order) != 4 || order[0][2:] != "one two three" || order[1][2:] != "one two three" {
+		t.Errorf("replies sent in order %q", order)
+	}
+}
+
+func TestPacingFailure(t *testing.T) {
+	// the replies are rejected, the sender actions accepted
+	send := sendResponder(func(string, int) int { return 0 })
+	s := messengertest.NewServer()
+	s.Respond(messengertest.SEND_CALL, func(c *messengertest.Call) (int, interface{}) {
+		if e, err := c.Envelope(); err == nil && e.Message != nil {
+			return http.StatusBadRequest, map[string]messengertest.GraphError{"error": {Message: "failed", Type: "OAuthException", Code: 100}}
+		}
+		return send(c)
+	})
+	defer s.Close()
+	w := newWebhook(t, s)
+	w.UsePacing(messengerbot.Pacing{MinDelay: time.Millisecond, MarkSeen: true})
+	seen := make(chan []*messengertest.Envelope, 1)
+	w.ConversationMessageHandler(func(c *messengerbot.Conversation, m messengerbot.IncomingTextMessage) bool {
+		seen <- s.Sent()
+		c.ReplyText("hello")
+		return true
+	})
+	messengertest.NewClient(w, "page").Text("a", "hi")
+	w.Shutdown(context.Background())
+
+	// the message is marked seen before it is handled
+	if sent := <-seen; len(sent) != 1 || sent[0].SenderAction != messengerbot.MARK_SEEN {
+		t.Errorf("sent %+v before handling", sent)
+	}
+	var sent []string
+	for _, e := range s.Sent() {
+		what := string(e.SenderAction)
+		if e.Message != nil {
+			what = e.Message.DisplayText()
+		}
+		sent = append(sent, what)
+	}
+	if want := []string{"mark_seen", "typing_on", "hello", "typing_off"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent %q", sent)
+	}
+}
@@ -0,0 +1,28 @@
+package messengerbot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacingDelay(t *testing.T) {
+	p := Pacing{WordsPerMinute: 60, MinDelay: time.Second, MaxDelay: 5 * time.Second}
+	cases := []struct {
+		m     *Message
+		delay time.Duration
+	}{
+		{NewTextMessage("Hi", nil), time.Second},
+		{NewTextMessage("How are you today?", nil), 4 * time.Second},
+		{NewTextMessage("This reply is far too long to type at one word per second", nil), 5 * time.Second},
+		{NewButtonMessage("Pick one of these", nil, nil), 4 * time.Second},
+		{NewImageMessage("https://example.com/cat.png", nil), time.Second},
+	}
+	for _, c := range cases {
+		if d := p.Delay(c.m); d != c.delay {
+			t.Errorf("%+v takes %v, want %v", c.m, d, c.delay)
+		}
+	}
+	if d := (Pacing{}).Delay(NewTextMessage("ten words take three seconds at the default speed okay", nil)); d != 3*time.Second {
+		t.Errorf("default pacing takes %v", d)
+	}
+}
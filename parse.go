@@ -0,0 +1,186 @@
+package messengerbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+)
+
+// ParseError is a webhook request body, or a messaging event in it, which cannot be handled
+type ParseError struct {
+	// Data is the request body, or the JSON of the messaging event
+	Data []byte
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return "messengerbot: " + e.Msg
+}
+
+type webhookRequest struct {
+	Object string `json:"object"`
+	Entry  []struct {
+		Id        string            `json:"id"`
+		Messaging []json.RawMessage `json:"messaging"`
+	} `json:"entry"`
+}
+
+type participant struct {
+	Id string `json:"id"`
+}
+
+// messagingEvent is the union of the messaging events the webhook handles. Pointers tell missing fields
+// from zero values
+type messagingEvent struct {
+	Sender    *participant `json:"sender"`
+	Recipient *participant `json:"recipient"`
+	Timestamp float64      `json:"timestamp"`
+	Optin     *EventOptin  `json:"optin"`
+	Message   *struct {
+		Mid        *string  `json:"mid"`
+		Seq        *float64 `json:"seq"`
+		Text       *string  `json:"text"`
+		QuickReply *struct {
+			Payload string `json:"payload"`
+		} `json:"quick_reply"`
+		Attachments []struct {
+			Type    *string `json:"type"`
+			Payload *struct {
+				Url         *string      `json:"url"`
+				Coordinates *Coordinates `json:"coordinates"`
+			} `json:"payload"`
+		} `json:"attachments"`
+	} `json:"message"`
+	Delivery *struct {
+		Mids      []*string `json:"mids"`
+		Watermark *float64  `json:"watermark"`
+		Seq       *float64  `json:"seq"`
+	} `json:"delivery"`
+	Postback *struct {
+		Payload *string `json:"payload"`
+	} `json:"postback"`
+}
+
+// parseRequest parses every JSON document of a webhook request body into events. A body which is not a
+// sequence of JSON objects is an error; messaging events which cannot be parsed are reported to the error
+// callback and left out
+func (w *Webhook) parseRequest(body io.Reader) ([]*Event, error) {
+	var events []*Event
+	dec := json.NewDecoder(body)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return nil, &ParseError{Data: raw, Msg: "invalid request body: " + err.Error()}
+		}
+		var d webhookRequest
+		if err := json.Unmarshal(raw, &d); err != nil {
+			return nil, &ParseError{Data: raw, Msg: "invalid request body: " + err.Error()}
+		}
+		if d.Object != "page" {
+			log.Println("ignoring update of object : ", d.Object)
+			continue
+		}
+		for _, entry := range d.Entry {
+			for _, data := range entry.Messaging {
+				parsed, err := parseMessagingEvent(entry.Id, data)
+				if err != nil {
+					w.errorCallback(&ParseError{Data: data, Msg: err.Error()})
+					continue
+				}
+				events = append(events, parsed...)
+			}
+		}
+	}
+}
+
+// parseMessagingEvent parses a messaging event of the given page. Messages with several attachments become
+// one event each, while a delivery of several mids is a single event
+func parseMessagingEvent(pageId string, data []byte) ([]*Event, error) {
+	var m messagingEvent
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid messaging event: %v", err)
+	}
+	if m.Sender == nil || m.Sender.Id == "" || m.Recipient == nil || m.Recipient.Id == "" {
+		return nil, fmt.Errorf("messaging event without sender or recipient")
+	}
+	event := func(t EventType) *Event {
+		return &Event{Type: t, PageId: pageId, Sender: Sender{m.Sender.Id}, Recipient: Recipient{Id: m.Recipient.Id},
+			Timestamp: msToTime(int64(m.Timestamp))}
+	}
+
+	switch {
+	case m.Optin != nil:
+		e := event(OPTIN_EVENT)
+		e.Optin = m.Optin
+		e.dedupKey = fmt.Sprintf("optin:%s:%s:%d:%s", pageId, m.Sender.Id, int64(m.Timestamp), m.Optin.Ref)
+		return []*Event{e}, nil
+
+	case m.Message != nil:
+		msg := m.Message
+		if msg.Mid == nil || msg.Seq == nil {
+			return nil, fmt.Errorf("message without mid or seq")
+		}
+		if len(msg.Attachments) == 0 {
+			if msg.Text == nil {
+				return nil, fmt.Errorf("message %s has neither text nor attachments", *msg.Mid)
+			}
+			e := event(MESSAGE_EVENT)
+			e.Message = &IncomingTextMessage{Mid: *msg.Mid, Seq: *msg.Seq, Text: *msg.Text}
+			e.dedupKey = "mid:" + *msg.Mid
+			if msg.QuickReply != nil {
+				e.Message.QuickReply = &QuickReply{Payload: msg.QuickReply.Payload}
+			}
+			return []*Event{e}, nil
+		}
+		var events []*Event
+		for i, a := range msg.Attachments {
+			// location attachments carry coordinates instead of a url
+			if a.Type == nil || a.Payload == nil || (a.Payload.Url == nil && a.Payload.Coordinates == nil) {
+				return nil, fmt.Errorf("attachment of message %s without type, url or coordinates", *msg.Mid)
+			}
+			e := event(ATTACHMENT_EVENT)
+			e.Attachment = &IncomingAttachmentMessage{Mid: *msg.Mid, Seq: *msg.Seq, AttachmentType: *a.Type,
+				Coordinates: a.Payload.Coordinates}
+			if a.Payload.Url != nil {
+				e.Attachment.AttachmentUrl = *a.Payload.Url
+			}
+			e.dedupKey = fmt.Sprintf("mid:%s#%d", *msg.Mid, i)
+			events = append(events, e)
+		}
+		return events, nil
+
+	case m.Delivery != nil:
+		del := m.Delivery
+		if del.Watermark == nil || del.Seq == nil || del.Mids == nil {
+			return nil, fmt.Errorf("delivery without mids, watermark or seq")
+		}
+		e := event(DELIVERY_EVENT)
+		e.Delivery = &EventDelivery{Mids: []string{}, Watermark: *del.Watermark, Seq: *del.Seq}
+		for _, mid := range del.Mids {
+			if mid == nil {
+				return nil, fmt.Errorf("delivery with a null mid")
+			}
+			e.Delivery.Mids = append(e.Delivery.Mids, *mid)
+		}
+		if len(e.Delivery.Mids) > 0 {
+			e.Delivery.Mid = e.Delivery.Mids[0]
+		}
+		e.dedupKey = fmt.Sprintf("delivery:%s:%s:%d", pageId, m.Sender.Id, int64(*del.Watermark))
+		return []*Event{e}, nil
+
+	case m.Postback != nil:
+		if m.Postback.Payload == nil {
+			return nil, fmt.Errorf("postback without payload")
+		}
+		e := event(POSTBACK_EVENT)
+		e.Postback = &EventPostback{Payload: *m.Postback.Payload}
+		e.dedupKey = fmt.Sprintf("postback:%s:%s:%d:%s", pageId, m.Sender.Id, int64(m.Timestamp), *m.Postback.Payload)
+		return []*Event{e}, nil
+	}
+	log.Println("unknown event : ", string(bytes.TrimSpace(data)))
+	return nil, nil
+}
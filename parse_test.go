@@ -0,0 +1,181 @@
+package messengerbot
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordingWebhook returns a webhook recording a line per handled event and the errors it reports
+func recordingWebhook() (*Webhook, *[]string, *[]error) {
+	var handled []string
+	var errors []error
+	w := NewMessengerWebhook("token", "token")
+	w.ErrorHandler(func(err error) { errors = append(errors, err) })
+	w.Use(func(next EventHandler) EventHandler {
+		return func(e *Event) bool {
+			line := fmt.Sprintf("%s %s>%s", e.Type, e.Sender.Id, e.PageId)
+			switch e.Type {
+			case MESSAGE_EVENT:
+				line += " " + e.Message.Text
+				if e.Message.QuickReply != nil {
+					line += " " + e.Message.QuickReply.Payload
+				}
+			case ATTACHMENT_EVENT:
+				line += " " + e.Attachment.AttachmentType + " " + e.Attachment.AttachmentUrl
+				if c := e.Attachment.Coordinates; c != nil {
+					line += fmt.Sprintf("%v,%v", c.Lat, c.Long)
+				}
+			case DELIVERY_EVENT:
+				line += " " + strings.Join(e.Delivery.Mids, ",")
+			case POSTBACK_EVENT:
+				line += " " + e.Postback.Payload
+			case OPTIN_EVENT:
+				line += " " + e.Optin.Ref
+			}
+			handled = append(handled, line)
+			return true
+		}
+	})
+	return w, &handled, &errors
+}
+
+func post(w *Webhook, body string) int {
+	res := httptest.NewRecorder()
+	w.Handler(res, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body)))
+	return res.Code
+}
+
+func TestParseSamples(t *testing.T) {
+	want := map[string][]string{
+		"text.json":        {"message USER_ID>PAGE_ID hello, world!"},
+		"quick_reply.json": {"message USER_ID>PAGE_ID Red DEVELOPER_DEFINED_PAYLOAD_FOR_PICKING_RED"},
+		"attachments.json": {"attachment USER_ID>PAGE_ID image IMAGE_URL", "attachment USER_ID>PAGE_ID file FILE_URL"},
+		"location.json":    {"attachment USER_ID>PAGE_ID location 37.483872693672,-122.14900441942"},
+		"delivery.json": {
+			"delivery USER_ID>PAGE_ID mid.1458668856218:ed81099e15d3f4f233,mid.1458668856219:ed81099e15d3f4f234"},
+		"postback.json": {"postback USER_ID>PAGE_ID USER_DEFINED_PAYLOAD"},
+		"optin.json":    {"optin USER_ID>PAGE_ID PASS_THROUGH_PARAM"},
+		"batch.json": {"message USER_ID>PAGE_ID one", "message OTHER_ID>PAGE_ID two",
+			"postback USER_ID>OTHER_PAGE_ID START"},
+	}
+	for name, events := range want {
+		body, err := ioutil.ReadFile(filepath.Join("testdata", "webhook", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, handled, errors := recordingWebhook()
+		if code := post(w, string(body)); code != http.StatusOK || len(*errors) > 0 {
+			t.Errorf("%s answered %d, errors %v", name, code, *errors)
+		}
+		if !reflect.DeepEqual(*handled, events) {
+			t.Errorf("%s handled %q, want %q", name, *handled, events)
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	event := func(fields string) string {
+		return `{"object":"page","entry":[{"id":"page","messaging":[{"sender":{"id":"user"},"recipient":{"id":"page"},
+			"timestamp":1458692752478,` + fields + `},{"sender":{"id":"user"},"recipient":{"id":"page"},
+			"message":{"mid":"mid.2","seq":2,"text":"still handled"}}]}]}`
+	}
+	cases := []struct {
+		body   string
+		code   int
+		errors int
+	}{
+		{``, http.StatusOK, 0},
+		{`{`, http.StatusBadRequest, 1},
+		{`[1, 2]`, http.StatusBadRequest, 1},
+		{`{"object":"page","entry":{}}`, http.StatusBadRequest, 1},
+		{`{"object":"page","entry":[{"id":1}]}`, http.StatusBadRequest, 1},
+		{`{"object":"page","entry":[{"id":"page"}]} garbage`, http.StatusBadRequest, 1},
+		{`{"object":"user","entry":[{"id":"page","messaging":[{}]}]}`, http.StatusOK, 0},
+		{`{"object":"page","entry":[null,{"id":"page","messaging":[null]}]}`, http.StatusOK, 1},
+		{event(`"message":{"mid":"mid.1","seq":1}`), http.StatusOK, 1},
+		{event(`"message":{"mid":"mid.1","text":"no seq"}`), http.StatusOK, 1},
+		{event(`"message":{"mid":"mid.1","seq":"1","text":"string seq"}`), http.StatusOK, 1},
+		{event(`"message":{"mid":"mid.1","seq":1,"attachments":[{"type":"image"}]}`), http.StatusOK, 1},
+		{event(`"message":{"mid":"mid.1","seq":1,"attachments":[{"payload":{"url":"u"}}]}`), http.StatusOK, 1},
+		{event(`"message":null`), http.StatusOK, 0},
+		{event(`"delivery":{"mids":"mid.1","watermark":1,"seq":1}`), http.StatusOK, 1},
+		{event(`"delivery":{"mids":[null],"watermark":1,"seq":1}`), http.StatusOK, 1},
+		{event(`"delivery":{"mids":["mid.1"],"seq":1}`), http.StatusOK, 1},
+		{event(`"postback":{}`), http.StatusOK, 1},
+		{event(`"postback":"payload"`), http.StatusOK, 1},
+		{event(`"optin":[]`), http.StatusOK, 1},
+		{`{"object":"page","entry":[{"id":"page","messaging":[{"recipient":{"id":"page"},"postback":{"payload":"x"}}]}]}`,
+			http.StatusOK, 1},
+	}
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(out)
+	for _, c := range cases {
+		w, handled, errors := recordingWebhook()
+		code := post(w, c.body)
+		if code != c.code || len(*errors) != c.errors {
+			t.Errorf("%s\nanswered %d with errors %v, want %d with %d errors", c.body, code, *errors, c.code, c.errors)
+		}
+		if strings.Contains(c.body, "still handled") && !reflect.DeepEqual(*handled, []string{"message user>page still handled"}) {
+			t.Errorf("%s\nhandled %q", c.body, *handled)
+		}
+	}
+
+	w, handled, errs := recordingWebhook()
+	w.SetMaxBodySize(100)
+	if code := post(w, event(`"message":{"mid":"mid.1","seq":1,"text":"too long"}`)); code != http.StatusRequestEntityTooLarge ||
+		len(*handled) != 0 || len(*errs) != 1 || !errors.Is((*errs)[0], ErrBodyTooLarge) {
+		t.Errorf("long body answered %d, handled %q, errors %v", code, *handled, *errs)
+	}
+
+	res := httptest.NewRecorder()
+	w.Handler(res, httptest.NewRequest(http.MethodPut, "/webhook", nil))
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT answered %d", res.Code)
+	}
+}
+
+// FuzzHandler checks no request body makes the handler panic, and that it only answers 200 or 400. The
+// corpus is seeded with the samples in testdata/webhook
+func FuzzHandler(f *testing.F) {
+	samples, _ := filepath.Glob(filepath.Join("testdata", "webhook", "*.json"))
+	for _, path := range samples {
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(body)
+	}
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(out)
+	f.Fuzz(func(t *testing.T, body []byte) {
+		w, _, _ := recordingWebhook()
+		res := httptest.NewRecorder()
+		w.Handler(res, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(string(body))))
+		if res.Code != http.StatusOK && res.Code != http.StatusBadRequest {
+			t.Errorf("answered %d", res.Code)
+		}
+	})
+}
+
+func TestOptinHandler(t *testing.T) {
+	w := NewMessengerWebhook("token", "token")
+	optins := 0
+	w.OptinHandler(func() string {
+		optins++
+		return ""
+	})
+	postMessagingEvent(w, "page", "user", `"optin":{"ref":"PASS_THROUGH_PARAM"}`)
+	if optins != 1 {
+		t.Errorf("optin callback called %d times", optins)
+	}
+}
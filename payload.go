@@ -0,0 +1,164 @@
+package messengerbot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// MaxPayloadLength is the maximum number of characters Messenger accepts in a postback or quick reply payload
+const MaxPayloadLength = 1000
+
+var (
+	ErrPayloadTooLong = errors.New("messengerbot: payload longer than 1000 characters")
+	ErrInvalidPayload = errors.New("messengerbot: invalid action payload")
+)
+
+type jsonPayload struct {
+	Action string            `json:"action"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// EncodePayload encodes an action name and its parameters in the compact form "action?key=value&..."
+func EncodePayload(action string, params map[string]string) (string, error) {
+	if action == "" {
+		return "", ErrInvalidPayload
+	}
+	payload := url.QueryEscape(action)
+	if len(params) > 0 {
+		values := url.Values{}
+		for k, v := range params {
+			values.Set(k, v)
+		}
+		payload += "?" + values.Encode()
+	}
+	return checkPayloadLength(payload)
+}
+
+// EncodeJSONPayload encodes an action name and its parameters as a JSON object
+func EncodeJSONPayload(action string, params map[string]string) (string, error) {
+	if action == "" {
+		return "", ErrInvalidPayload
+	}
+	b, err := json.Marshal(jsonPayload{action, params})
+	if err != nil {
+		return "", err
+	}
+	return checkPayloadLength(string(b))
+}
+
+// DecodePayload decodes a payload produced by EncodePayload or EncodeJSONPayload
+func DecodePayload(payload string) (string, map[string]string, error) {
+	params := make(map[string]string)
+	if strings.HasPrefix(payload, "{") {
+		var p jsonPayload
+		if err := json.Unmarshal([]byte(payload), &p); err != nil || p.Action == "" {
+			return "", nil, ErrInvalidPayload
+		}
+		for k, v := range p.Params {
+			params[k] = v
+		}
+		return p.Action, params, nil
+	}
+
+	rawAction, rawQuery := payload, ""
+	if i := strings.Index(payload, "?"); i >= 0 {
+		rawAction, rawQuery = payload[:i], payload[i+1:]
+	}
+	action, err := url.QueryUnescape(rawAction)
+	if err != nil || action == "" {
+		return "", nil, ErrInvalidPayload
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", nil, ErrInvalidPayload
+	}
+	for k := range values {
+		params[k] = values.Get(k)
+	}
+	return action, params, nil
+}
+
+func checkPayloadLength(payload string) (string, error) {
+	if utf8.RuneCountInString(payload) > MaxPayloadLength {
+		return "", fmt.Errorf("%w: %d characters", ErrPayloadTooLong, utf8.RuneCountInString(payload))
+	}
+	return payload, nil
+}
+
+// NewActionButton creates a postback button carrying the encoded action
+func NewActionButton(title, action string, params map[string]string) (Button, error) {
+	payload, err := EncodePayload(action, params)
+	if err != nil {
+		return Button{}, err
+	}
+	return Button{Type: POSTBACK, Title: title, Payload: payload}, nil
+}
+
+// NewActionQuickReply creates a text quick reply carrying the encoded action
+func NewActionQuickReply(title, action string, params map[string]string) (QuickReply, error) {
+	payload, err := EncodePayload(action, params)
+	if err != nil {
+		return QuickReply{}, err
+	}
+	return QuickReply{ContentType: TEXT, Title: title, Payload: payload}, nil
+}
+
+// ActionCallback handles a postback or quick reply whose payload decoded to a registered action
+type ActionCallback func(c *Conversation, action string, params map[string]string) bool
+
+// Dispatcher routes postbacks and quick replies to the handler registered for the action encoded in their
+// payload. Payloads which do not decode, or whose action has no handler, go to the postback or text
+// message callbacks as before
+type Dispatcher struct {
+	webhook *Webhook
+	mu      sync.RWMutex
+	actions map[string]ActionCallback
+}
+
+// NewDispatcher creates a dispatcher and attaches it to the given webhook
+func NewDispatcher(w *Webhook) *Dispatcher {
+	d := new(Dispatcher)
+	d.webhook = w
+	d.actions = make(map[string]ActionCallback)
+	w.dispatcher = d
+	return d
+}
+
+// Action registers the handler for the given action name
+func (d *Dispatcher) Action(action string, cb ActionCallback) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.actions[action] = cb
+}
+
+// Actions returns the names of the registered actions
+func (d *Dispatcher) Actions() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	actions := make([]string, 0, len(d.actions))
+	for action := range d.actions {
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+// dispatch calls the handler of the action encoded in payload. The second return value is false when
+// the payload does not name a registered action
+func (d *Dispatcher) dispatch(e *Event, payload string) (bool, bool) {
+	action, params, err := DecodePayload(payload)
+	if err != nil {
+		return false, false
+	}
+	d.mu.RLock()
+	cb, ok := d.actions[action]
+	d.mu.RUnlock()
+	if !ok {
+		return false, false
+	}
+	return cb(e.Conversation(), action, params), true
+}
@@ -0,0 +1,77 @@
+package messengerbot
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPayloadRoundTrip(t *testing.T) {
+	params := map[string]string{"id": "42", "page": "2", "note": "a&b=c?"}
+	for name, encode := range map[string]func(string, map[string]string) (string, error){
+		"compact": EncodePayload,
+		"json":    EncodeJSONPayload,
+	} {
+		payload, err := encode("BUY NOW", params)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		action, decoded, err := DecodePayload(payload)
+		if err != nil {
+			t.Fatalf("%s: decode %q: %v", name, payload, err)
+		}
+		if action != "BUY NOW" || !reflect.DeepEqual(decoded, params) {
+			t.Errorf("%s: decoded %q %v, want %q %v", name, action, decoded, "BUY NOW", params)
+		}
+	}
+
+	if _, _, err := DecodePayload("{not json"); err != ErrInvalidPayload {
+		t.Errorf("decode invalid json: err = %v", err)
+	}
+	if _, err := EncodePayload("", nil); err != ErrInvalidPayload {
+		t.Errorf("encode empty action: err = %v", err)
+	}
+	if _, err := EncodePayload("LONG", map[string]string{"v": strings.Repeat("x", MaxPayloadLength)}); !errors.Is(err, ErrPayloadTooLong) {
+		t.Errorf("encode long payload: err = %v", err)
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	w := NewMessengerWebhook("token", "token")
+	d := NewDispatcher(w)
+	var got string
+	var gotParams map[string]string
+	d.Action("BUY", func(c *Conversation, action string, params map[string]string) bool {
+		got = action
+		gotParams = params
+		return true
+	})
+	w.MessageHandler(func(pageId string, s Sender, r Recipient, t time.Time, m IncomingTextMessage) bool {
+		got = "message"
+		return true
+	})
+	w.PostbackHandler(func(pageId string, s Sender, r Recipient, t time.Time, e EventPostback) bool {
+		got = "postback"
+		return true
+	})
+
+	button, _ := NewActionButton("Buy", "BUY", map[string]string{"id": "7"})
+	postMessagingEvent(w, "page", "user", `"postback":{"payload":"`+button.Payload+`"}`)
+	if got != "BUY" || gotParams["id"] != "7" {
+		t.Errorf("postback dispatched to %q %v", got, gotParams)
+	}
+
+	reply, _ := NewActionQuickReply("Buy", "BUY", map[string]string{"id": "8"})
+	postMessagingEvent(w, "page", "user",
+		`"message":{"mid":"mid.1","seq":1,"text":"Buy","quick_reply":{"payload":"`+reply.Payload+`"}}`)
+	if got != "BUY" || gotParams["id"] != "8" {
+		t.Errorf("quick reply dispatched to %q %v", got, gotParams)
+	}
+
+	postMessagingEvent(w, "page", "user", `"postback":{"payload":"SELL?id=1"}`)
+	if got != "postback" {
+		t.Errorf("unknown action dispatched to %q, want postback callback", got)
+	}
+}
@@ -0,0 +1,133 @@
+package messengerbot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// UserProfile is the public profile of a user as returned by the User Profile API
+// https://developers.facebook.com/docs/messenger-platform/user-profile
+type UserProfile struct {
+	FirstName  string  `json:"first_name,omitempty"`
+	LastName   string  `json:"last_name,omitempty"`
+	ProfilePic string  `json:"profile_pic,omitempty"`
+	Locale     string  `json:"locale,omitempty"`
+	Timezone   float64 `json:"timezone,omitempty"`
+	Gender     string  `json:"gender,omitempty"`
+}
+
+// profileFields are the fields of the profile of users asked for
+const profileFields = "first_name,last_name,profile_pic,locale,timezone,gender"
+
+// profileLookupTimeout bounds profile lookups, which hold up the events of the users looked up
+const profileLookupTimeout = 10 * time.Second
+
+var profileClient = &http.Client{Timeout: profileLookupTimeout}
+
+// GetUserProfile fetches the profile of the user identified by psid using the access token of the given page,
+// giving up after 10 seconds
+func (w *Webhook) GetUserProfile(pageId, psid string) (*UserProfile, error) {
+	return w.getUserProfile(context.Background(), pageId, psid)
+}
+
+func (w *Webhook) getUserProfile(ctx context.Context, pageId, psid string) (*UserProfile, error) {
+	url := w.graphApiUrl + "/" + psid + "?fields=" + profileFields + "&access_token=" + w.accessTokenForPage(pageId)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := profileClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("messengerbot: user profile request failed with status %s", resp.Status)
+	}
+	profile := new(UserProfile)
+	if err := json.NewDecoder(resp.Body).Decode(profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// profileLoader fetches the profiles asked for by concurrent lookups together. A lookup is made right away
+// when no other lookup of the page is being made, and the lookups asked for meanwhile are then made in a
+// single batch request. Each request gives up after timeout, so a request which hangs does not hold up the
+// lookups of the page for good
+type profileLoader struct {
+	w       *Webhook
+	timeout time.Duration
+	mu      sync.Mutex
+	pending map[string][]*profileLookup
+}
+
+type profileLookup struct {
+	psid    string
+	profile *UserProfile
+	err     error
+	done    chan struct{}
+}
+
+func newProfileLoader(w *Webhook) *profileLoader {
+	l := new(profileLoader)
+	l.w = w
+	l.timeout = profileLookupTimeout
+	l.pending = make(map[string][]*profileLookup)
+	return l
+}
+
+// get returns the profile of the user of the page, once it is fetched
+func (l *profileLoader) get(pageId, psid string) (*UserProfile, error) {
+	lookup := &profileLookup{psid: psid, done: make(chan struct{})}
+	l.mu.Lock()
+	lookups, loading := l.pending[pageId]
+	l.pending[pageId] = append(lookups, lookup)
+	l.mu.Unlock()
+	if !loading {
+		go l.load(pageId)
+	}
+	<-lookup.done
+	return lookup.profile, lookup.err
+}
+
+// load fetches the profiles of the lookups of the page until there are none left
+func (l *profileLoader) load(pageId string) {
+	for {
+		l.mu.Lock()
+		lookups := l.pending[pageId]
+		if len(lookups) == 0 {
+			delete(l.pending, pageId)
+			l.mu.Unlock()
+			return
+		}
+		if len(lookups) > maxBatchSize {
+			lookups = lookups[:maxBatchSize]
+		}
+		// the page stays pending, marking its lookups as being made
+		l.pending[pageId] = l.pending[pageId][len(lookups):]
+		l.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+		if len(lookups) == 1 {
+			lookups[0].profile, lookups[0].err = l.w.getUserProfile(ctx, pageId, lookups[0].psid)
+		} else {
+			psids := make([]string, len(lookups))
+			for i, lookup := range lookups {
+				psids[i] = lookup.psid
+			}
+			profiles, errs := l.w.GetUserProfiles(ctx, pageId, psids)
+			for i, lookup := range lookups {
+				lookup.profile, lookup.err = profiles[i], errs[i]
+			}
+		}
+		cancel()
+		for _, lookup := range lookups {
+			close(lookup.done)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package messengerbot
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// RateLimitPolicy is what the send path does with a message sent faster than the rate limits allow
+type RateLimitPolicy string
+
+const (
+	// WAIT_WHEN_LIMITED waits until the message can be sent, failing only when the wait would go past the
+	// deadline of the context
+	WAIT_WHEN_LIMITED RateLimitPolicy = "wait"
+	// FAIL_WHEN_LIMITED fails with ErrRateLimited instead of waiting
+	FAIL_WHEN_LIMITED RateLimitPolicy = "fail"
+)
+
+var ErrRateLimited = errors.New("messengerbot: send rate limit exceeded")
+
+// Rate is a number of calls per second, allowing bursts of up to Burst calls. The zero Rate is unlimited
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// RateLimiterStats counts the calls which went through a rate limiter and how long they waited
+type RateLimiterStats struct {
+	Calls     int64
+	Waited    int64
+	Rejected  int64
+	TotalWait time.Duration
+	MaxWait   time.Duration
+}
+
+// AverageWait returns the average wait of the calls which went through
+func (s RateLimiterStats) AverageWait() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.TotalWait / time.Duration(s.Calls)
+}
+
+// RateLimiter is a token bucket rate limiter for the Send API, with a bucket for all the calls, one per
+// page and one per recipient. A call takes a token from each of its buckets
+type RateLimiter struct {
+	mu           sync.Mutex
+	perPage      Rate
+	perRecipient Rate
+	policy       RateLimitPolicy
+	all          *bucket
+	pages        map[string]*bucket
+	recipients   map[string]*bucket
+	stats        RateLimiterStats
+}
+
+// NewRateLimiter creates a rate limiter with the given global, per page and per recipient rates
+func NewRateLimiter(global, perPage, perRecipient Rate, policy RateLimitPolicy) *RateLimiter {
+	l := new(RateLimiter)
+	l.perPage = perPage
+	l.perRecipient = perRecipient
+	l.policy = policy
+	l.all = newBucket(global, time.Now())
+	l.pages = make(map[string]*bucket)
+	l.recipients = make(map[string]*bucket)
+	return l
+}
+
+// UseRateLimiter makes the webhook wait for the rate limiter before every call to the Send API
+func (w *Webhook) UseRateLimiter(l *RateLimiter) {
+	w.rateLimiter = l
+}
+
+// Wait waits until a message to the recipient can be sent on the page. It returns ErrRateLimited without
+// waiting when the policy is FAIL_WHEN_LIMITED or the wait would go past the deadline of ctx, and ctx.Err()
+// when ctx is done while waiting
+func (l *RateLimiter) Wait(ctx context.Context, pageId, recipient string) error {
+	now := time.Now()
+	l.mu.Lock()
+	buckets := []*bucket{l.all, l.bucketOf(l.pages, pageId, l.perPage, now),
+		l.bucketOf(l.recipients, sessionKey(pageId, recipient), l.perRecipient, now)}
+	var wait time.Duration
+	for _, b := range buckets {
+		if d := b.take(now); d > wait {
+			wait = d
+		}
+	}
+	deadline, ok := ctx.Deadline()
+	if wait > 0 && (l.policy == FAIL_WHEN_LIMITED || (ok && now.Add(wait).After(deadline))) {
+		for _, b := range buckets {
+			b.give()
+		}
+		l.stats.Rejected++
+		l.mu.Unlock()
+		return ErrRateLimited
+	}
+	l.stats.Calls++
+	if wait > 0 {
+		l.stats.Waited++
+		l.stats.TotalWait += wait
+		if wait > l.stats.MaxWait {
+			l.stats.MaxWait = wait
+		}
+	}
+	l.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		for _, b := range buckets {
+			b.give()
+		}
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Stats returns the counts of the calls which went through the rate limiter
+func (l *RateLimiter) Stats() RateLimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
+
+// bucketOf returns the bucket of key, forgetting full buckets when there are many
+func (l *RateLimiter) bucketOf(buckets map[string]*bucket, key string, r Rate, now time.Time) *bucket {
+	b, ok := buckets[key]
+	if ok {
+		return b
+	}
+	if len(buckets) >= 4096 {
+		for k, b := range buckets {
+			if b.full(now) {
+				delete(buckets, k)
+			}
+		}
+	}
+	b = newBucket(r, now)
+	buckets[key] = b
+	return b
+}
+
+// bucket is a token bucket. tokens go negative when calls are waiting for tokens
+type bucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(r Rate, now time.Time) *bucket {
+	if r.Burst < 1 {
+		r.Burst = 1
+	}
+	return &bucket{rate: r, tokens: float64(r.Burst), last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate.PerSecond
+		if b.tokens > float64(b.rate.Burst) {
+			b.tokens = float64(b.rate.Burst)
+		}
+		b.last = now
+	}
+}
+
+// take takes a token and returns how long to wait until it is available
+func (b *bucket) take(now time.Time) time.Duration {
+	if b.rate.PerSecond <= 0 {
+		return 0
+	}
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate.PerSecond * float64(time.Second))
+}
+
+// give returns a token taken by a call which does not go through
+func (b *bucket) give() {
+	if b.rate.PerSecond > 0 {
+		b.tokens++
+	}
+}
+
+func (b *bucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= float64(b.rate.Burst)
+}
@@ -0,0 +1,41 @@
+package messengerbot_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+	"github.com/vimukthi-git/messengerbot/messengertest"
+)
+
+func TestSendRateLimited(t *testing.T) {
+	api := newSendServer(func(string, int) int { return 0 })
+	defer api.Close()
+	w := newWebhook(t, api)
+	w.UseRateLimiter(messengerbot.NewRateLimiter(messengerbot.Rate{}, messengerbot.Rate{},
+		messengerbot.Rate{PerSecond: 1, Burst: 1}, messengerbot.FAIL_WHEN_LIMITED))
+	message := func(recipient string) messengerbot.MessageEnvelope {
+		return messengerbot.MessageEnvelope{Recipient: messengerbot.Recipient{Id: recipient}, Message: messengerbot.NewTextMessage("hi", nil)}
+	}
+	ctx := context.Background()
+	if r, err := w.SendMessage(ctx, "page", message("a")); err != nil || r.MessageId != "mid.a.1" {
+		t.Errorf("sent %+v, %v", r, err)
+	}
+	if _, err := w.SendMessage(ctx, "page", message("a")); err != messengerbot.ErrRateLimited {
+		t.Errorf("second message returned %v", err)
+	}
+	if _, err := w.SendMessage(ctx, "page", message("b")); err != nil || len(api.CallsOf(messengertest.SEND_CALL)) != 2 {
+		t.Errorf("returned %v after %d calls", err, len(api.CallsOf(messengertest.SEND_CALL)))
+	}
+
+	w.UseRateLimiter(messengerbot.NewRateLimiter(messengerbot.Rate{PerSecond: 100, Burst: 1}, messengerbot.Rate{}, messengerbot.Rate{},
+		messengerbot.WAIT_WHEN_LIMITED))
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		w.SendTextMessageByRecipientId("c", "hi", nil, messengerbot.REGULAR)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond || len(textsTo(api, "c")) != 5 {
+		t.Errorf("sent %d messages in %v", len(textsTo(api, "c")), elapsed)
+	}
+}
@@ -0,0 +1,60 @@
+package messengerbot
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := newBucket(Rate{PerSecond: 10, Burst: 2}, now)
+	var waits []time.Duration
+	for i := 0; i < 4; i++ {
+		waits = append(waits, b.take(now))
+	}
+	if waits[0] != 0 || waits[1] != 0 || waits[2] != 100*time.Millisecond || waits[3] != 200*time.Millisecond {
+		t.Errorf("waits %v", waits)
+	}
+	if d := b.take(now.Add(time.Second)); d != 0 || !b.full(now.Add(2*time.Second)) {
+		t.Errorf("waited %v after refill", d)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(Rate{}, Rate{PerSecond: 1, Burst: 2}, Rate{PerSecond: 1, Burst: 1}, FAIL_WHEN_LIMITED)
+	ctx := context.Background()
+	calls := []struct {
+		page, recipient string
+		err             error
+	}{
+		{"page", "a", nil},
+		{"page", "a", ErrRateLimited},
+		{"page", "b", nil},
+		{"page", "c", ErrRateLimited},
+		{"other", "c", nil},
+	}
+	for _, c := range calls {
+		if err := l.Wait(ctx, c.page, c.recipient); err != c.err {
+			t.Errorf("%s to %s returned %v", c.page, c.recipient, err)
+		}
+	}
+	if s := l.Stats(); s.Calls != 3 || s.Rejected != 2 || s.Waited != 0 {
+		t.Errorf("stats %+v", s)
+	}
+
+	l = NewRateLimiter(Rate{PerSecond: 20, Burst: 1}, Rate{}, Rate{}, WAIT_WHEN_LIMITED)
+	l.Wait(ctx, "page", "a")
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.Wait(short, "page", "b"); err != ErrRateLimited || time.Since(start) > 10*time.Millisecond {
+		t.Errorf("returned %v after %v past the deadline", err, time.Since(start))
+	}
+	if err := l.Wait(ctx, "page", "b"); err != nil || time.Since(start) < 40*time.Millisecond {
+		t.Errorf("returned %v after %v", err, time.Since(start))
+	}
+	if s := l.Stats(); s.Calls != 2 || s.Waited != 1 || s.MaxWait < 40*time.Millisecond || s.AverageWait() != s.TotalWait/2 {
+		t.Errorf("stats %+v", s)
+	}
+}
@@ -0,0 +1,220 @@
+package messengerbot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+)
+
+// RecordedRequest is a webhook request as received, kept one per line in recordings
+type RecordedRequest struct {
+	Time   time.Time   `json:"time"`
+	Method string      `json:"method"`
+	Url    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	// Body is kept as a string, as requests which are not valid JSON are worth recording too
+	Body string `json:"body"`
+}
+
+// Redactor removes personal data from a request before it is recorded
+type Redactor func(r *RecordedRequest)
+
+// Recorder appends the webhook requests it sees to a recording file
+type Recorder struct {
+	mu        sync.Mutex
+	file      *os.File
+	redactors []Redactor
+	// maxBodySize is the length of the longest body recorded
+	maxBodySize int64
+}
+
+// NewRecorder opens the recording at path for appending, creating it when needed. The redactors are
+// applied, in order, to every request before it is written
+func NewRecorder(path string, redactors ...Redactor) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	m := new(Recorder)
+	m.file = file
+	m.redactors = redactors
+	m.maxBodySize = defaultMaxBodySize
+	return m, nil
+}
+
+// SetMaxBodySize changes the limit of request bodies, 1MB by default like the limit of the webhook, which
+// it should match. Longer bodies are answered with 413 without being recorded or passed on
+func (r *Recorder) SetMaxBodySize(n int64) {
+	r.maxBodySize = n
+}
+
+// Wrap returns a handler recording every request before passing it to h, e.g.
+// http.HandleFunc("/webhook", recorder.Wrap(w.Handler))
+func (r *Recorder) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, r.maxBodySize))
+		req.Body.Close()
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			log.Println("warning: not recording request over", tooLarge.Limit, "bytes")
+			http.Error(res, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err == nil {
+			r.Record(&RecordedRequest{Time: time.Now(), Method: req.Method, Url: req.URL.RequestURI(),
+				Header: req.Header.Clone(), Body: string(body)})
+		}
+		h(res, req)
+	}
+}
+
+// Record redacts and appends a request to the recording. Failures are logged, recording never stops the
+// request from being handled
+func (r *Recorder) Record(rr *RecordedRequest) {
+	for _, redact := range r.redactors {
+		redact(rr)
+	}
+	line, err := json.Marshal(rr)
+	if err != nil {
+		log.Println("warning: cannot encode recorded request :", err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		log.Println("warning: cannot write recorded request :", err)
+	}
+}
+
+// Close closes the recording file
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// RedactHeaders removes the given headers, e.g. "X-Hub-Signature"
+func RedactHeaders(names ...string) Redactor {
+	return func(r *RecordedRequest) {
+		for _, name := range names {
+			r.Header.Del(name)
+		}
+	}
+}
+
+// RedactFields replaces the string values of the given JSON fields of the body, wherever they appear, e.g.
+// RedactFields("text", "url") hides what users wrote and sent. Bodies which are not valid JSON are kept
+func RedactFields(fields ...string) Redactor {
+	redacted := make(map[string]bool)
+	for _, f := range fields {
+		redacted[f] = true
+	}
+	return rewriteBody(func(key string, value interface{}) interface{} {
+		if _, ok := value.(string); ok && redacted[key] {
+			return "REDACTED"
+		}
+		return value
+	})
+}
+
+// PseudonymizeIds replaces the ids of senders and recipients with a salted hash, so a recording still
+// tells users apart without revealing their PSIDs. Bodies which are not valid JSON are kept
+func PseudonymizeIds(salt string) Redactor {
+	return rewriteBody(func(key string, value interface{}) interface{} {
+		if m, ok := value.(map[string]interface{}); ok && (key == "sender" || key == "recipient") {
+			if id, ok := m["id"].(string); ok {
+				sum := sha256.Sum256([]byte(salt + id))
+				m["id"] = "psid-" + hex.EncodeToString(sum[:8])
+			}
+		}
+		return value
+	})
+}
+
+// rewriteBody decodes the body and passes every field of every object, depth first, to rewrite, which
+// returns the field's new value
+func rewriteBody(rewrite func(key string, value interface{}) interface{}) Redactor {
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for k, child := range t {
+				t[k] = rewrite(k, walk(child))
+			}
+		case []interface{}:
+			for i, child := range t {
+				t[i] = walk(child)
+			}
+		}
+		return v
+	}
+	return func(r *RecordedRequest) {
+		dec := json.NewDecoder(bytes.NewReader([]byte(r.Body)))
+		dec.UseNumber()
+		var body interface{}
+		if err := dec.Decode(&body); err != nil {
+			return
+		}
+		if out, err := json.Marshal(walk(body)); err == nil {
+			r.Body = string(out)
+		}
+	}
+}
+
+// ReadRecording reads all the requests of a recording
+func ReadRecording(path string) ([]*RecordedRequest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var requests []*RecordedRequest
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		rr := new(RecordedRequest)
+		if err := json.Unmarshal(scanner.Bytes(), rr); err != nil {
+			return nil, err
+		}
+		requests = append(requests, rr)
+	}
+	return requests, scanner.Err()
+}
+
+// Replay feeds the requests of a recording to the webhook's Handler. speed 1 keeps the original pace, 10
+// replays ten times faster and 0 without pauses. Point the webhook at a fake Graph API, e.g. a
+// messengertest.Server, so replies are not sent to real users
+func (w *Webhook) Replay(path string, speed float64) error {
+	requests, err := ReadRecording(path)
+	if err != nil {
+		return err
+	}
+	for i, rr := range requests {
+		if i > 0 && speed > 0 {
+			time.Sleep(time.Duration(float64(rr.Time.Sub(requests[i-1].Time)) / speed))
+		}
+		req, err := http.NewRequest(rr.Method, rr.Url, bytes.NewReader([]byte(rr.Body)))
+		if err != nil {
+			return err
+		}
+		for k, v := range rr.Header {
+			req.Header[k] = v
+		}
+		w.Handler(httptest.NewRecorder(), req)
+	}
+	return nil
+}
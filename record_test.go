@@ -0,0 +1,106 @@
+package messengerbot
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	rec, err := NewRecorder(path, RedactHeaders("X-Hub-Signature"), RedactFields("text"), PseudonymizeIds("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewMessengerWebhook("token", "token")
+	var texts []string
+	w.MessageHandler(func(pageId string, s Sender, r Recipient, ts time.Time, m IncomingTextMessage) bool {
+		texts = append(texts, s.Id+":"+m.Text)
+		return true
+	})
+	handler := rec.Wrap(w.Handler)
+	for _, text := range []string{"my phone is 555-1234", "hi"} {
+		req := httptest.NewRequest(http.MethodPost, "/webhook?x=1", strings.NewReader(
+			`{"object":"page","entry":[{"id":"page","time":1458692752478,"messaging":[{"sender":{"id":"1234"},
+			"recipient":{"id":"page"},"timestamp":1458692752478,"message":{"mid":"mid.1","seq":1,"text":"`+text+`"}}]}]}`))
+		req.Header.Set("X-Hub-Signature", "sha1=secret")
+		req.Header.Set("Content-Type", "application/json")
+		handler(httptest.NewRecorder(), req)
+		time.Sleep(20 * time.Millisecond)
+	}
+	rec.Close()
+	if !reflect.DeepEqual(texts, []string{"1234:my phone is 555-1234", "1234:hi"}) {
+		t.Fatalf("the recorder changed what the handler received: %q", texts)
+	}
+
+	requests, err := ReadRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("recorded %d requests", len(requests))
+	}
+	r := requests[0]
+	if r.Method != http.MethodPost || r.Url != "/webhook?x=1" || r.Header.Get("Content-Type") != "application/json" ||
+		r.Header.Get("X-Hub-Signature") != "" {
+		t.Errorf("recorded %+v", r)
+	}
+	if strings.Contains(r.Body, "555") || strings.Contains(r.Body, `"1234"`) ||
+		!strings.Contains(r.Body, `"text":"REDACTED"`) || !strings.Contains(r.Body, `"timestamp":1458692752478`) {
+		t.Errorf("recorded body %s", r.Body)
+	}
+
+	texts = nil
+	start := time.Now()
+	if err := w.Replay(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	fast := time.Since(start)
+	if len(texts) != 2 || texts[0] != texts[1] || strings.HasPrefix(texts[0], "1234") ||
+		!strings.HasSuffix(texts[0], ":REDACTED") {
+		t.Errorf("replayed %q", texts)
+	}
+	start = time.Now()
+	w.Replay(path, 1)
+	if paced := time.Since(start); paced < 15*time.Millisecond || paced < fast {
+		t.Errorf("replay at the original pace took %v", paced)
+	}
+}
+
+func TestRecordTooLarge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	rec, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.SetMaxBodySize(4)
+	var bodies []string
+	handler := rec.Wrap(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+	})
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(out)
+	for _, body := range []string{"{}", "[1,2]"} {
+		res := httptest.NewRecorder()
+		handler(res, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body)))
+		if want := map[string]int{"{}": http.StatusOK, "[1,2]": http.StatusRequestEntityTooLarge}[body]; res.Code != want {
+			t.Errorf("%s answered %d", body, res.Code)
+		}
+	}
+	rec.Close()
+	requests, err := ReadRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bodies, []string{"{}"}) || len(requests) != 1 || requests[0].Body != "{}" {
+		t.Errorf("handled %q, recorded %+v", bodies, requests)
+	}
+}
@@ -0,0 +1,206 @@
+package messengerbot
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// RouteCallback handles a text message matched by a route. captures holds the named groups of a
+// regular expression route and the remaining text of a prefix route under the key "rest"
+type RouteCallback func(c *Conversation, m IncomingTextMessage, captures map[string]string) bool
+
+type routeMatcher func(text string) (map[string]string, bool)
+
+// Route is a single text route registered on a Router
+type Route struct {
+	kind     string
+	pattern  string
+	match    routeMatcher
+	callback RouteCallback
+	priority int
+	order    int
+	pages    map[string]bool
+}
+
+// Priority sets the priority of the route. Routes with a higher priority are tried first, routes with
+// the same priority are tried in the order they were registered
+func (rt *Route) Priority(priority int) *Route {
+	rt.priority = priority
+	return rt
+}
+
+// Pages limits the route to messages received on the given pages
+func (rt *Route) Pages(pageIds ...string) *Route {
+	if rt.pages == nil {
+		rt.pages = make(map[string]bool)
+	}
+	for _, pageId := range pageIds {
+		rt.pages[pageId] = true
+	}
+	return rt
+}
+
+// Kind returns how the route matches: "exact", "keyword", "prefix" or "regexp"
+func (rt *Route) Kind() string {
+	return rt.kind
+}
+
+// Pattern returns the text, keyword, prefix or expression the route matches
+func (rt *Route) Pattern() string {
+	return rt.pattern
+}
+
+func (rt *Route) matches(pageId, text string) (map[string]string, bool) {
+	if rt.pages != nil && !rt.pages[pageId] {
+		return nil, false
+	}
+	return rt.match(text)
+}
+
+// Router dispatches incoming text messages to handlers registered by exact text, keyword, prefix or
+// regular expression. Messages no route matches go to the fallback handler if one is set, otherwise
+// to the webhook's text message callback
+type Router struct {
+	webhook  *Webhook
+	mu       sync.RWMutex
+	routes   []*Route
+	fallback RouteCallback
+}
+
+// NewRouter creates a router and attaches it to the given webhook
+func NewRouter(w *Webhook) *Router {
+	r := new(Router)
+	r.webhook = w
+	w.router = r
+	return r
+}
+
+// Exact routes messages whose text is exactly the given text
+func (r *Router) Exact(text string, cb RouteCallback) *Route {
+	return r.add("exact", text, func(t string) (map[string]string, bool) {
+		return map[string]string{}, t == text
+	}, cb)
+}
+
+// Keyword routes messages containing the given word, or the words of a phrase such as "good morning" one
+// after the other, ignoring case and punctuation
+func (r *Router) Keyword(keyword string, cb RouteCallback) *Route {
+	keywords := words(keyword)
+	return r.add("keyword", keyword, func(t string) (map[string]string, bool) {
+		text := words(t)
+		for i := 0; len(keywords) > 0 && i+len(keywords) <= len(text); i++ {
+			if equalWords(text[i:i+len(keywords)], keywords) {
+				return map[string]string{}, true
+			}
+		}
+		return nil, false
+	}, cb)
+}
+
+// Prefix routes messages starting with the given prefix. The text after the prefix is captured as "rest"
+func (r *Router) Prefix(prefix string, cb RouteCallback) *Route {
+	return r.add("prefix", prefix, func(t string) (map[string]string, bool) {
+		if !strings.HasPrefix(t, prefix) {
+			return nil, false
+		}
+		return map[string]string{"rest": strings.TrimPrefix(t, prefix)}, true
+	}, cb)
+}
+
+// Regexp routes messages matching the given regular expression, passing its named groups as captures.
+// It panics if the expression cannot be compiled
+func (r *Router) Regexp(expr string, cb RouteCallback) *Route {
+	re := regexp.MustCompile(expr)
+	return r.add("regexp", expr, func(t string) (map[string]string, bool) {
+		match := re.FindStringSubmatch(t)
+		if match == nil {
+			return nil, false
+		}
+		captures := make(map[string]string)
+		for i, name := range re.SubexpNames() {
+			if name != "" {
+				captures[name] = match[i]
+			}
+		}
+		return captures, true
+	}, cb)
+}
+
+// Fallback sets the handler for messages no route matches. It is optional: without it these messages reach
+// the webhook's text message callback, which it replaces for them once set
+func (r *Router) Fallback(cb RouteCallback) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = cb
+}
+
+func (r *Router) add(kind, pattern string, match routeMatcher, cb RouteCallback) *Route {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rt := &Route{kind: kind, pattern: pattern, match: match, callback: cb, order: len(r.routes)}
+	r.routes = append(r.routes, rt)
+	return rt
+}
+
+// Routes returns the routes in the order they are tried
+func (r *Router) Routes() []*Route {
+	r.mu.RLock()
+	routes := make([]*Route, len(r.routes))
+	copy(routes, r.routes)
+	r.mu.RUnlock()
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].priority != routes[j].priority {
+			return routes[i].priority > routes[j].priority
+		}
+		return routes[i].order < routes[j].order
+	})
+	return routes
+}
+
+// HasFallback reports whether a fallback handler is set
+func (r *Router) HasFallback() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.fallback != nil
+}
+
+// route calls the handler of the first matching route. The second return value is false when neither a
+// route nor the fallback handled the message
+func (r *Router) route(e *Event) (bool, bool) {
+	routes := r.Routes()
+	r.mu.RLock()
+	fallback := r.fallback
+	r.mu.RUnlock()
+
+	for _, rt := range routes {
+		if captures, ok := rt.matches(e.PageId, e.Message.Text); ok {
+			return rt.callback(e.Conversation(), *e.Message, captures), true
+		}
+	}
+	if fallback != nil {
+		return fallback(e.Conversation(), *e.Message, map[string]string{}), true
+	}
+	return false, false
+}
+
+// words splits lowercased text into words
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), isWordSeparator)
+}
+
+func equalWords(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func isWordSeparator(c rune) bool {
+	return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+}
@@ -0,0 +1,71 @@
+package messengerbot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRouter(t *testing.T) {
+	w := NewMessengerWebhook("token", "token")
+	r := NewRouter(w)
+	var got string
+	var captures map[string]string
+	record := func(name string) RouteCallback {
+		return func(c *Conversation, m IncomingTextMessage, cs map[string]string) bool {
+			got = name
+			captures = cs
+			return true
+		}
+	}
+	r.Exact("image", record("exact"))
+	r.Keyword("help", record("keyword"))
+	r.Prefix("/say ", record("prefix"))
+	r.Regexp(`^order (?P<id>\d+)$`, record("regexp"))
+	r.Keyword("urgent", record("urgent")).Priority(10)
+	r.Keyword("Good Morning", record("greeting"))
+	r.Exact("vip", record("vip")).Pages("page-2")
+	w.MessageHandler(func(pageId string, s Sender, rc Recipient, ts time.Time, m IncomingTextMessage) bool {
+		got = "default"
+		return true
+	})
+
+	cases := []struct {
+		page, text, want string
+	}{
+		{"page-1", "image", "exact"},
+		{"page-1", "Image", "default"},
+		{"page-1", "I need HELP!", "keyword"},
+		{"page-1", "helpful", "default"},
+		{"page-1", "/say hello", "prefix"},
+		{"page-1", "order 42", "regexp"},
+		{"page-1", "help, urgent", "urgent"},
+		{"page-1", "Good morning!", "greeting"},
+		{"page-1", "well, good  MORNING to you", "greeting"},
+		{"page-1", "good evening, morning person", "default"},
+		{"page-1", "goodmorning", "default"},
+		{"page-1", "vip", "default"},
+		{"page-2", "vip", "vip"},
+	}
+	for _, c := range cases {
+		got = ""
+		postTextMessage(w, c.page, "user", c.text)
+		if got != c.want {
+			t.Errorf("%s %q: routed to %q, want %q", c.page, c.text, got, c.want)
+		}
+	}
+
+	postTextMessage(w, "page-1", "user", "order 42")
+	if captures["id"] != "42" {
+		t.Errorf("captures = %v, want id=42", captures)
+	}
+	postTextMessage(w, "page-1", "user", "/say hello")
+	if captures["rest"] != "hello" {
+		t.Errorf("captures = %v, want rest=hello", captures)
+	}
+
+	r.Fallback(record("fallback"))
+	postTextMessage(w, "page-1", "user", "nothing matches")
+	if got != "fallback" {
+		t.Errorf("routed to %q, want fallback", got)
+	}
+}
@@ -0,0 +1,322 @@
+package messengerbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// messagingWindow is how long after a user interaction a page may message the user without a tag
+const messagingWindow = 24 * time.Hour
+
+// maxScheduleAttempts is how many times a job failing with a temporary error runs before it is dropped
+const maxScheduleAttempts = 5
+
+var ErrOutsideWindow = errors.New("messengerbot: more than 24 hours since the last interaction and no message tag")
+
+// ScheduledJob is a message to send to a recipient at a given time. Messages with a tag may be sent outside
+// the 24 hour window
+type ScheduledJob struct {
+	Id          string     `json:"id"`
+	PageId      string     `json:"page_id"`
+	RecipientId string     `json:"recipient_id"`
+	Message     *Message   `json:"message"`
+	RunAt       time.Time  `json:"run_at"`
+	Tag         MessageTag `json:"tag,omitempty"`
+	// Attempts is how many times the job failed with a temporary error
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// ScheduleStore stores the jobs of a scheduler and the time of the last interaction of each user with a
+// page. Jobs returns the jobs added and not removed. LastInteraction returns the zero time for users who
+// never interacted
+type ScheduleStore interface {
+	Add(job *ScheduledJob) error
+	Remove(id string) error
+	Jobs() ([]*ScheduledJob, error)
+	Touch(pageId, psid string, at time.Time) error
+	LastInteraction(pageId, psid string) (time.Time, error)
+}
+
+// ScheduleError is a scheduled job which could not be run
+type ScheduleError struct {
+	Job *ScheduledJob
+	Err error
+}
+
+func (e *ScheduleError) Error() string {
+	return e.Err.Error() + " : scheduled job " + e.Job.Id + " to " + e.Job.RecipientId
+}
+
+func (e *ScheduleError) Unwrap() error {
+	return e.Err
+}
+
+// Scheduler sends messages at a later time. Jobs are kept in a store so they run across restarts; jobs due
+// while the process was stopped run when the scheduler is created
+type Scheduler struct {
+	w     *Webhook
+	store ScheduleStore
+	mu    sync.Mutex
+	jobs  map[string]*ScheduledJob
+	// running holds the jobs being run, but not those cancelled while they run
+	running map[string]*ScheduledJob
+	// touched is when the last interaction of each user was stored
+	touched map[string]time.Time
+	seq     uint64
+	retry   time.Duration
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewScheduler creates a scheduler sending through the webhook, and the outbox of the webhook when it has
+// one, and starts running the jobs of the store. It adds a middleware to the webhook recording the
+// interactions of users, so whether a job is within the 24 hour window is checked when the job runs
+func (w *Webhook) NewScheduler(store ScheduleStore) (*Scheduler, error) {
+	jobs, err := store.Jobs()
+	if err != nil {
+		return nil, err
+	}
+	s := new(Scheduler)
+	s.w = w
+	s.store = store
+	s.jobs = make(map[string]*ScheduledJob)
+	for _, job := range jobs {
+		s.jobs[job.Id] = job
+	}
+	s.running = make(map[string]*ScheduledJob)
+	s.touched = make(map[string]time.Time)
+	s.retry = time.Minute
+	s.wake = make(chan struct{}, 1)
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	w.Use(s.middleware)
+	go s.run()
+	return s, nil
+}
+
+// Schedule adds a job sending the message to the recipient at the given time, and returns its id
+func (s *Scheduler) Schedule(pageId, recipientId string, m *Message, at time.Time, tag MessageTag) (string, error) {
+	job := &ScheduledJob{Id: fmt.Sprintf("%d.%d", time.Now().UnixNano(), atomic.AddUint64(&s.seq, 1)),
+		PageId: pageId, RecipientId: recipientId, Message: m, RunAt: at, Tag: tag}
+	if err := s.store.Add(job); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.jobs[job.Id] = job
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return job.Id, nil
+}
+
+// Cancel removes a job. Cancelling a job which already ran does nothing, and a job being run is not run
+// again if it fails
+func (s *Scheduler) Cancel(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, pending := s.jobs[id]
+	_, running := s.running[id]
+	if !pending && !running {
+		return nil
+	}
+	delete(s.jobs, id)
+	delete(s.running, id)
+	return s.store.Remove(id)
+}
+
+// CancelRecipient removes the jobs of a recipient of the page and returns how many were removed
+func (s *Scheduler) CancelRecipient(pageId, recipientId string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, jobs := range []map[string]*ScheduledJob{s.jobs, s.running} {
+		for id, job := range jobs {
+			if job.PageId == pageId && job.RecipientId == recipientId {
+				if err := s.store.Remove(id); err != nil {
+					return n, err
+				}
+				delete(jobs, id)
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// Pending returns the jobs which did not run yet, the earliest first
+func (s *Scheduler) Pending() []*ScheduledJob {
+	s.mu.Lock()
+	jobs := make([]*ScheduledJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	s.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].RunAt.Before(jobs[j].RunAt) })
+	return jobs
+}
+
+// RetryAfter sets how long a job which failed with a temporary error waits before running again, a minute by
+// default, doubling with each attempt up to an hour. Jobs are dropped after failing to send 5 times
+func (s *Scheduler) RetryAfter(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retry = d
+}
+
+// Close stops running jobs, which stay in the store, once the job being run is done
+func (s *Scheduler) Close() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+	for {
+		wait := s.runDue(time.Now())
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// runDue runs the jobs due at now, the earliest first, and returns how long until the next job
+func (s *Scheduler) runDue(now time.Time) time.Duration {
+	var due []*ScheduledJob
+	wait := time.Hour
+	s.mu.Lock()
+	for id, job := range s.jobs {
+		if d := job.RunAt.Sub(now); d > 0 {
+			if d < wait {
+				wait = d
+			}
+			continue
+		}
+		due = append(due, job)
+		delete(s.jobs, id)
+		s.running[id] = job
+	}
+	s.mu.Unlock()
+	sort.Slice(due, func(i, j int) bool { return due[i].RunAt.Before(due[j].RunAt) })
+	for _, job := range due {
+		// jobs may be cancelled while the earlier ones run
+		s.mu.Lock()
+		_, ok := s.running[job.Id]
+		s.mu.Unlock()
+		if ok {
+			s.runJob(job, now)
+		}
+	}
+	return wait
+}
+
+// runJob sends the message of a job when the recipient is within the 24 hour window or the job has a tag.
+// The job is removed from the store once the message is sent or handed to the outbox, so a job may run
+// twice if the process stops in between. Failures are reported to the error callback, and jobs which failed
+// with a temporary error, or whose window could not be checked, run again later
+func (s *Scheduler) runJob(job *ScheduledJob, now time.Time) {
+	envelope := MessageEnvelope{Recipient: Recipient{Id: job.RecipientId}, Message: job.Message, MessagingType: UPDATE}
+	if job.Tag != "" {
+		envelope.MessagingType = MESSAGE_TAG
+		envelope.Tag = job.Tag
+	} else if last, err := s.store.LastInteraction(job.PageId, job.RecipientId); err != nil {
+		// the window is checked again later
+		s.w.errorCallback(&ScheduleError{job, err})
+		s.reschedule(job, now)
+		return
+	} else if now.Sub(last) > messagingWindow {
+		s.w.errorCallback(&ScheduleError{job, ErrOutsideWindow})
+		s.remove(job)
+		return
+	}
+	if s.w.outbox != nil {
+		// the outbox retries the message and reports its failure
+		s.w.outbox.add(job.PageId, envelope)
+		s.remove(job)
+		return
+	}
+	if _, err := s.w.SendMessage(context.Background(), job.PageId, envelope); err != nil {
+		s.w.errorCallback(&ScheduleError{job, err})
+		if temporary(err) && job.Attempts+1 < maxScheduleAttempts {
+			s.reschedule(job, now)
+			return
+		}
+	}
+	s.remove(job)
+}
+
+// reschedule runs a job which failed again later. The job is copied, as the store may hold it
+func (s *Scheduler) reschedule(job *ScheduledJob, now time.Time) {
+	next := *job
+	next.Attempts++
+	s.mu.Lock()
+	if _, ok := s.running[job.Id]; !ok {
+		// cancelled while it ran
+		s.mu.Unlock()
+		return
+	}
+	delete(s.running, job.Id)
+	delay := s.retry
+	for i := 1; i < next.Attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	next.RunAt = now.Add(delay)
+	if err := s.store.Add(&next); err != nil {
+		log.Println("warning: cannot reschedule job ", job.Id, err)
+	}
+	s.jobs[next.Id] = &next
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) remove(job *ScheduledJob) {
+	s.mu.Lock()
+	_, ok := s.running[job.Id]
+	delete(s.running, job.Id)
+	s.mu.Unlock()
+	if !ok {
+		// cancelled while it ran, so already removed
+		return
+	}
+	if err := s.store.Remove(job.Id); err != nil {
+		log.Println("warning: cannot remove scheduled job ", job.Id, err)
+	}
+}
+
+// middleware records the interactions of users, at most once a minute per user
+func (s *Scheduler) middleware(next EventHandler) EventHandler {
+	return func(e *Event) bool {
+		if e.Type != DELIVERY_EVENT {
+			key := sessionKey(e.PageId, e.Sender.Id)
+			s.mu.Lock()
+			stale := e.Timestamp.Sub(s.touched[key]) > time.Minute
+			if stale {
+				s.touched[key] = e.Timestamp
+			}
+			s.mu.Unlock()
+			if stale {
+				if err := s.store.Touch(e.PageId, e.Sender.Id, e.Timestamp); err != nil {
+					log.Println("warning: cannot record interaction of ", e.Sender.Id, err)
+				}
+			}
+		}
+		return next(e)
+	}
+}
@@ -0,0 +1,149 @@
+package messengerbot
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	fileScheduleAdd    = "add"
+	fileScheduleRemove = "remove"
+	fileScheduleTouch  = "touch"
+)
+
+type fileScheduleRecord struct {
+	Op     string        `json:"op"`
+	Job    *ScheduledJob `json:"job,omitempty"`
+	Id     string        `json:"id,omitempty"`
+	PageId string        `json:"page_id,omitempty"`
+	UserId string        `json:"user_id,omitempty"`
+	At     time.Time     `json:"at,omitempty"`
+}
+
+// FileScheduleStore is a ScheduleStore persisting jobs and interactions to a log file, one JSON record per
+// change, and keeping them in memory. Interactions older than 24 hours are forgotten when the log is
+// compacted
+type FileScheduleStore struct {
+	mu           sync.Mutex
+	log          *appendLog
+	jobs         map[string]*ScheduledJob
+	interactions map[string]fileScheduleRecord
+}
+
+// NewFileScheduleStore opens the schedule log at path, creating it if it does not exist
+func NewFileScheduleStore(path string) (*FileScheduleStore, error) {
+	f := new(FileScheduleStore)
+	f.log = newAppendLog(path, "schedule")
+	f.jobs = make(map[string]*ScheduledJob)
+	f.interactions = make(map[string]fileScheduleRecord)
+	err := f.log.load(func(data []byte) error {
+		var r fileScheduleRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		f.apply(r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := f.compact(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileScheduleStore) apply(r fileScheduleRecord) {
+	switch r.Op {
+	case fileScheduleAdd:
+		if r.Job != nil {
+			f.jobs[r.Job.Id] = r.Job
+		}
+	case fileScheduleRemove:
+		delete(f.jobs, r.Id)
+	case fileScheduleTouch:
+		f.interactions[sessionKey(r.PageId, r.UserId)] = r
+	}
+}
+
+func (f *FileScheduleStore) append(r fileScheduleRecord) error {
+	if err := f.log.append(r); err != nil {
+		return err
+	}
+	f.apply(r)
+	// the change is durable, so a failed compaction must not fail it
+	f.log.compactIfFull(len(f.jobs)+len(f.interactions), f.snapshot)
+	return nil
+}
+
+// compact rewrites the log with a record per pending job and recent interaction
+func (f *FileScheduleStore) compact() error {
+	return f.log.compact(f.snapshot)
+}
+
+func (f *FileScheduleStore) snapshot(write func(r interface{}) error) error {
+	for _, job := range f.jobs {
+		if err := write(fileScheduleRecord{Op: fileScheduleAdd, Job: job}); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	for key, r := range f.interactions {
+		if now.Sub(r.At) > messagingWindow {
+			delete(f.interactions, key)
+			continue
+		}
+		if err := write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FileScheduleStore) Add(job *ScheduledJob) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.append(fileScheduleRecord{Op: fileScheduleAdd, Job: job})
+}
+
+func (f *FileScheduleStore) Remove(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.jobs[id]; !ok {
+		return nil
+	}
+	return f.append(fileScheduleRecord{Op: fileScheduleRemove, Id: id})
+}
+
+func (f *FileScheduleStore) Jobs() ([]*ScheduledJob, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	jobs := make([]*ScheduledJob, 0, len(f.jobs))
+	for _, job := range f.jobs {
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (f *FileScheduleStore) Touch(pageId, psid string, at time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r, ok := f.interactions[sessionKey(pageId, psid)]; ok && !at.After(r.At) {
+		return nil
+	}
+	return f.append(fileScheduleRecord{Op: fileScheduleTouch, PageId: pageId, UserId: psid, At: at})
+}
+
+func (f *FileScheduleStore) LastInteraction(pageId, psid string) (time.Time, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.interactions[sessionKey(pageId, psid)].At, nil
+}
+
+// Close closes the log file
+func (f *FileScheduleStore) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.log.close()
+}
@@ -0,0 +1,251 @@
+package messengerbot_test
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+	"github.com/vimukthi-git/messengerbot/messengertest"
+)
+
+func TestScheduler(t *testing.T) {
+	api := newSendServer(func(string, int) int { return 0 })
+	defer api.Close()
+	path := filepath.Join(t.TempDir(), "schedule.log")
+	store, err := messengerbot.NewFileScheduleStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := newWebhook(t, api)
+	var mu sync.Mutex
+	var errs []error
+	w.ErrorHandler(func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	})
+	s, err := w.NewScheduler(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messengertest.NewClient(w, "page").Text("user", "hi")
+
+	now := time.Now()
+	schedule := func(recipient, text string, after time.Duration, tag messengerbot.MessageTag) string {
+		id, err := s.Schedule("page", recipient, messengerbot.NewTextMessage(text, nil), now.Add(after), tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	schedule("user", "later", time.Hour, "")
+	schedule("user", "second", 40*time.Millisecond, "")
+	schedule("user", "first", 20*time.Millisecond, "")
+	s.Cancel(schedule("user", "cancelled", 10*time.Millisecond, ""))
+	schedule("stranger", "outside window", 10*time.Millisecond, "")
+	schedule("stranger", "tagged", 30*time.Millisecond, messengerbot.ACCOUNT_UPDATE)
+	schedule("gone", "one", 10*time.Millisecond, "")
+	schedule("gone", "two", 20*time.Millisecond, "")
+	if n, err := s.CancelRecipient("page", "gone"); n != 2 || err != nil {
+		t.Errorf("cancelled %d jobs of gone, %v", n, err)
+	}
+
+	if texts := waitForTexts(t, api, "user", 2); !reflect.DeepEqual(texts, []string{"first", "second"}) {
+		t.Errorf("user received %q", texts)
+	}
+	waitForTexts(t, api, "stranger", 1)
+	s.Close()
+	for _, e := range delivered(api) {
+		if e.Recipient.Id == "stranger" && (e.Message.DisplayText() != "tagged" || e.Tag != messengerbot.ACCOUNT_UPDATE) {
+			t.Errorf("stranger was sent %+v", e)
+		}
+	}
+	mu.Lock()
+	if len(errs) != 1 || !errors.Is(errs[0], messengerbot.ErrOutsideWindow) {
+		t.Errorf("errors %v", errs)
+	}
+	mu.Unlock()
+	if pending := s.Pending(); len(pending) != 1 || pending[0].Message.Text != "later" {
+		t.Errorf("pending %+v", pending)
+	}
+
+	// the process restarts while a job is due
+	store.Add(&messengerbot.ScheduledJob{Id: "missed", PageId: "page", RecipientId: "user", Message: messengerbot.NewTextMessage("missed", nil),
+		RunAt: now.Add(-time.Minute)})
+	store.Close()
+	if store, err = messengerbot.NewFileScheduleStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if last, _ := store.LastInteraction("page", "user"); now.Sub(last) > time.Minute {
+		t.Errorf("last interaction %v", last)
+	}
+	w = messengerbot.NewMessengerWebhook("token", "token")
+	api.Attach(w)
+	s, err = w.NewScheduler(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if texts := waitForTexts(t, api, "user", 3); texts[2] != "missed" {
+		t.Errorf("user received %q", texts)
+	}
+	s.Close()
+	if jobs, _ := store.Jobs(); len(jobs) != 1 || jobs[0].Message.Text != "later" {
+		t.Errorf("jobs %+v", jobs)
+	}
+}
+
+func TestSchedulerRetry(t *testing.T) {
+	// the first message to flaky fails with a temporary error, bad is not a valid recipient
+	api := newSendServer(func(recipient string, call int) int {
+		if recipient == "bad" {
+			return 100
+		}
+		if call == 1 {
+			return 2
+		}
+		return 0
+	})
+	defer api.Close()
+	store, err := messengerbot.NewFileScheduleStore(filepath.Join(t.TempDir(), "schedule.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	w := newWebhook(t, api)
+	var mu sync.Mutex
+	var errs []error
+	w.ErrorHandler(func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	})
+	s, err := w.NewScheduler(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RetryAfter(5 * time.Millisecond)
+	s.Schedule("page", "flaky", messengerbot.NewTextMessage("reminder", nil), time.Now(), messengerbot.ACCOUNT_UPDATE)
+	waitForTexts(t, api, "flaky", 1)
+	s.Schedule("page", "bad", messengerbot.NewTextMessage("never", nil), time.Now(), messengerbot.ACCOUNT_UPDATE)
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := len(errs)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+	}
+	s.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	var serrs []int
+	for _, err := range errs {
+		var jerr *messengerbot.ScheduleError
+		var serr *messengerbot.SendError
+		if errors.As(err, &jerr) && errors.As(err, &serr) {
+			serrs = append(serrs, serr.Code)
+		}
+	}
+	if !reflect.DeepEqual(serrs, []int{2, 100}) {
+		t.Errorf("errors %v", errs)
+	}
+	if jobs, _ := store.Jobs(); len(jobs) != 0 || len(s.Pending()) != 0 {
+		t.Errorf("jobs %+v", jobs)
+	}
+}
+
+func TestSchedulerCancelWhileRunning(t *testing.T) {
+	// the message fails with a temporary error once the job is cancelled
+	sending, cancelled := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	fail := sendResponder(func(string, int) int { return 2 })
+	api := messengertest.NewServer()
+	api.Respond(messengertest.SEND_CALL, func(c *messengertest.Call) (int, interface{}) {
+		once.Do(func() { close(sending) })
+		<-cancelled
+		return fail(c)
+	})
+	defer api.Close()
+	store, err := messengerbot.NewFileScheduleStore(filepath.Join(t.TempDir(), "schedule.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	w := newWebhook(t, api)
+	s, err := w.NewScheduler(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RetryAfter(time.Millisecond)
+	id, _ := s.Schedule("page", "user", messengerbot.NewTextMessage("reminder", nil), time.Now(), messengerbot.ACCOUNT_UPDATE)
+	<-sending
+	if err := s.Cancel(id); err != nil {
+		t.Fatal(err)
+	}
+	close(cancelled)
+	time.Sleep(20 * time.Millisecond)
+	s.Close()
+	if jobs, _ := store.Jobs(); len(jobs) != 0 || len(s.Pending()) != 0 {
+		t.Errorf("jobs %+v, pending %+v", jobs, s.Pending())
+	}
+	if calls := api.CallsOf(messengertest.SEND_CALL); len(calls) != 1 {
+		t.Errorf("%d messages sent", len(calls))
+	}
+}
+
+// flakyScheduleStore fails to return the first last interaction asked for
+type flakyScheduleStore struct {
+	*messengerbot.FileScheduleStore
+	failed int32
+}
+
+func (f *flakyScheduleStore) LastInteraction(pageId, psid string) (time.Time, error) {
+	if atomic.AddInt32(&f.failed, 1) == 1 {
+		return time.Time{}, errors.New("store unavailable")
+	}
+	return f.FileScheduleStore.LastInteraction(pageId, psid)
+}
+
+func TestSchedulerStoreFailure(t *testing.T) {
+	api := newSendServer(func(string, int) int { return 0 })
+	defer api.Close()
+	file, err := messengerbot.NewFileScheduleStore(filepath.Join(t.TempDir(), "schedule.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.Touch("page", "user", time.Now())
+	store := &flakyScheduleStore{FileScheduleStore: file}
+
+	w := newWebhook(t, api)
+	var mu sync.Mutex
+	var errs []error
+	w.ErrorHandler(func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	})
+	s, err := w.NewScheduler(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RetryAfter(5 * time.Millisecond)
+	s.Schedule("page", "user", messengerbot.NewTextMessage("reminder", nil), time.Now(), "")
+	waitForTexts(t, api, "user", 1)
+	s.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 1 || errors.Is(errs[0], messengerbot.ErrOutsideWindow) {
+		t.Errorf("errors %v", errs)
+	}
+}
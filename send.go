@@ -0,0 +1,118 @@
+package messengerbot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+)
+
+// SendResponse is the answer of the Send API to an accepted message. MessageId is empty for sender actions
+type SendResponse struct {
+	RecipientId string `json:"recipient_id"`
+	MessageId   string `json:"message_id"`
+}
+
+// SendError is a call to the Send API answered with an error
+type SendError struct {
+	Status       int    `json:"-"`
+	Message      string `json:"message"`
+	Type         string `json:"type"`
+	Code         int    `json:"code"`
+	ErrorSubcode int    `json:"error_subcode"`
+	FbtraceId    string `json:"fbtrace_id"`
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("messengerbot: send api answered %d : %s (code %d)", e.Status, e.Message, e.Code)
+}
+
+// Temporary reports whether sending the message again later may succeed, which is the case for server
+// errors and rate limits
+func (e *SendError) Temporary() bool {
+	switch e.Code {
+	case 1, 2, 4, 17, 32, 613:
+		return true
+	}
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests
+}
+
+// Blocked reports whether the recipient cannot be reached, because they blocked the page, deleted their
+// account or never talked to the page
+func (e *SendError) Blocked() bool {
+	return e.Code == 551 || (e.Code == 200 && e.ErrorSubcode == 1545041) || (e.Code == 100 && e.ErrorSubcode == 2018001)
+}
+
+// temporary reports whether an error of SendMessage may go away when sending again: a temporary error of
+// the Send API, a request which could not be made or timed out, or a message held back by the rate limiter.
+// An answer which cannot be decoded is not temporary, as the message may have been accepted
+func temporary(err error) bool {
+	var serr *SendError
+	if errors.As(err, &serr) {
+		return serr.Temporary()
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, ErrRateLimited) || errors.Is(err, ErrNotAnswered)
+}
+
+// SendMessage sends a message with the access token of the given page right away, without going through
+// the outbox, and returns the answer of the Send API. It waits for the rate limiter, giving up when ctx
+// is done
+func (w *Webhook) SendMessage(ctx context.Context, pageId string, data MessageEnvelope) (*SendResponse, error) {
+	if w.rateLimiter != nil {
+		r := data.Recipient
+		if err := w.rateLimiter.Wait(ctx, pageId, r.Id+r.PhoneNumber); err != nil {
+			return nil, err
+		}
+	}
+	url := w.graphApiUrl + "/me/messages?access_token=" + w.accessTokenForPage(pageId)
+	jsonStr, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("json : ", string(jsonStr))
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("response Status:", resp.Status)
+	log.Println("response Body:", string(body))
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, sendError(resp.StatusCode, body)
+	}
+	r := new(SendResponse)
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// sendError returns the Graph API error in the body of an answer with the given status
+func sendError(status int, body []byte) *SendError {
+	var answer struct {
+		Error *SendError `json:"error"`
+	}
+	if json.Unmarshal(body, &answer) != nil || answer.Error == nil {
+		answer.Error = &SendError{Message: http.StatusText(status)}
+	}
+	answer.Error.Status = status
+	return answer.Error
+}
@@ -0,0 +1,95 @@
+package messengerbot_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+	"github.com/vimukthi-git/messengerbot/messengertest"
+)
+
+// newSendServer starts a fake Graph API answering Send API calls with sendResponder
+func newSendServer(fail func(recipient string, call int) int) *messengertest.Server {
+	s := messengertest.NewServer()
+	s.Respond(messengertest.SEND_CALL, sendResponder(fail))
+	return s
+}
+
+// sendResponder fails the Send API calls, numbered from 1 including the operations of batch requests, with
+// the Graph error code fail returns, and lets them succeed when it returns 0. Messages get ids numbered per
+// recipient, such as mid.user.1
+func sendResponder(fail func(recipient string, call int) int) messengertest.Responder {
+	var mu sync.Mutex
+	calls := 0
+	messages := make(map[string]int)
+	return func(c *messengertest.Call) (int, interface{}) {
+		e, err := c.Envelope()
+		if err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if code := fail(e.Recipient.Id, calls); code != 0 {
+			status := http.StatusBadRequest
+			if code == 2 {
+				status = http.StatusServiceUnavailable
+			}
+			return status, map[string]messengertest.GraphError{"error": {Message: "failed", Type: "OAuthException", Code: code}}
+		}
+		if e.Message == nil {
+			return http.StatusOK, map[string]string{"recipient_id": e.Recipient.Id}
+		}
+		messages[e.Recipient.Id]++
+		return http.StatusOK, map[string]string{"recipient_id": e.Recipient.Id,
+			"message_id": fmt.Sprintf("mid.%s.%d", e.Recipient.Id, messages[e.Recipient.Id])}
+	}
+}
+
+// delivered returns the envelopes of the Send API calls which succeeded
+func delivered(s *messengertest.Server) []*messengertest.Envelope {
+	var envelopes []*messengertest.Envelope
+	for _, c := range s.CallsOf(messengertest.SEND_CALL) {
+		if e, err := c.Envelope(); err == nil && c.Status == http.StatusOK {
+			envelopes = append(envelopes, e)
+		}
+	}
+	return envelopes
+}
+
+// textsTo returns the texts of the messages delivered to the recipient
+func textsTo(s *messengertest.Server, recipient string) []string {
+	var texts []string
+	for _, e := range delivered(s) {
+		if e.Recipient.Id == recipient && e.Message != nil {
+			texts = append(texts, e.Message.DisplayText())
+		}
+	}
+	return texts
+}
+
+// waitForTexts waits until the recipient was delivered n texts
+func waitForTexts(t *testing.T, s *messengertest.Server, recipient string, n int) []string {
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(time.Millisecond) {
+		if texts := textsTo(s, recipient); len(texts) >= n {
+			return texts
+		}
+	}
+	t.Fatalf("%s did not receive %d texts", recipient, n)
+	return nil
+}
+
+// newWebhook returns a webhook sending through s, and silences the log until the test ends
+func newWebhook(t *testing.T, s *messengertest.Server) *messengerbot.Webhook {
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { log.SetOutput(out) })
+	w := messengerbot.NewMessengerWebhook("token", "token")
+	s.Attach(w)
+	return w
+}
@@ -0,0 +1,149 @@
+package messengerbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SequencePolicy is what a sequence does when a step fails
+type SequencePolicy string
+
+const (
+	// STOP_ON_FAILURE skips the steps after a failed step
+	STOP_ON_FAILURE SequencePolicy = "stop"
+	// CONTINUE_ON_FAILURE goes on with the next steps
+	CONTINUE_ON_FAILURE SequencePolicy = "continue"
+)
+
+// SequenceStep is a step of a sequence: a message, a sender action or a pause
+type SequenceStep struct {
+	Message      *Message
+	SenderAction SenderActionType
+	Pause        time.Duration
+}
+
+// StepError is a step of a sequence which failed
+type StepError struct {
+	Step int
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("%v : sequence step %d", e.Err, e.Step)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// Sequence is a list of messages, sender actions and pauses sent to a recipient in order, each step
+// waiting for the Send API to accept the previous one
+type Sequence struct {
+	steps  []SequenceStep
+	policy SequencePolicy
+	tag    MessageTag
+}
+
+// NewSequence creates an empty sequence stopping on failure
+func NewSequence() *Sequence {
+	s := new(Sequence)
+	s.policy = STOP_ON_FAILURE
+	return s
+}
+
+// Message adds a message to the sequence
+func (s *Sequence) Message(m *Message) *Sequence {
+	s.steps = append(s.steps, SequenceStep{Message: m})
+	return s
+}
+
+// Text adds a text message to the sequence
+func (s *Sequence) Text(text string) *Sequence {
+	return s.Message(NewTextMessage(text, nil))
+}
+
+// Action adds a sender action, such as TYPING_ON, to the sequence
+func (s *Sequence) Action(a SenderActionType) *Sequence {
+	s.steps = append(s.steps, SequenceStep{SenderAction: a})
+	return s
+}
+
+// Pause adds a pause to the sequence
+func (s *Sequence) Pause(d time.Duration) *Sequence {
+	s.steps = append(s.steps, SequenceStep{Pause: d})
+	return s
+}
+
+// OnFailure sets what the sequence does when a step fails
+func (s *Sequence) OnFailure(p SequencePolicy) *Sequence {
+	s.policy = p
+	return s
+}
+
+// Tag makes the messages of the sequence tagged messages
+func (s *Sequence) Tag(tag MessageTag) *Sequence {
+	s.tag = tag
+	return s
+}
+
+// Steps returns the steps of the sequence
+func (s *Sequence) Steps() []SequenceStep {
+	return s.steps
+}
+
+// SendSequence sends the steps of the sequence to the recipient one after the other, as updates unless the
+// sequence is tagged, and returns the message id of each step, empty for the steps which are not messages
+// or were not sent. Failed steps are returned as *StepError, joined when the sequence continues on failure.
+// Steps are sent right away, not through the outbox or the pacing of conversations, and pauses end early
+// when ctx is done
+func (w *Webhook) SendSequence(ctx context.Context, pageId string, r Recipient, s *Sequence) ([]string, error) {
+	return w.sendSequence(ctx, pageId, r, s, UPDATE)
+}
+
+// ReplySequence sends the sequence to the sender of the event as a response. See SendSequence
+func (c *Conversation) ReplySequence(ctx context.Context, s *Sequence) ([]string, error) {
+	return c.webhook.sendSequence(ctx, c.PageId, Recipient{Id: c.Sender.Id}, s, RESPONSE)
+}
+
+func (w *Webhook) sendSequence(ctx context.Context, pageId string, r Recipient, s *Sequence,
+	messagingType MessagingType) ([]string, error) {
+	ids := make([]string, len(s.steps))
+	var errs []error
+	for i, step := range s.steps {
+		var err error
+		switch {
+		case step.Message != nil:
+			envelope := MessageEnvelope{Recipient: r, Message: step.Message, MessagingType: messagingType}
+			if s.tag != "" {
+				envelope.MessagingType = MESSAGE_TAG
+				envelope.Tag = s.tag
+			}
+			var res *SendResponse
+			if res, err = w.SendMessage(ctx, pageId, envelope); err == nil {
+				ids[i] = res.MessageId
+			}
+		case step.SenderAction != "":
+			_, err = w.SendMessage(ctx, pageId, MessageEnvelope{Recipient: r, SenderAction: step.SenderAction})
+		default:
+			timer := time.NewTimer(step.Pause)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				err = ctx.Err()
+			}
+		}
+		if err != nil {
+			errs = append(errs, &StepError{i, err})
+			if s.policy == STOP_ON_FAILURE || ctx.Err() != nil {
+				break
+			}
+		}
+	}
+	if len(errs) == 1 {
+		return ids, errs[0]
+	}
+	return ids, errors.Join(errs...)
+}
@@ -0,0 +1,71 @@
+package messengerbot_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vimukthi-git/messengerbot"
+)
+
+func TestSequence(t *testing.T) {
+	// the sequences are sent one after the other, and the calls sending the texts saying fail are rejected
+	api := newSendServer(func(recipient string, call int) int {
+		if call == 6 || call == 7 || call == 9 {
+			return 100
+		}
+		return 0
+	})
+	defer api.Close()
+	w := newWebhook(t, api)
+	ctx := context.Background()
+
+	start := time.Now()
+	s := messengerbot.NewSequence().Text("Here it is").Action(messengerbot.TYPING_ON).Pause(20 * time.Millisecond).
+		Message(messengerbot.NewImageMessage("https://example.com/cat.png", nil)).Text("Enjoy")
+	ids, err := w.SendSequence(ctx, "page", messengerbot.Recipient{Id: "a"}, s)
+	if err != nil || !reflect.DeepEqual(ids, []string{"mid.a.1", "", "", "mid.a.2", "mid.a.3"}) {
+		t.Errorf("sent %q, %v", ids, err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("sequence took %v", elapsed)
+	}
+	if sent := api.Sent(); sent[1].SenderAction != messengerbot.TYPING_ON || sent[0].MessagingType != messengerbot.UPDATE {
+		t.Errorf("sent %+v", sent)
+	}
+	if texts := textsTo(api, "a"); !reflect.DeepEqual(texts, []string{"Here it is", "https://example.com/cat.png", "Enjoy"}) {
+		t.Errorf("a received %q", texts)
+	}
+
+	ids, err = w.SendSequence(ctx, "page", messengerbot.Recipient{Id: "b"}, messengerbot.NewSequence().Text("one").Text("fail").Text("three"))
+	var serr *messengerbot.StepError
+	if !errors.As(err, &serr) || serr.Step != 1 || !reflect.DeepEqual(ids, []string{"mid.b.1", "", ""}) {
+		t.Errorf("sent %q, %v", ids, err)
+	}
+	if texts := textsTo(api, "b"); !reflect.DeepEqual(texts, []string{"one"}) {
+		t.Errorf("b received %q", texts)
+	}
+
+	s = messengerbot.NewSequence().Text("fail").Text("two").Text("fail").OnFailure(messengerbot.CONTINUE_ON_FAILURE).Tag(messengerbot.ACCOUNT_UPDATE)
+	c := w.Conversation("page", messengerbot.Sender{Id: "c"}, messengerbot.Recipient{Id: "page"}, time.Now())
+	ids, err = c.ReplySequence(ctx, s)
+	if err == nil || strings.Count(err.Error(), "sequence step") != 2 || !reflect.DeepEqual(ids, []string{"", "mid.c.1", ""}) {
+		t.Errorf("sent %q, %v", ids, err)
+	}
+	sent := api.Sent()
+	if e := sent[len(sent)-1]; e.MessagingType != messengerbot.MESSAGE_TAG || e.Tag != messengerbot.ACCOUNT_UPDATE {
+		t.Errorf("sent %+v", e)
+	}
+
+	cancelled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	ids, err = w.SendSequence(cancelled, "page", messengerbot.Recipient{Id: "d"}, messengerbot.NewSequence().Pause(time.Minute).Text("late").
+		OnFailure(messengerbot.CONTINUE_ON_FAILURE))
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second || len(textsTo(api, "d")) != 0 {
+		t.Errorf("sent %q, %v after %v", ids, err, time.Since(start))
+	}
+}
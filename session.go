@@ -0,0 +1,200 @@
+package messengerbot
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Session holds the state of the conversation between a page and a user across events
+type Session struct {
+	PageId    string            `json:"page_id"`
+	UserId    string            `json:"user_id"`
+	Values    map[string]string `json:"values"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	dirty     bool
+	destroyed bool
+	// loaded is a copy of Values as loaded, so that changes made to Values directly are saved too
+	loaded map[string]string
+}
+
+// NewSession creates an empty session for the user identified by psid on the given page
+func NewSession(pageId, psid string) *Session {
+	return &Session{PageId: pageId, UserId: psid, Values: make(map[string]string)}
+}
+
+func (s *Session) Get(key string) string {
+	return s.Values[key]
+}
+
+func (s *Session) Set(key, value string) {
+	s.Values[key] = value
+	s.dirty = true
+}
+
+func (s *Session) Delete(key string) {
+	delete(s.Values, key)
+	s.dirty = true
+}
+
+// Destroy removes the session from the store once the current event has been handled
+func (s *Session) Destroy() {
+	s.destroyed = true
+}
+
+// SessionStore stores sessions keyed by page id and user PSID. Sessions expire when they have not been
+// set or touched for their ttl. Get returns a nil session without error when there is no live session
+type SessionStore interface {
+	Get(pageId, psid string) (*Session, error)
+	Set(s *Session, ttl time.Duration) error
+	Delete(pageId, psid string) error
+	Touch(pageId, psid string, ttl time.Duration) error
+}
+
+// UseSessionStore makes the webhook load the session of the sender into Event.Session before the
+// middlewares and callbacks run, and save it with the given ttl after they return. Sessions which were
+// not changed only have their ttl extended
+func (w *Webhook) UseSessionStore(store SessionStore, ttl time.Duration) {
+	w.sessionStore = store
+	w.sessionTTL = ttl
+}
+
+func (w *Webhook) loadSession(e *Event) {
+	s, err := w.sessionStore.Get(e.PageId, e.Sender.Id)
+	if err != nil {
+		log.Println("warning: cannot load session of ", e.Sender.Id, err)
+	}
+	if s == nil {
+		s = NewSession(e.PageId, e.Sender.Id)
+	}
+	s.loaded = copySession(s).Values
+	e.Session = s
+}
+
+func (w *Webhook) saveSession(e *Event) {
+	s := e.Session
+	var err error
+	if s.destroyed {
+		err = w.sessionStore.Delete(s.PageId, s.UserId)
+	} else if s.dirty || !sameValues(s.Values, s.loaded) {
+		s.UpdatedAt = time.Now()
+		s.dirty = false
+		err = w.sessionStore.Set(s, w.sessionTTL)
+	} else if !s.UpdatedAt.IsZero() {
+		err = w.sessionStore.Touch(s.PageId, s.UserId, w.sessionTTL)
+	}
+	if err != nil {
+		log.Println("warning: cannot save session of ", s.UserId, err)
+	}
+}
+
+func sameValues(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+type sessionEntry struct {
+	session *Session
+	expires time.Time
+}
+
+func sessionKey(pageId, psid string) string {
+	return pageId + ":" + psid
+}
+
+func copySession(s *Session) *Session {
+	c := *s
+	c.loaded = nil
+	c.Values = make(map[string]string, len(s.Values))
+	for k, v := range s.Values {
+		c.Values[k] = v
+	}
+	return &c
+}
+
+// MemorySessionStore is a SessionStore keeping sessions in memory. Expired sessions are never returned
+// and are removed by a background sweep
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]sessionEntry
+	stop     chan struct{}
+}
+
+// NewMemorySessionStore creates a memory session store sweeping expired sessions every sweepInterval
+func NewMemorySessionStore(sweepInterval time.Duration) *MemorySessionStore {
+	m := new(MemorySessionStore)
+	m.sessions = make(map[string]sessionEntry)
+	m.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.sweep()
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+	return m
+}
+
+func (m *MemorySessionStore) Get(pageId, psid string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.sessions[sessionKey(pageId, psid)]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, nil
+	}
+	return copySession(entry.session), nil
+}
+
+func (m *MemorySessionStore) Set(s *Session, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[sessionKey(s.PageId, s.UserId)] = sessionEntry{copySession(s), time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *MemorySessionStore) Delete(pageId, psid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, sessionKey(pageId, psid))
+	return nil
+}
+
+func (m *MemorySessionStore) Touch(pageId, psid string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := sessionKey(pageId, psid)
+	if entry, ok := m.sessions[key]; ok && time.Now().Before(entry.expires) {
+		entry.expires = time.Now().Add(ttl)
+		m.sessions[key] = entry
+	}
+	return nil
+}
+
+// Close stops the background sweep
+func (m *MemorySessionStore) Close() error {
+	close(m.stop)
+	return nil
+}
+
+func (m *MemorySessionStore) sweep() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for key, entry := range m.sessions {
+		if now.After(entry.expires) {
+			delete(m.sessions, key)
+		}
+	}
+}
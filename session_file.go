@@ -0,0 +1,150 @@
+package messengerbot
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	fileSessionSet    = "set"
+	fileSessionTouch  = "touch"
+	fileSessionDelete = "delete"
+)
+
+type fileSessionRecord struct {
+	Op      string    `json:"op"`
+	PageId  string    `json:"page_id"`
+	UserId  string    `json:"user_id"`
+	Session *Session  `json:"session,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// FileSessionStore is a SessionStore persisting sessions to a log file, one JSON record per change. All
+// live sessions are also kept in memory
+type FileSessionStore struct {
+	mu       sync.Mutex
+	log      *appendLog
+	sessions map[string]sessionEntry
+}
+
+// NewFileSessionStore opens the session log at path, creating it if it does not exist
+func NewFileSessionStore(path string) (*FileSessionStore, error) {
+	f := new(FileSessionStore)
+	f.log = newAppendLog(path, "session")
+	f.sessions = make(map[string]sessionEntry)
+	err := f.log.load(func(data []byte) error {
+		var r fileSessionRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		f.apply(r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := f.compact(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileSessionStore) apply(r fileSessionRecord) {
+	key := sessionKey(r.PageId, r.UserId)
+	switch r.Op {
+	case fileSessionSet:
+		if r.Session != nil {
+			if r.Session.Values == nil {
+				r.Session.Values = make(map[string]string)
+			}
+			f.sessions[key] = sessionEntry{r.Session, r.Expires}
+		}
+	case fileSessionTouch:
+		if entry, ok := f.sessions[key]; ok {
+			entry.expires = r.Expires
+			f.sessions[key] = entry
+		}
+	case fileSessionDelete:
+		delete(f.sessions, key)
+	}
+}
+
+func (f *FileSessionStore) append(r fileSessionRecord) error {
+	if err := f.log.append(r); err != nil {
+		return err
+	}
+	f.apply(r)
+	// the change is durable, so a failed compaction must not fail it
+	f.log.compactIfFull(len(f.sessions), f.snapshot)
+	return nil
+}
+
+// compact rewrites the log with a single record per live session, forgetting expired sessions
+func (f *FileSessionStore) compact() error {
+	return f.log.compact(f.snapshot)
+}
+
+func (f *FileSessionStore) snapshot(write func(r interface{}) error) error {
+	now := time.Now()
+	for key, entry := range f.sessions {
+		if now.After(entry.expires) {
+			delete(f.sessions, key)
+			continue
+		}
+		s := entry.session
+		if err := write(fileSessionRecord{fileSessionSet, s.PageId, s.UserId, s, entry.expires}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FileSessionStore) Get(pageId, psid string) (*Session, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry, ok := f.sessions[sessionKey(pageId, psid)]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, nil
+	}
+	return copySession(entry.session), nil
+}
+
+func (f *FileSessionStore) Set(s *Session, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.append(fileSessionRecord{fileSessionSet, s.PageId, s.UserId, copySession(s), time.Now().Add(ttl)})
+}
+
+func (f *FileSessionStore) Delete(pageId, psid string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.sessions[sessionKey(pageId, psid)]; !ok {
+		return nil
+	}
+	return f.append(fileSessionRecord{Op: fileSessionDelete, PageId: pageId, UserId: psid})
+}
+
+func (f *FileSessionStore) Touch(pageId, psid string, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry, ok := f.sessions[sessionKey(pageId, psid)]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	return f.append(fileSessionRecord{Op: fileSessionTouch, PageId: pageId, UserId: psid, Expires: time.Now().Add(ttl)})
+}
+
+// Compact rewrites the log with a single record per live session
+func (f *FileSessionStore) Compact() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.compact()
+}
+
+// Close closes the log file
+func (f *FileSessionStore) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.log.close()
+}
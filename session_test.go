@@ -0,0 +1,127 @@
+package messengerbot
+
+import (
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testSessionStore(t *testing.T, store SessionStore) {
+	if s, err := store.Get("page", "user"); s != nil || err != nil {
+		t.Fatalf("Get of missing session = %v, %v", s, err)
+	}
+	s := NewSession("page", "user")
+	s.Set("step", "1")
+	if err := store.Set(s, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	s.Set("step", "2")
+	got, err := store.Get("page", "user")
+	if err != nil || got.Get("step") != "1" {
+		t.Fatalf("Get = %v, %v, want the stored copy", got, err)
+	}
+	if err := store.Set(s, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Get("page", "user"); got != nil {
+		t.Errorf("Get of expired session = %v", got)
+	}
+	store.Set(s, time.Hour)
+	store.Delete("page", "user")
+	if got, _ := store.Get("page", "user"); got != nil {
+		t.Errorf("Get of deleted session = %v", got)
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	store := NewMemorySessionStore(time.Millisecond)
+	defer store.Close()
+	testSessionStore(t, store)
+
+	store.Set(NewSession("page", "other"), time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	store.mu.Lock()
+	n := len(store.sessions)
+	store.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d sessions left after sweep", n)
+	}
+}
+
+func TestFileSessionStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	store, err := NewFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSessionStore(t, store)
+
+	s := NewSession("page", "user")
+	for i := 0; i < 500; i++ {
+		s.Set("count", strconv.Itoa(i))
+		if err := store.Set(s, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.log.records > 102 {
+		t.Errorf("log holds %d records after compaction", store.log.records)
+	}
+	store.Close()
+
+	store, err = NewFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if got, _ := store.Get("page", "user"); got == nil || got.Get("count") != "499" {
+		t.Errorf("reopened store has session %v", got)
+	}
+}
+
+func TestWebhookSessions(t *testing.T) {
+	w := NewMessengerWebhook("token", "token")
+	store := NewMemorySessionStore(time.Minute)
+	defer store.Close()
+	w.UseSessionStore(store, time.Hour)
+	var counts []string
+	w.ConversationMessageHandler(func(c *Conversation, m IncomingTextMessage) bool {
+		n, _ := strconv.Atoi(c.Session.Get("count"))
+		c.Session.Set("count", strconv.Itoa(n+1))
+		counts = append(counts, c.Session.Get("count"))
+		if m.Text == "reset" {
+			c.Session.Destroy()
+		}
+		return true
+	})
+	postTextMessage(w, "page", "user", "hi")
+	postTextMessage(w, "page", "user", "hi")
+	postTextMessage(w, "page", "other", "hi")
+	postTextMessage(w, "page", "user", "reset")
+	postTextMessage(w, "page", "user", "hi")
+	want := []string{"1", "2", "1", "3", "1"}
+	for i := range want {
+		if counts[i] != want[i] {
+			t.Fatalf("counts = %v, want %v", counts, want)
+		}
+	}
+}
+
+func TestWebhookSessionValues(t *testing.T) {
+	w := NewMessengerWebhook("token", "token")
+	store := NewMemorySessionStore(time.Minute)
+	defer store.Close()
+	w.UseSessionStore(store, time.Hour)
+	var seen []string
+	w.ConversationMessageHandler(func(c *Conversation, m IncomingTextMessage) bool {
+		seen = append(seen, c.Session.Get("last"))
+		c.Session.Values["last"] = m.Text
+		return true
+	})
+	postTextMessage(w, "page", "user", "one")
+	postTextMessage(w, "page", "user", "two")
+	if s, _ := store.Get("page", "user"); !reflect.DeepEqual(seen, []string{"", "one"}) || s.Get("last") != "two" {
+		t.Errorf("seen %q, saved %+v", seen, s)
+	}
+}
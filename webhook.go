@@ -2,46 +2,87 @@ package messengerbot
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"time"
 )
 
+// ErrBodyTooLarge is a request whose body is longer than the limit set with SetMaxBodySize
+var ErrBodyTooLarge = errors.New("messengerbot: request body too large")
+
+// defaultMaxBodySize is the limit of request bodies, far above the largest batch of events Messenger posts
+const defaultMaxBodySize = 1 << 20
+
 type Webhook struct {
 	validationToken            string
 	pageAccessToken            string
+	pageAccessTokens           map[string]string
+	graphApiUrl                string
+	maxBodySize                int64
 	verifiedCallback           VerifiedCallback
 	verificationFailedCallback VerificationFailedCallback
 	optinCallback              OptinCallback
-	messageCallback            TextMessageCallback
-	attachmentMessageCallback  AttachementMessageCallback
-	deliveryCallback           DeliveryCallback
-	postbackCallback           PostbackCallback
+	errorCallback              ErrorCallback
+	messageHandler             EventHandler
+	attachmentMessageHandler   EventHandler
+	deliveryHandler            EventHandler
+	postbackHandler            EventHandler
+	middlewares                []Middleware
+	sessionStore               SessionStore
+	sessionTTL                 time.Duration
+	router                     *Router
+	dispatcher                 *Dispatcher
+	queue                      *eventQueue
+	locks                      conversationLocks
+	dedupStore                 DedupStore
+	dedupTTL                   time.Duration
+	outbox                     *outboxSender
+	rateLimiter                *RateLimiter
+	pacer                      *pacer
+	profiles                   *profileLoader
+	requests                   syncRequests
 }
 
 func NewMessengerWebhook(validationToken, pageAccessToken string) *Webhook {
 	m := new(Webhook)
 	m.validationToken = validationToken
 	m.pageAccessToken = pageAccessToken
+	m.pageAccessTokens = make(map[string]string)
+	m.graphApiUrl = "https://graph.facebook.com/v2.6"
+	m.maxBodySize = defaultMaxBodySize
+	m.profiles = newProfileLoader(m)
 	m.verifiedCallback = func() string {log.Println("Default verfied callback called"); return ""}
 	m.verificationFailedCallback = func() string {log.Println("Default verfication failed callback called"); return ""}
 	m.optinCallback = func() string {log.Println("Default optin callback called"); return ""}
-	m.messageCallback = func(id string, s Sender, r Recipient,
-		t time.Time, i IncomingTextMessage) bool {log.Println("Default text message callback called"); return true}
-	m.attachmentMessageCallback = func(id string, s Sender, r Recipient,
-		t time.Time, i IncomingAttachmentMessage) bool {
-		log.Println("Default attachment message callback called"); return true}
-	m.deliveryCallback = func(id string, s Sender, r Recipient,
-		e EventDelivery) bool {log.Println("Default delivery callback called"); return true}
-	m.postbackCallback = func(id string, s Sender, r Recipient,
-		t time.Time, e EventPostback) bool {log.Println("Default postback callback called"); return true}
+	m.errorCallback = func(err error) {log.Println("warning:", err)}
+	m.messageHandler = func(e *Event) bool {log.Println("Default text message callback called"); return true}
+	m.attachmentMessageHandler = func(e *Event) bool {log.Println("Default attachment message callback called"); return true}
+	m.deliveryHandler = func(e *Event) bool {log.Println("Default delivery callback called"); return true}
+	m.postbackHandler = func(e *Event) bool {log.Println("Default postback callback called"); return true}
 	return m
 }
 
+// SetGraphApiUrl changes the base url of the Graph API, e.g. to point the webhook at a local test server
+func (w *Webhook) SetGraphApiUrl(url string) {
+	w.graphApiUrl = url
+}
+
+// SetMaxBodySize changes the limit of request bodies, 1MB by default. Longer bodies are answered with 413
+// and reported to the error callback
+func (w *Webhook) SetMaxBodySize(n int64) {
+	w.maxBodySize = n
+}
+
+// AddPageAccessToken registers the access token to use when replying on behalf of the page identified
+// by pageId. Pages without a registered token use the token given to NewMessengerWebhook
+func (w *Webhook) AddPageAccessToken(pageId, pageAccessToken string) {
+	w.pageAccessTokens[pageId] = pageAccessToken
+}
+
 func (w *Webhook) VerfiedHandler(cb VerifiedCallback) {
 	w.verifiedCallback = cb
 }
@@ -54,259 +95,171 @@ func (w *Webhook) OptinHandler(cb OptinCallback) {
 	w.optinCallback = cb
 }
 
+// ErrorHandler sets the callback told about request bodies and messaging events which cannot be handled,
+// instead of logging them
+func (w *Webhook) ErrorHandler(cb ErrorCallback) {
+	w.errorCallback = cb
+}
+
 func (w *Webhook) MessageHandler(cb TextMessageCallback) {
-	w.messageCallback = cb
+	w.messageHandler = func(e *Event) bool {
+		return cb(e.PageId, e.Sender, e.Recipient, e.Timestamp, *e.Message)
+	}
 }
 
 func (w *Webhook) AttachmentHandler(cb AttachementMessageCallback) {
-	w.attachmentMessageCallback = cb
+	w.attachmentMessageHandler = func(e *Event) bool {
+		return cb(e.PageId, e.Sender, e.Recipient, e.Timestamp, *e.Attachment)
+	}
 }
 
 func (w *Webhook) DeliveryHandler(cb DeliveryCallback) {
-	w.deliveryCallback = cb
+	w.deliveryHandler = func(e *Event) bool {
+		return cb(e.PageId, e.Sender, e.Recipient, *e.Delivery)
+	}
 }
 
 func (w *Webhook) PostbackHandler(cb PostbackCallback) {
-	w.postbackCallback = cb
+	w.postbackHandler = func(e *Event) bool {
+		return cb(e.PageId, e.Sender, e.Recipient, e.Timestamp, *e.Postback)
+	}
 }
 
+// Handler answers the subscription verification and handles the events posted to the webhook, or queues
+// them when the webhook is asynchronous. The events of a conversation are handled one at a time, in the
+// order of their timestamps within a request. Bodies which are not JSON are answered with 400 and reported to
+// the error callback, as are messaging events which cannot be parsed, which are left out while the other
+// events of the request are handled. Bodies over the limit of SetMaxBodySize are answered with 413
 func (w *Webhook) Handler(res http.ResponseWriter, req *http.Request) {
-
-	////////////////////////////////////////////////////////
-	// TODO REFACTOR THIS SHIT
-	////////////////////////////////////////////////////////
 	if req.Method == http.MethodGet {
 		hubMode := req.URL.Query().Get("hub.mode")
 		hubVerfifyToken := req.URL.Query().Get("hub.verify_token")
 		hubChallenge := req.URL.Query().Get("hub.challenge")
 		if hubMode == "subscribe" && hubVerfifyToken == w.validationToken {
 			log.Println("valid token")
-			fmt.Fprintf(res, hubChallenge)
+			fmt.Fprint(res, hubChallenge)
 		} else {
 			log.Println("invalid token")
 			fmt.Fprintf(res, "O")
 		}
 	} else if req.Method == http.MethodPost {
 		log.Println("message received")
-		dec := json.NewDecoder(req.Body)
-		for {
-			var d map[string]interface{}
-			if err := dec.Decode(&d); err == io.EOF {
-				break
-			} else if err != nil {
-				log.Fatal(err)
+		body, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, w.maxBodySize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				w.errorCallback(fmt.Errorf("%w : over %d bytes", ErrBodyTooLarge, tooLarge.Limit))
+				http.Error(res, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			} else {
+				w.errorCallback(err)
+				http.Error(res, "Bad Request", http.StatusBadRequest)
 			}
+			return
+		}
+		events, err := w.parseRequest(bytes.NewReader(body))
+		if err != nil {
+			w.errorCallback(err)
+			http.Error(res, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		orderEvents(events)
+		if w.queue != nil {
+			if !w.queue.enqueue(w, events) {
+				http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		} else if !w.dispatchSync(events) {
+			http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(res, "OK")
+	} else {
+		http.Error(res, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
 
-			if d["object"] == "page" {
-				// process page entries
-				for _, pageEntryInterface := range d["entry"].([]interface{}) {
-					pageEntry := pageEntryInterface.(map[string]interface{})
-					pageId := pageEntry["id"].(string)
-					// process events
-					for _, messagingEventInterface := range pageEntry["messaging"].([]interface{}) {
-						messagingEvent := messagingEventInterface.(map[string]interface{})
-						// find sender and receiver
-						sender := Sender{messagingEvent["sender"].(map[string]interface{})["id"].(string)}
-						recipient := Recipient{Id: messagingEvent["recipient"].(map[string]interface{})["id"].(string)}
-
-						// decide which type of message and handle accordingly
-						if optin, ok := messagingEvent["optin"]; ok {
-							log.Println("optin : ", optin)
-						} else if message, ok := messagingEvent["message"]; ok {
-							sentTime := int64(messagingEvent["timestamp"].(float64))
-							msg := message.(map[string]interface{})
-							if attachments, ok := msg["attachments"].([]interface{}); ok {
-								log.Println(attachments)
-								for _, attachment := range attachments {
-									stop := false
-									attachmentMap, ok_attachmentMap := attachment.(map[string]interface{})
-									if !ok_attachmentMap {
-										stop = true
-										log.Println("warning: cannot attachment to map[string]interface{}")
-									}
-
-									attachmentPayload, ok_attachmentPayload := attachmentMap["payload"].(map[string]interface{})
-									if !ok_attachmentPayload {
-										stop = true
-										log.Println("warning: cannot cast attachmentMap[\"payload\"] to map[string]interface{}")
-									}
-
-									str_mid, ok_mid := msg["mid"].(string)
-									if !ok_mid {
-										stop = true
-										log.Println("warning: cannot cast msg[\"mid\"] to string", msg["mid"])
-									}
-
-									float_seq, ok_seq := msg["seq"].(float64);
-									if !ok_seq {
-										stop = true
-										log.Println("warning: cannot cast msg[\"seq\"] to float")
-									}
-
-									str_type, ok_type := attachmentMap["type"].(string)
-									if !ok_type {
-										stop = true
-										log.Println("warning: cannot cast attachmentMap[\"type\"] to string")
-									}
-
-									str_url, ok_url := attachmentPayload["url"].(string);
-									if !ok_url {
-										stop = true
-										log.Println("warning: cannot cast attachmentPayload[\"url\"].(string)} to string")
-									}
-
-									if !stop {
-										w.attachmentMessageCallback(pageId, sender, recipient, time.Unix(sentTime, 0),
-										IncomingAttachmentMessage{str_mid, float_seq, str_type, str_url})
-									} else {
-										log.Println("warning: attachmentMessageCallback stopped due to casting errors")
-									}
-								}
-							} else {
-								stop := false
-
-								str_mid, ok_mid := msg["mid"].(string)
-								if !ok_mid {
-									stop = true
-									log.Println("warning: cannot cast msg[\"mid\"] to string")
-								}
-
-								str_text, ok_text := msg["text"].(string)
-								if !ok_text {
-									stop = true
-									log.Println("warning: cannot cast msg[\"text\"] to string")
-								}
-
-								var quickReply *QuickReply = nil
-								if quickReplyObj, ok := msg["quick_reply"]; ok {
-									if quickReplyMap, ok := quickReplyObj.(map[string]interface{}); ok {
-										if quickReplyPayload, ok := quickReplyMap["payload"].(string); ok {
-											quickReply = &QuickReply{Payload: quickReplyPayload}
-										}
-									}
-									log.Println("warning: cannot cast msg[\"text\"] to string")
-								}
-
-								float_seq, ok_seq := msg["seq"].(float64);
-								if !ok_seq {
-									stop = true
-									log.Println("warning: cannot cast msg[\"seq\"] to float")
-								}
-
-								if !stop {
-									w.messageCallback(pageId, sender, recipient, time.Unix(sentTime, 0),
-									IncomingTextMessage{str_mid, float_seq, str_text, quickReply})
-								} else {
-									log.Println("warning: messageCallback stopped due to casting errors")
-								}
-							}
-						} else if delivery, ok := messagingEvent["delivery"]; ok {
-							del := delivery.(map[string]interface{})
-							stop := false
-							float_seq, ok_seq := del["seq"].(float64);
-							if !ok_seq {
-								stop = true
-								log.Println("warning: cannot cast del[\"seq\"] to float")
-							}
-
-							float_wmrk, ok_wmrk := del["watermark"].(float64);
-							if !ok_wmrk {
-								stop = true
-								log.Println("warning: cannot cast del[\"watermark\"] to float")
-							}
-
-							if !stop {
-								mids, ok_mids := del["mids"].([]interface{});
-
-								if !ok_mids {
-									log.Println("warning: deliveryCallback stopped, del[\"mids\"] is not an array")
-								} else {
-									for _, mid := range mids {
-										nested := false
-
-										str_mid, ok_mid := mid.(string)
-										if !ok_mid {
-											nested = true
-											log.Println("warning: cannot cast object of mids to string")
-										}
-
-										if !nested {
-											w.deliveryCallback(pageId, sender, recipient,
-											EventDelivery{str_mid, float_wmrk, float_seq})
-										} else {
-											log.Println("warning: deliveryCallback stopped due to casting errors")
-										}
-									}
-								}
-							} else {
-								log.Println("warning: all deliveryCallback's stopped due to casting errors")
-							}
-						} else if postback, ok := messagingEvent["postback"]; ok {
-							sentTime := int64(messagingEvent["timestamp"].(float64))
-							pos := postback.(map[string]interface{})
-
-							stop := false
-
-							str_payload, ok_payload := pos["payload"].(string)
-							if !ok_payload {
-								stop = true
-								log.Println("warning: cannot cast pos[\"payload\"] to string")
-							}
+// handleEvent calls the callback registered for the type of the event
+func (w *Webhook) handleEvent(e *Event) bool {
+	switch e.Type {
+	case OPTIN_EVENT:
+		log.Println("optin : ", e.Optin.Ref)
+		w.optinCallback()
+		return true
+	case MESSAGE_EVENT:
+		return w.handleTextMessage(e)
+	case ATTACHMENT_EVENT:
+		return w.attachmentMessageHandler(e)
+	case DELIVERY_EVENT:
+		return w.deliveryHandler(e)
+	case POSTBACK_EVENT:
+		return w.handlePostback(e)
+	}
+	log.Println("unknown event type : ", e.Type)
+	return false
+}
 
-							if !stop {
-								w.postbackCallback(pageId, sender, recipient, time.Unix(sentTime, 0),
-								EventPostback{str_payload})
-							} else {
-								log.Println("warning: postbackCallback stopped due to casting errors")
-							}
-						} else {
-							log.Println("unknown event : ", messagingEvent)
-						}
-					}
-				}
+// handleTextMessage gives the dispatcher a chance to handle the quick reply and the router a chance to
+// handle the text before the text message callback
+func (w *Webhook) handleTextMessage(e *Event) bool {
+	if w.dispatcher != nil && e.Message.QuickReply != nil {
+		if handled, ok := w.dispatcher.dispatch(e, e.Message.QuickReply.Payload); ok {
+			return handled
+		}
+	}
+	if w.router != nil {
+		if handled, ok := w.router.route(e); ok {
+			return handled
+		}
+	}
+	return w.messageHandler(e)
+}
 
-			}
+// handlePostback gives the dispatcher a chance to handle the payload before the postback callback
+func (w *Webhook) handlePostback(e *Event) bool {
+	if w.dispatcher != nil {
+		if handled, ok := w.dispatcher.dispatch(e, e.Postback.Payload); ok {
+			return handled
 		}
-		fmt.Fprintf(res, "OK")
 	}
+	return w.postbackHandler(e)
 }
 
 // SendSenderActionByRecipientId send the given message text to the recipient identified by the given
 // recipientId
 func (w *Webhook) SendSenderActionByRecipientId(recipientId string, senderAction SenderActionType) {
-	w.callSendApi(MessageEnvelope{Recipient{Id:recipientId}, nil,
-		senderAction, ""})
+	w.callSendApi(MessageEnvelope{Recipient: Recipient{Id:recipientId}, SenderAction: senderAction})
 }
 
 // SendTextMessageByRecipientId send the given message text to the recipient identified by the given
 // recipientId
 func (w *Webhook) SendTextMessageByRecipientId(recipientId, messageText string,
 	quickReplies []QuickReply, notificationType NotificationType) {
-	w.callSendApi(MessageEnvelope{Recipient{Id:recipientId}, NewTextMessage(messageText, quickReplies),
-		"", notificationType})
+	w.callSendApi(MessageEnvelope{Recipient: Recipient{Id:recipientId},
+		Message: NewTextMessage(messageText, quickReplies), NotificationType: notificationType})
 }
 
 // SendImageMessageByRecipientId send the image given by the imageUrl to the recipient identified by the given
 // recipientId
 func (w *Webhook) SendImageMessageByRecipientId(recipientId, imageUrl string, quickReplies []QuickReply,
 	notificationType NotificationType) {
-	w.callSendApi(MessageEnvelope{Recipient{Id:recipientId}, NewImageMessage(imageUrl, quickReplies), "", notificationType})
+	w.callSendApi(MessageEnvelope{Recipient: Recipient{Id:recipientId},
+		Message: NewImageMessage(imageUrl, quickReplies), NotificationType: notificationType})
 }
 
 // SendButtonMessageByRecipientId send the buttons given to the recipient identified by the given
 // recipientId
 func (w *Webhook) SendButtonMessageByRecipientId(recipientId, text string, buttons []Button,
 	quickReplies []QuickReply, notificationType NotificationType) {
-	w.callSendApi(MessageEnvelope{Recipient{Id:recipientId}, NewButtonMessage(text, buttons, quickReplies),
-		"", notificationType})
+	w.callSendApi(MessageEnvelope{Recipient: Recipient{Id:recipientId},
+		Message: NewButtonMessage(text, buttons, quickReplies), NotificationType: notificationType})
 }
 
 // SendGenericMessageByRecipientId send the generic message to the recipient identified by the given
 // recipientId
 func (w *Webhook) SendGenericMessageByRecipientId(recipientId string, elements []GenericTemplateElement,
 	quickReplies []QuickReply, notificationType NotificationType) {
-	w.callSendApi(MessageEnvelope{Recipient{Id:recipientId}, NewGenericMessage(elements, quickReplies),
-		"", notificationType})
+	w.callSendApi(MessageEnvelope{Recipient: Recipient{Id:recipientId},
+		Message: NewGenericMessage(elements, quickReplies), NotificationType: notificationType})
 }
 
 // SendReceiptMessageByRecipientId send the receipt message to the recipient identified by the given
@@ -317,39 +270,44 @@ func (w *Webhook) SendReceiptMessageByRecipientId(recipientId, recipientName, or
 	notificationType NotificationType) {
 
 	w.callSendApi(MessageEnvelope{
-		Recipient{Id:recipientId},
-		NewReceiptMessage(
+		Recipient: Recipient{Id:recipientId},
+		Message: NewReceiptMessage(
 			recipientName, orderNumber,
 			currency, paymentMethod,
 			timestamp, orderUrl, elements,
 			shippingAddress, paymentSummary, adjustments,
 			quickReplies,
 		),
-		"",
-		notificationType,
+		NotificationType: notificationType,
 	})
 }
 
 func (w *Webhook) callSendApi(data MessageEnvelope) {
-	url := "https://graph.facebook.com/v2.6/me/messages?access_token=" + w.pageAccessToken
-	jsonStr, e := json.Marshal(data)
-	if e != nil {
-		log.Fatal("Error in marshalling data")
+	w.callSendApiForPage("", data)
+}
+
+// accessTokenForPage returns the access token registered for pageId, falling back to the default
+// page access token
+func (w *Webhook) accessTokenForPage(pageId string) string {
+	if token, ok := w.pageAccessTokens[pageId]; ok {
+		return token
 	}
-	log.Println("json : ", string(jsonStr))
-	log.Println("url : ", url)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
-	req.Header.Set("Content-Type", "application/json")
+	return w.pageAccessToken
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(err)
+// callSendApiForPage sends a message with the access token of the given page, through the outbox when
+// the webhook has one
+func (w *Webhook) callSendApiForPage(pageId string, data MessageEnvelope) {
+	if w.outbox != nil {
+		w.outbox.add(pageId, data)
+		return
+	}
+	if _, err := w.SendMessage(context.Background(), pageId, data); err != nil {
+		log.Println("warning: send api call failed :", err)
 	}
-	defer resp.Body.Close()
+}
 
-	fmt.Println("response Status:", resp.Status)
-	fmt.Println("response Headers:", resp.Header)
-	body, _ := ioutil.ReadAll(resp.Body)
-	fmt.Println("response Body:", string(body))
+// msToTime converts the millisecond timestamps of webhook events to time
+func msToTime(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
 }
@@ -2,12 +2,34 @@ package messengerbot
 
 import (
 	"testing"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"time"
 )
 
+// postMessagingEvent posts a webhook request with the given messaging event json to the handler
+func postMessagingEvent(w *Webhook, pageId, senderId, event string) {
+	body := fmt.Sprintf(`{"object":"page","entry":[{"id":%q,"time":1458692752478,"messaging":[{
+		"sender":{"id":%q},"recipient":{"id":%q},"timestamp":1458692752478,%s}]}]}`,
+		pageId, senderId, pageId, event)
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	w.Handler(httptest.NewRecorder(), req)
+}
+
+func postTextMessage(w *Webhook, pageId, senderId, text string) {
+	postMessagingEvent(w, pageId, senderId,
+		fmt.Sprintf(`"message":{"mid":"mid.1457764197618:41d102a3e1ae206a38","seq":73,"text":%q}`, text))
+}
+
+// TestWebhook serves a demo bot on :8080 for a real page until it is killed. It only runs when config.json
+// holds the tokens of the page, see messengertest for testing bots offline
 func TestWebhook(t *testing.T) {
-	config := getTestConfig();
+	config, err := getTestConfig()
+	if err != nil {
+		t.Skip("no usable config.json, skipping the live webhook :", err)
+	}
 	w := NewMessengerWebhook(config.ValidationToken, config.PageAccessToken)
 	w.MessageHandler(func(pageId string, s Sender, r Recipient, t time.Time, m IncomingTextMessage) bool {
 		switch m.Text {